@@ -0,0 +1,315 @@
+package sbus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+	"github.com/wwengg/threego/core/slog"
+	"github.com/wwengg/threego/core/smsg"
+)
+
+const (
+	// ClusterDefaultMsgID is the msgID of the messages forwarded between the nodes, it must not be used by
+	// the other routers of the Nsq (节点之间转发消息的msgID，不能被Nsq的其他路由使用)
+	ClusterDefaultMsgID uint16 = 3
+	// ClusterTopicPrefix + nodeID is the NSQ topic of the node (ClusterTopicPrefix + nodeID为节点的NSQ topic)
+	ClusterTopicPrefix = "sbus_node_"
+
+	clusterRegistryTimeout = 3 * time.Second
+	// ClusterDefaultKeepAlive is the interval of marking the node alive in the SUserRegistry, the node is
+	// alive for 3 intervals (在SUserRegistry中标记节点存活的间隔，节点存活3个间隔)
+	ClusterDefaultKeepAlive = 10 * time.Second
+
+	// The metadata keys of the forwarded messages (转发消息的metadata key)
+	clusterMetaOp     = "op"
+	clusterMetaUID    = "uid"
+	clusterMetaDevice = "device"
+	clusterMetaConnID = "connID"
+
+	clusterOpUser = "user"
+	clusterOpConn = "conn"
+	clusterOpKick = "kick"
+)
+
+var (
+	ErrUserOffline     = errors.New("user is offline")
+	ErrInvalidConnAddr = errors.New("invalid cluster connection address")
+)
+
+type ClusterOption func(r *ClusterRouter)
+
+// WithClusterMsgID sets the msgID of the forwarded messages (设置转发消息的msgID)
+func WithClusterMsgID(msgID uint16) ClusterOption {
+	return func(r *ClusterRouter) {
+		r.msgID = msgID
+	}
+}
+
+// WithClusterRegistryTimeout sets the timeout of the registry calls made by the user hooks
+// (设置用户钩子调用注册中心的超时时间)
+func WithClusterRegistryTimeout(timeout time.Duration) ClusterOption {
+	return func(r *ClusterRouter) {
+		r.registryTimeout = timeout
+	}
+}
+
+// WithClusterKeepAlive sets the interval of marking the node alive in the SUserRegistry,
+// ClusterDefaultKeepAlive by default (设置在SUserRegistry中标记节点存活的间隔，默认为ClusterDefaultKeepAlive)
+func WithClusterKeepAlive(interval time.Duration) ClusterOption {
+	return func(r *ClusterRouter) {
+		r.keepAlive = interval
+	}
+}
+
+// ClusterRouter routes the messages to the users and connections on any gateway node, every node consumes
+// its own NSQ topic, the users bound by ConnManager.BindUser are registered in the SUserRegistry, so a
+// message to a user on another node is forwarded to the topic of that node
+// (在任意网关节点之间路由发给用户和连接的消息，每个节点消费自己的NSQ topic，通过ConnManager.BindUser绑定的用户
+// 会注册到SUserRegistry，发给其他节点上用户的消息会被转发到该节点的topic)
+type ClusterRouter struct {
+	BaseRouter
+	nodeID          string
+	topic           string
+	msgID           uint16
+	registryTimeout time.Duration
+	keepAlive       time.Duration
+	nsq             *Nsq
+	connMgr         SConnManager
+	registry        SUserRegistry
+	// publish sends the packed message to the topic of a node (将封包后的消息发送到节点的topic)
+	publish func(topic string, data []byte) error
+
+	closeOnce sync.Once
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// NewClusterRouter creates the router of nodeID, it consumes the topic of the node through n, so n.Start
+// must be called after it, the user hooks are added to connMgr, the node is kept alive in the registry
+// until Close
+// (创建nodeID的路由，通过n消费节点的topic，所以必须在其之后调用n.Start，用户钩子会添加到connMgr上，
+// 在Close之前节点会在注册中心中保持存活)
+func NewClusterRouter(nodeID string, n *Nsq, connMgr SConnManager, registry SUserRegistry, opts ...ClusterOption) *ClusterRouter {
+	if n == nil || connMgr == nil || registry == nil {
+		panic("sbus: ClusterRouter needs the Nsq, ConnManager and SUserRegistry")
+	}
+	topic := ClusterTopicPrefix + nodeID
+	if nodeID == "" || !nsq.IsValidTopicName(topic) {
+		panic(fmt.Sprintf("sbus: invalid cluster nodeID %q", nodeID))
+	}
+	r := &ClusterRouter{
+		nodeID:          nodeID,
+		topic:           topic,
+		msgID:           ClusterDefaultMsgID,
+		registryTimeout: clusterRegistryTimeout,
+		keepAlive:       ClusterDefaultKeepAlive,
+		nsq:             n,
+		connMgr:         connMgr,
+		registry:        registry,
+		publish:         n.SendToMsgBuffChan,
+		done:            make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	n.AddRouter(topic, int32(r.msgID), r)
+	connMgr.AddUserHooks(r.onUserBind, r.onUserUnbind)
+	r.keepNodeAlive()
+	r.wg.Add(1)
+	go r.keepAliveLoop()
+	return r
+}
+
+// Close stops keeping the node alive, its users expire in the registry after the ttl
+// (停止保持节点存活，其用户在ttl之后从注册中心过期)
+func (r *ClusterRouter) Close() {
+	r.closeOnce.Do(func() {
+		close(r.done)
+	})
+	r.wg.Wait()
+}
+
+func (r *ClusterRouter) keepAliveLoop() {
+	defer r.wg.Done()
+	ticker := time.NewTicker(r.keepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.keepNodeAlive()
+		case <-r.done:
+			return
+		}
+	}
+}
+
+func (r *ClusterRouter) keepNodeAlive() {
+	ctx, cancel := context.WithTimeout(context.Background(), r.registryTimeout)
+	defer cancel()
+	if err := r.registry.KeepAlive(ctx, r.nodeID, 3*r.keepAlive); err != nil {
+		slog.Ins().Errorf("keep node = %s alive error: %s", r.nodeID, err)
+	}
+}
+
+// NodeID returns the ID of the current node (返回当前节点的ID)
+func (r *ClusterRouter) NodeID() string {
+	return r.nodeID
+}
+
+// PushToUser sends msg to every device of uid, the devices on the current node are sent to directly before
+// looking up the registry, the others are forwarded to their nodes, ErrUserOffline is returned if uid has
+// no device online
+// (向uid的每个设备发送msg，查询注册中心之前先直接发送当前节点上的设备，其他设备转发到其所在节点，
+// uid没有在线设备时返回ErrUserOffline)
+func (r *ClusterRouter) PushToUser(ctx context.Context, uid string, msg SMsg) error {
+	var errs []error
+	local := r.connMgr.GetUserConns(uid)
+	if len(local) > 0 {
+		errs = append(errs, r.sendLocal(local, msg))
+	}
+	devices, err := r.registry.Lookup(ctx, uid)
+	if err != nil {
+		return errors.Join(append(errs, err)...)
+	}
+	nodes := make(map[string]struct{})
+	for _, nodeID := range devices {
+		if nodeID != r.nodeID {
+			nodes[nodeID] = struct{}{}
+		}
+	}
+	if len(local) == 0 && len(nodes) == 0 {
+		return ErrUserOffline
+	}
+
+	for nodeID := range nodes {
+		errs = append(errs, r.forward(nodeID, map[string]string{clusterMetaOp: clusterOpUser, clusterMetaUID: uid}, msg))
+	}
+	return errors.Join(errs...)
+}
+
+// PushToConn sends msg to the connection connID of nodeID (向nodeID节点上的连接connID发送msg)
+func (r *ClusterRouter) PushToConn(nodeID string, connID uint64, msg SMsg) error {
+	if nodeID == r.nodeID {
+		conn, err := r.connMgr.Get(connID)
+		if err != nil {
+			return err
+		}
+		return conn.SendBuffMsg(msg)
+	}
+	meta := map[string]string{clusterMetaOp: clusterOpConn, clusterMetaConnID: strconv.FormatUint(connID, 10)}
+	return r.forward(nodeID, meta, msg)
+}
+
+// ConnAddr returns the address of conn in the cluster, nodeID/connID, PushToConnAddr sends to it from any node
+// (返回conn在集群中的地址nodeID/connID，任意节点都可以通过PushToConnAddr向其发送)
+func (r *ClusterRouter) ConnAddr(conn SConnection) string {
+	return r.nodeID + "/" + conn.GetConnIdStr()
+}
+
+// PushToConnAddr sends msg to the connection of the address returned by ConnAddr
+// (向ConnAddr返回的地址对应的连接发送msg)
+func (r *ClusterRouter) PushToConnAddr(addr string, msg SMsg) error {
+	i := strings.LastIndexByte(addr, '/')
+	if i <= 0 {
+		return fmt.Errorf("%w: %q", ErrInvalidConnAddr, addr)
+	}
+	connID, err := strconv.ParseUint(addr[i+1:], 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: %q", ErrInvalidConnAddr, addr)
+	}
+	return r.PushToConn(addr[:i], connID, msg)
+}
+
+// Handle delivers the messages forwarded by the other nodes (投递其他节点转发过来的消息)
+func (r *ClusterRouter) Handle(task STask) error {
+	meta := task.GetMessage().GetMeta()
+	if meta[clusterMetaOp] == clusterOpKick {
+		if conn, err := r.connMgr.GetUserConn(meta[clusterMetaUID], meta[clusterMetaDevice]); err == nil {
+			r.connMgr.Kick(conn, KickReasonLoginElsewhere)
+		}
+		return nil
+	}
+
+	msg, err := NsqDataPackObj.Unpack(task.GetData())
+	if err != nil {
+		// a broken message never succeeds, so it is not requeued (损坏的消息永远不会成功，所以不重新入队)
+		slog.Ins().Errorf("unpack the forwarded message error: %s", err)
+		return nil
+	}
+	switch meta[clusterMetaOp] {
+	case clusterOpUser:
+		if conns := r.connMgr.GetUserConns(meta[clusterMetaUID]); len(conns) > 0 {
+			return r.sendLocal(conns, msg)
+		}
+		slog.Ins().Debugf("uid = %s is offline on node = %s, drop the forwarded message", meta[clusterMetaUID], r.nodeID)
+	case clusterOpConn:
+		connID, _ := strconv.ParseUint(meta[clusterMetaConnID], 10, 64)
+		conn, err := r.connMgr.Get(connID)
+		if err != nil {
+			slog.Ins().Debugf("connID = %d is not on node = %s, drop the forwarded message", connID, r.nodeID)
+			return nil
+		}
+		return conn.SendBuffMsg(msg)
+	}
+	return nil
+}
+
+func (r *ClusterRouter) sendLocal(conns []SConnection, msg SMsg) error {
+	connIDs := make([]uint64, 0, len(conns))
+	for _, conn := range conns {
+		connIDs = append(connIDs, conn.GetConnID())
+	}
+	return r.connMgr.Multicast(connIDs, msg)
+}
+
+// forward packs msg into the data of a message of msgID and sends it to the topic of nodeID
+// (将msg封包为msgID消息的data，并发送到nodeID的topic)
+func (r *ClusterRouter) forward(nodeID string, meta map[string]string, msg SMsg) error {
+	var data []byte
+	if msg != nil {
+		var err error
+		if data, err = NsqDataPackObj.Pack(copyMsg(msg, false)); err != nil {
+			return err
+		}
+	}
+	// the inner msg has been compressed according to its own CompressType (内部消息已按其自身的CompressType压缩)
+	envelopeMsg := NewNSQMsg(r.msgID, 0, smsg.SerializeNone, meta, data)
+	envelopeMsg.CompressType = smsg.None
+	envelope, err := r.nsq.getDataPack().Pack(envelopeMsg)
+	if err != nil {
+		return err
+	}
+	return r.publish(ClusterTopicPrefix+nodeID, envelope)
+}
+
+// onUserBind registers the user on the current node, the same device logged in on another node is kicked
+// there (将用户注册到当前节点，在其他节点登录的同一设备会在该节点被踢下线)
+func (r *ClusterRouter) onUserBind(conn SConnection, uid, device string) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.registryTimeout)
+	defer cancel()
+	prevNodeID, err := r.registry.Register(ctx, uid, device, r.nodeID)
+	if err != nil {
+		slog.Ins().Errorf("register uid = %s, device = %q on node = %s error: %s", uid, device, r.nodeID, err)
+		return
+	}
+	if prevNodeID != "" && prevNodeID != r.nodeID {
+		meta := map[string]string{clusterMetaOp: clusterOpKick, clusterMetaUID: uid, clusterMetaDevice: device}
+		if err := r.forward(prevNodeID, meta, nil); err != nil {
+			slog.Ins().Errorf("kick uid = %s, device = %q on node = %s error: %s", uid, device, prevNodeID, err)
+		}
+	}
+}
+
+func (r *ClusterRouter) onUserUnbind(conn SConnection, uid, device string) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.registryTimeout)
+	defer cancel()
+	if err := r.registry.Unregister(ctx, uid, device, r.nodeID); err != nil {
+		slog.Ins().Errorf("unregister uid = %s, device = %q on node = %s error: %s", uid, device, r.nodeID, err)
+	}
+}
@@ -0,0 +1,178 @@
+package sbus
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+	"github.com/wwengg/threego/core/sconfig"
+	"github.com/wwengg/threego/core/slog"
+	"github.com/wwengg/threego/core/smsg"
+)
+
+type memUserRegistry struct {
+	mu    sync.Mutex
+	users map[string]map[string]string
+	// nodeID -> the time it is alive until (nodeID -> 存活截止时间)
+	nodes map[string]time.Time
+	// the error returned by Lookup (Lookup返回的错误)
+	lookupErr error
+}
+
+func (r *memUserRegistry) Register(ctx context.Context, uid, device, nodeID string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.users[uid] == nil {
+		r.users[uid] = make(map[string]string)
+	}
+	prev := r.users[uid][device]
+	r.users[uid][device] = nodeID
+	return prev, nil
+}
+
+func (r *memUserRegistry) Unregister(ctx context.Context, uid, device, nodeID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.users[uid][device] == nodeID {
+		delete(r.users[uid], device)
+	}
+	return nil
+}
+
+func (r *memUserRegistry) Lookup(ctx context.Context, uid string) (map[string]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.lookupErr != nil {
+		return nil, r.lookupErr
+	}
+	devices := make(map[string]string)
+	for device, nodeID := range r.users[uid] {
+		if time.Now().Before(r.nodes[nodeID]) {
+			devices[device] = nodeID
+		}
+	}
+	return devices, nil
+}
+
+func (r *memUserRegistry) KeepAlive(ctx context.Context, nodeID string, ttl time.Duration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nodes[nodeID] = time.Now().Add(ttl)
+	return nil
+}
+
+func (r *memUserRegistry) setLookupErr(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lookupErr = err
+}
+
+func TestClusterRouter(t *testing.T) {
+	slog.NewZapLog(&sconfig.Slog{Director: t.TempDir(), Level: "error"})
+	registry := &memUserRegistry{users: make(map[string]map[string]string), nodes: make(map[string]time.Time)}
+	nsqs := make(map[string]*Nsq)
+	routers := make(map[string]*ClusterRouter)
+	connMgrs := make(map[string]*ConnManager)
+	for _, nodeID := range []string{"a", "b"} {
+		nsqs[nodeID] = NewNsq(1, 1, 16, "gateway", "127.0.0.1:4161", 1, 1, nil)
+		connMgrs[nodeID] = NewConnManager()
+		routers[nodeID] = NewClusterRouter(nodeID, nsqs[nodeID], connMgrs[nodeID], registry)
+		defer routers[nodeID].Close()
+	}
+	// the topics are delivered to the Nsq of the node directly, the envelope is not compressed again
+	// (topic直接投递到节点的Nsq，信封不会再次压缩)
+	for _, r := range routers {
+		r.publish = func(topic string, data []byte) error {
+			if envelope, err := NsqDataPackObj.Unpack(data); err != nil || envelope.GetCompressType() != smsg.None {
+				t.Errorf("unexpected envelope compress type, %v", err)
+			}
+			return nsqs[topic[len(ClusterTopicPrefix):]].HandleMessage(nsq.NewMessage(nsq.MessageID{}, data))
+		}
+	}
+	newConn := func(nodeID string, connID uint64) *Connection {
+		conn := NewConnection(nil, connID, 0, nil, nil, nil, nil, NewTcpDataPack(), connMgrs[nodeID], 0, 0).(*Connection)
+		connMgrs[nodeID].Add(conn)
+		return conn
+	}
+	received := func(conn *Connection) string {
+		select {
+		case data := <-conn.msgBuffChan:
+			msg, err := conn.Datapack.Unpack(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return string(msg.GetData())
+		default:
+			return ""
+		}
+	}
+
+	onB := newConn("b", 1)
+	if err := connMgrs["b"].BindUser(onB, "u1", "pc"); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := routers["a"].PushToUser(ctx, "u1", NewNSQMsg(10, 0, smsg.SerializeNone, nil, []byte("to user"))); err != nil {
+		t.Fatal(err)
+	}
+	if got := received(onB); got != "to user" {
+		t.Fatalf("received %q on node b", got)
+	}
+	if err := routers["a"].PushToConn("b", onB.GetConnID(), NewNSQMsg(10, 0, smsg.SerializeNone, nil, []byte("to conn"))); err != nil {
+		t.Fatal(err)
+	}
+	if got := received(onB); got != "to conn" {
+		t.Fatalf("received %q on node b", got)
+	}
+	addr := routers["b"].ConnAddr(onB)
+	if err := routers["a"].PushToConnAddr(addr, NewNSQMsg(10, 0, smsg.SerializeNone, nil, []byte("to addr"))); err != nil {
+		t.Fatal(err)
+	}
+	if got := received(onB); got != "to addr" {
+		t.Fatalf("received %q from %s on node b", got, addr)
+	}
+	if err := routers["a"].PushToConnAddr("1", nil); !errors.Is(err, ErrInvalidConnAddr) {
+		t.Fatalf("expected ErrInvalidConnAddr, got %v", err)
+	}
+
+	// the local devices receive the msg even if the registry fails (注册中心出错时本地设备仍会收到消息)
+	lookupErr := errors.New("registry down")
+	registry.setLookupErr(lookupErr)
+	if err := routers["b"].PushToUser(ctx, "u1", NewNSQMsg(10, 0, smsg.SerializeNone, nil, []byte("local"))); !errors.Is(err, lookupErr) {
+		t.Fatalf("expected the lookup error, got %v", err)
+	}
+	if got := received(onB); got != "local" {
+		t.Fatalf("received %q on node b", got)
+	}
+	registry.setLookupErr(nil)
+
+	// the same device logging in on node a kicks the connection on node b (同一设备在节点a登录会踢掉节点b上的连接)
+	onA := newConn("a", 1)
+	if err := connMgrs["a"].BindUser(onA, "u1", "pc"); err != nil {
+		t.Fatal(err)
+	}
+	if got := received(onB); got != KickReasonLoginElsewhere || onB.IsAlive() {
+		t.Fatalf("the connection on node b is not kicked, received %q", got)
+	}
+	connMgrs["b"].Remove(onB)
+	if devices, _ := registry.Lookup(ctx, "u1"); devices["pc"] != "a" {
+		t.Fatalf("unexpected registry %v", devices)
+	}
+
+	// the users of a node that is not kept alive are not looked up (未保持存活节点上的用户不会被查询到)
+	routers["a"].Close()
+	registry.mu.Lock()
+	registry.nodes["a"] = time.Now()
+	registry.mu.Unlock()
+	if err := routers["b"].PushToUser(ctx, "u1", NewNSQMsg(10, 0, smsg.SerializeNone, nil, nil)); err != ErrUserOffline {
+		t.Fatalf("expected ErrUserOffline for the dead node, got %v", err)
+	}
+
+	connMgrs["a"].Remove(onA)
+	if err := routers["b"].PushToUser(ctx, "u1", NewNSQMsg(10, 0, smsg.SerializeNone, nil, nil)); err != ErrUserOffline {
+		t.Fatalf("expected ErrUserOffline, got %v", err)
+	}
+}
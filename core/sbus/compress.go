@@ -0,0 +1,52 @@
+package sbus
+
+import (
+	"fmt"
+
+	"github.com/wwengg/threego/core/smsg"
+)
+
+// UnknownCompressTypeError is returned when a msg is packed or unpacked with a CompressType
+// that has no compressor registered in smsg.Compressors
+// (当CompressType在smsg.Compressors中没有对应的压缩器时返回)
+type UnknownCompressTypeError struct {
+	CompressType smsg.CompressType
+}
+
+func (e *UnknownCompressTypeError) Error() string {
+	return fmt.Sprintf("unknown compress type: %d", e.CompressType)
+}
+
+// compressData compresses data according to compressType, data shorter than threshold is not
+// compressed and the returned CompressType is smsg.None, so the receiver does not decompress it
+// (根据compressType压缩数据，长度小于threshold的数据不压缩，返回的CompressType为smsg.None，接收方也就不会解压)
+func compressData(compressType smsg.CompressType, data []byte, threshold uint32) (smsg.CompressType, []byte, error) {
+	compressor, ok := smsg.Compressors[compressType]
+	if !ok {
+		return compressType, nil, &UnknownCompressTypeError{CompressType: compressType}
+	}
+	if len(data) == 0 || compressType == smsg.None {
+		return compressType, data, nil
+	}
+	if uint32(len(data)) < threshold {
+		return smsg.None, data, nil
+	}
+	zipped, err := compressor.Zip(data)
+	if err != nil {
+		return compressType, nil, err
+	}
+	return compressType, zipped, nil
+}
+
+// decompressData decompresses data according to compressType
+// (根据compressType解压数据)
+func decompressData(compressType smsg.CompressType, data []byte) ([]byte, error) {
+	compressor, ok := smsg.Compressors[compressType]
+	if !ok {
+		return nil, &UnknownCompressTypeError{CompressType: compressType}
+	}
+	if len(data) == 0 || compressType == smsg.None {
+		return data, nil
+	}
+	return compressor.Unzip(data)
+}
@@ -0,0 +1,166 @@
+package sbus
+
+import (
+	"errors"
+	"net"
+	"os"
+	"time"
+
+	"github.com/wwengg/threego/core/slog"
+)
+
+// IdleState is the kind of the idle event, like the IdleStateHandler of Netty
+// (空闲事件的类型，类似Netty的IdleStateHandler)
+type IdleState int
+
+const (
+	ReaderIdle IdleState = iota // Nothing is read for ReaderIdleTimeout (ReaderIdleTimeout内没有读取到数据)
+	WriterIdle                  // Nothing is written for WriterIdleTimeout (WriterIdleTimeout内没有写入数据)
+	AllIdle                     // Nothing is read or written for AllIdleTimeout (AllIdleTimeout内没有读取或写入数据)
+)
+
+func (s IdleState) String() string {
+	switch s {
+	case ReaderIdle:
+		return "ReaderIdle"
+	case WriterIdle:
+		return "WriterIdle"
+	case AllIdle:
+		return "AllIdle"
+	}
+	return "Unknown"
+}
+
+// IdleHandler is called when the connection is idle, it can send a ping or stop the connection,
+// the event is fired again after every further timeout while the connection stays idle
+// (连接空闲时调用，可以发送ping或者停止连接，连接持续空闲时每经过一个超时时间会再次触发)
+type IdleHandler func(conn SConnection, state IdleState)
+
+// WithIdleTimeout sets the idle timeouts, 0 means disabled, the reader idle is detected by SetReadDeadline,
+// the writer and all idle by a monitor goroutine, without an IdleHandler the connection is stopped on
+// ReaderIdle and AllIdle
+// (设置空闲超时时间，0表示不启用，读空闲通过SetReadDeadline检测，写空闲以及读写空闲由监控协程检测，
+// 没有IdleHandler时ReaderIdle和AllIdle会停止连接)
+func WithIdleTimeout(readerIdle, writerIdle, allIdle time.Duration) ConnOption {
+	return func(c *Connection) {
+		c.ReaderIdleTimeout = readerIdle
+		c.WriterIdleTimeout = writerIdle
+		c.AllIdleTimeout = allIdle
+	}
+}
+
+// WithIdleHandler sets the handler of the idle events (设置空闲事件的处理函数)
+func WithIdleHandler(handler IdleHandler) ConnOption {
+	return func(c *Connection) {
+		c.idleHandler = handler
+	}
+}
+
+// WithWriteTimeout sets the deadline of every write to the socket, the connection stops if a write times out
+// (设置每次写入socket的超时时间，写入超时时连接会停止)
+func WithWriteTimeout(timeout time.Duration) ConnOption {
+	return func(c *Connection) {
+		c.WriteTimeout = timeout
+	}
+}
+
+func (bc *Connection) setReadDeadline() {
+	if bc.ReaderIdleTimeout <= 0 {
+		return
+	}
+	var err error
+	deadline := time.Now().Add(bc.ReaderIdleTimeout)
+	if bc.readDeadlineFunc != nil {
+		err = bc.readDeadlineFunc(deadline)
+	} else if bc.Conn != nil {
+		err = bc.Conn.SetReadDeadline(deadline)
+	}
+	if err != nil {
+		slog.Ins().Debugf("connID = %d set read deadline error: %s", bc.ConnID, err)
+	}
+}
+
+func (bc *Connection) setWriteDeadline(deadline time.Time) {
+	var err error
+	if bc.writeDeadlineFunc != nil {
+		err = bc.writeDeadlineFunc(deadline)
+	} else if bc.Conn != nil {
+		err = bc.Conn.SetWriteDeadline(deadline)
+	}
+	if err != nil {
+		slog.Ins().Debugf("connID = %d set write deadline error: %s", bc.ConnID, err)
+	}
+}
+
+// handleReadTimeout fires ReaderIdle if err is the timeout of the read deadline, it returns true if the
+// reader can go on, the transports with a readFunc, such as WebSocket, can not be read after a timeout
+// (err为读超时时触发ReaderIdle，返回true表示读协程可以继续，WebSocket这类有readFunc的传输方式超时后不能再读取)
+func (bc *Connection) handleReadTimeout(err error) bool {
+	if bc.ReaderIdleTimeout <= 0 || !isTimeout(err) {
+		return false
+	}
+	bc.fireIdle(ReaderIdle)
+	return bc.readFunc == nil && !bc.isClosed()
+}
+
+// fireIdle calls the IdleHandler, or stops the connection on ReaderIdle and AllIdle without a handler
+// (调用IdleHandler，没有处理函数时ReaderIdle和AllIdle会停止连接)
+func (bc *Connection) fireIdle(state IdleState) {
+	if bc.idleHandler != nil {
+		defer func() {
+			if err := recover(); err != nil {
+				slog.Ins().Errorf("idle handler of connID = %d panic: %v", bc.ConnID, err)
+			}
+		}()
+		bc.idleHandler(bc.self, state)
+		return
+	}
+	if state != WriterIdle {
+		slog.Ins().Infof("connID = %d is %s, stop it", bc.ConnID, state)
+		bc.Stop()
+	}
+}
+
+// startIdleMonitor checks WriterIdle and AllIdle a few times per timeout
+// (每个超时时间内检查几次WriterIdle和AllIdle)
+func (bc *Connection) startIdleMonitor() {
+	interval := bc.WriterIdleTimeout
+	if interval <= 0 || (bc.AllIdleTimeout > 0 && bc.AllIdleTimeout < interval) {
+		interval = bc.AllIdleTimeout
+	}
+	ticker := time.NewTicker(interval / 4)
+	defer ticker.Stop()
+
+	var writerFired, allFired int64
+	for {
+		select {
+		case <-bc.ctx.Done():
+			return
+		case now := <-ticker.C:
+			lastWrite := bc.lastWriteTime.Load()
+			lastAll := max(lastWrite, bc.lastActivityTime.Load())
+			if idleFor(now, lastWrite, writerFired, bc.WriterIdleTimeout) {
+				writerFired = now.UnixNano()
+				bc.fireIdle(WriterIdle)
+			}
+			if idleFor(now, lastAll, allFired, bc.AllIdleTimeout) {
+				allFired = now.UnixNano()
+				bc.fireIdle(AllIdle)
+			}
+		}
+	}
+}
+
+// idleFor reports whether timeout has passed since both the last activity and the last event
+// (判断距离最后一次活动以及最后一次事件是否都已经超过timeout)
+func idleFor(now time.Time, lastActivity, lastFired int64, timeout time.Duration) bool {
+	return timeout > 0 && now.Sub(time.Unix(0, max(lastActivity, lastFired))) >= timeout
+}
+
+func isTimeout(err error) bool {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
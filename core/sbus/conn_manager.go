@@ -2,25 +2,88 @@ package sbus
 
 import (
 	"errors"
+	"net"
+	"reflect"
 	"strconv"
+	"sync"
 
 	"github.com/wwengg/threego/core/slog"
 	"github.com/wwengg/threego/core/utils"
 )
 
+var ErrConnNotFound = errors.New("connection not found")
+
 type ConnManager struct {
 	Connections utils.ShardLockMaps
+
+	indexLock sync.RWMutex
+	// The indexed property keys (已索引的属性key)
+	indexKeys map[string]struct{}
+	// key -> value -> connID -> connection
+	index map[string]map[any]map[uint64]SConnection
+	// connID -> key -> value, used to remove a connection from the indexes
+	// (用于从索引中删除连接)
+	indexed map[uint64]map[string]any
+
+	userLock sync.Mutex
+	// uid -> device -> connection
+	users map[string]map[string]SConnection
+	// connID -> the user bound to the connection (连接绑定的用户)
+	connUsers map[uint64]userBinding
+
+	groupLock sync.RWMutex
+	// group -> connID -> connection
+	groups map[string]map[uint64]SConnection
+	// connID -> the groups joined by the connection (连接加入的分组)
+	connGroups map[uint64]map[string]struct{}
+
+	// Consulted on accept, nil means no blacklist (accept时检查，nil表示没有黑名单)
+	blacklist *IPBlacklist
+
+	kickMsgID    uint16
+	onUserBind   []UserBindHook
+	onUserUnbind []UserBindHook
 }
 
-func NewConnManager() *ConnManager {
-	return &ConnManager{
+type ConnManagerOption func(connMgr *ConnManager)
+
+// WithBlacklist sets the blacklist consulted on accept, the IPs of the connections over the rate limit
+// are banned in it, see WithDisconnectAfter
+// (设置accept时检查的黑名单，超出限流的连接IP会被封禁到其中)
+func WithBlacklist(blacklist *IPBlacklist) ConnManagerOption {
+	return func(connMgr *ConnManager) {
+		connMgr.blacklist = blacklist
+	}
+}
+
+// propertyRanger is implemented by the connections whose properties can be indexed, such as *Connection
+// (属性可以被索引的连接实现该接口，例如*Connection)
+type propertyRanger interface {
+	rangeProperties(fn func(key string, value any))
+}
+
+func NewConnManager(opts ...ConnManagerOption) *ConnManager {
+	connMgr := &ConnManager{
 		Connections: utils.NewShardLockMaps(),
+		indexKeys:   make(map[string]struct{}),
+		index:       make(map[string]map[any]map[uint64]SConnection),
+		indexed:     make(map[uint64]map[string]any),
+		users:       make(map[string]map[string]SConnection),
+		connUsers:   make(map[uint64]userBinding),
+		groups:      make(map[string]map[uint64]SConnection),
+		connGroups:  make(map[uint64]map[string]struct{}),
+		kickMsgID:   KickDefaultMsgID,
+	}
+	for _, opt := range opts {
+		opt(connMgr)
 	}
+	return connMgr
 }
 
 func (connMgr *ConnManager) Add(conn SConnection) {
 
 	connMgr.Connections.Set(conn.GetConnIdStr(), conn) // 将conn连接添加到ConnManager中
+	connMgr.indexConn(conn)
 
 	slog.Ins().Debugf("connection add to ConnManager successfully: conn num = %d", connMgr.Len())
 }
@@ -28,6 +91,9 @@ func (connMgr *ConnManager) Add(conn SConnection) {
 func (connMgr *ConnManager) Remove(conn SConnection) {
 
 	connMgr.Connections.Remove(conn.GetConnIdStr()) // 删除连接信息
+	connMgr.unindexConn(conn.GetConnID())
+	connMgr.unbindUser(conn, false)
+	connMgr.leaveAllGroups(conn.GetConnID())
 
 	slog.Ins().Debugf("connection Remove ConnID=%d successfully: conn num = %d", conn.GetConnID(), connMgr.Len())
 }
@@ -39,7 +105,7 @@ func (connMgr *ConnManager) Get(connID uint64) (SConnection, error) {
 		return conn.(SConnection), nil
 	}
 
-	return nil, errors.New("connection not found")
+	return nil, ErrConnNotFound
 }
 
 // Get2 It is recommended to use this method to obtain connection instances
@@ -49,7 +115,7 @@ func (connMgr *ConnManager) Get2(strConnId string) (SConnection, error) {
 		return conn.(SConnection), nil
 	}
 
-	return nil, errors.New("connection not found")
+	return nil, ErrConnNotFound
 }
 
 func (connMgr *ConnManager) Len() int {
@@ -122,3 +188,145 @@ func (connMgr *ConnManager) Range2(cb func(string, SConnection, interface{}) err
 
 	return err
 }
+
+// AddIndex indexes the property key of the connections, so FindByProperty can look them up,
+// the values that are not comparable are not indexed
+// (为连接的属性key建立索引，使FindByProperty可以查找，不可比较的值不会被索引)
+func (connMgr *ConnManager) AddIndex(key string) {
+	connMgr.indexLock.Lock()
+	if _, ok := connMgr.indexKeys[key]; ok {
+		connMgr.indexLock.Unlock()
+		return
+	}
+	connMgr.indexKeys[key] = struct{}{}
+	connMgr.indexLock.Unlock()
+
+	// index a snapshot outside the shard locks, indexConn takes the property lock, which is held by
+	// SetProperty while OnPropertyChange reads the shards
+	// (在分片锁之外为快照建立索引，indexConn会获取property锁，而SetProperty持有该锁时OnPropertyChange会读取分片)
+	for item := range connMgr.Connections.IterBuffered() {
+		if conn, ok := item.Val.(SConnection); ok {
+			connMgr.indexConn(conn)
+		}
+	}
+}
+
+// FindByProperty returns the connections whose indexed property key equals value
+// (返回已索引属性key等于value的连接)
+func (connMgr *ConnManager) FindByProperty(key string, value any) []SConnection {
+	if !isComparable(value) {
+		return nil
+	}
+	connMgr.indexLock.RLock()
+	defer connMgr.indexLock.RUnlock()
+
+	conns := connMgr.index[key][value]
+	result := make([]SConnection, 0, len(conns))
+	for _, conn := range conns {
+		result = append(result, conn)
+	}
+	return result
+}
+
+// OnPropertyChange is called by the connection while holding its property lock, it moves the connection
+// to the new value in the index of key
+// (连接在持有property锁时调用，将连接移动到key索引中的新值下)
+func (connMgr *ConnManager) OnPropertyChange(conn SConnection, key string, oldValue, newValue any) {
+	connMgr.indexLock.Lock()
+	defer connMgr.indexLock.Unlock()
+	if _, ok := connMgr.indexKeys[key]; !ok {
+		return
+	}
+	connMgr.unindexLocked(conn.GetConnID(), key)
+	// the removed connection is not indexed again (已删除的连接不会被再次索引)
+	if newValue != nil && connMgr.Connections.Has(conn.GetConnIdStr()) {
+		connMgr.indexLocked(conn, key, newValue)
+	}
+}
+
+// indexConn indexes the properties of conn, the property lock is taken before the index lock,
+// the same order as SetProperty, a connection removed after the snapshot of AddIndex is skipped
+// (为conn的属性建立索引，先获取property锁再获取索引锁，与SetProperty顺序一致，AddIndex快照之后已删除的连接会被跳过)
+func (connMgr *ConnManager) indexConn(conn SConnection) {
+	ranger, ok := conn.(propertyRanger)
+	if !ok {
+		return
+	}
+	ranger.rangeProperties(func(key string, value any) {
+		connMgr.indexLock.Lock()
+		defer connMgr.indexLock.Unlock()
+		if _, ok := connMgr.indexKeys[key]; !ok || value == nil || !connMgr.Connections.Has(conn.GetConnIdStr()) {
+			return
+		}
+		connMgr.unindexLocked(conn.GetConnID(), key)
+		connMgr.indexLocked(conn, key, value)
+	})
+}
+
+func (connMgr *ConnManager) unindexConn(connID uint64) {
+	connMgr.indexLock.Lock()
+	defer connMgr.indexLock.Unlock()
+	for key := range connMgr.indexed[connID] {
+		connMgr.unindexLocked(connID, key)
+	}
+}
+
+func (connMgr *ConnManager) indexLocked(conn SConnection, key string, value any) {
+	if !isComparable(value) {
+		slog.Ins().Warnf("property %s of type %T is not comparable, connID = %d is not indexed", key, value, conn.GetConnID())
+		return
+	}
+	values, ok := connMgr.index[key]
+	if !ok {
+		values = make(map[any]map[uint64]SConnection)
+		connMgr.index[key] = values
+	}
+	conns, ok := values[value]
+	if !ok {
+		conns = make(map[uint64]SConnection)
+		values[value] = conns
+	}
+	conns[conn.GetConnID()] = conn
+
+	keys, ok := connMgr.indexed[conn.GetConnID()]
+	if !ok {
+		keys = make(map[string]any)
+		connMgr.indexed[conn.GetConnID()] = keys
+	}
+	keys[key] = value
+}
+
+func (connMgr *ConnManager) unindexLocked(connID uint64, key string) {
+	keys, ok := connMgr.indexed[connID]
+	if !ok {
+		return
+	}
+	value, ok := keys[key]
+	if !ok {
+		return
+	}
+	delete(keys, key)
+	if len(keys) == 0 {
+		delete(connMgr.indexed, connID)
+	}
+	conns := connMgr.index[key][value]
+	delete(conns, connID)
+	if len(conns) == 0 {
+		delete(connMgr.index[key], value)
+	}
+}
+
+// isComparable reports whether value can be a map key (判断value能否作为map的key)
+func isComparable(value any) bool {
+	return value != nil && reflect.TypeOf(value).Comparable()
+}
+
+// GetBlacklist returns the blacklist, nil if there is none (返回黑名单，没有时返回nil)
+func (connMgr *ConnManager) GetBlacklist() *IPBlacklist {
+	return connMgr.blacklist
+}
+
+// IsBlocked reports whether the remote IP is in the blacklist (判断远端IP是否在黑名单中)
+func (connMgr *ConnManager) IsBlocked(ip net.IP) bool {
+	return connMgr.blacklist != nil && connMgr.blacklist.Contains(ip)
+}
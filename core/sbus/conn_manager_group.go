@@ -0,0 +1,205 @@
+package sbus
+
+import (
+	"errors"
+
+	"github.com/wwengg/threego/core/slog"
+)
+
+var ErrEmptyGroup = errors.New("group is empty")
+
+// JoinGroup adds conn to the group, such as a room or a channel, conn leaves all groups when it stops
+// (将conn加入分组，例如房间或频道，连接停止时自动离开所有分组)
+func (connMgr *ConnManager) JoinGroup(conn SConnection, group string) error {
+	if group == "" {
+		return ErrEmptyGroup
+	}
+	connID := conn.GetConnID()
+
+	connMgr.groupLock.Lock()
+	defer connMgr.groupLock.Unlock()
+	// checked under the lock, so a connection removed concurrently never joins
+	// (在锁内检查，保证并发删除的连接不会加入分组)
+	if !connMgr.Connections.Has(conn.GetConnIdStr()) {
+		return ErrConnNotFound
+	}
+	members, ok := connMgr.groups[group]
+	if !ok {
+		members = make(map[uint64]SConnection)
+		connMgr.groups[group] = members
+	}
+	members[connID] = conn
+
+	groups, ok := connMgr.connGroups[connID]
+	if !ok {
+		groups = make(map[string]struct{})
+		connMgr.connGroups[connID] = groups
+	}
+	groups[group] = struct{}{}
+	return nil
+}
+
+// LeaveGroup removes conn from the group (将conn移出分组)
+func (connMgr *ConnManager) LeaveGroup(conn SConnection, group string) {
+	connMgr.groupLock.Lock()
+	defer connMgr.groupLock.Unlock()
+	connMgr.leaveGroupLocked(conn.GetConnID(), group)
+}
+
+// GetGroupConns returns the connections of the group (返回分组中的连接)
+func (connMgr *ConnManager) GetGroupConns(group string) []SConnection {
+	connMgr.groupLock.RLock()
+	defer connMgr.groupLock.RUnlock()
+
+	members := connMgr.groups[group]
+	conns := make([]SConnection, 0, len(members))
+	for _, conn := range members {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// GetConnGroups returns the groups joined by conn (返回conn加入的分组)
+func (connMgr *ConnManager) GetConnGroups(conn SConnection) []string {
+	connMgr.groupLock.RLock()
+	defer connMgr.groupLock.RUnlock()
+
+	groups := connMgr.connGroups[conn.GetConnID()]
+	result := make([]string, 0, len(groups))
+	for group := range groups {
+		result = append(result, group)
+	}
+	return result
+}
+
+// Broadcast sends msg to all connections (向所有连接发送msg)
+func (connMgr *ConnManager) Broadcast(msg SMsg) error {
+	conns := make([]SConnection, 0, connMgr.Len())
+	connMgr.Connections.IterCb(func(_ string, v interface{}) {
+		if conn, ok := v.(SConnection); ok {
+			conns = append(conns, conn)
+		}
+	})
+	return connMgr.multicast(conns, msg)
+}
+
+// BroadcastToGroup sends msg to the connections of the group except the connIDs in exclude,
+// such as the sender itself (向分组中除exclude以外的连接发送msg，例如排除发送者自己)
+func (connMgr *ConnManager) BroadcastToGroup(group string, msg SMsg, exclude ...uint64) error {
+	connMgr.groupLock.RLock()
+	members := connMgr.groups[group]
+	conns := make([]SConnection, 0, len(members))
+	for connID, conn := range members {
+		excluded := false
+		for _, id := range exclude {
+			if id == connID {
+				excluded = true
+				break
+			}
+		}
+		if !excluded {
+			conns = append(conns, conn)
+		}
+	}
+	connMgr.groupLock.RUnlock()
+	return connMgr.multicast(conns, msg)
+}
+
+// Multicast sends msg to the connections of connIDs, the unknown connIDs are skipped
+// (向connIDs对应的连接发送msg，不存在的connID会被跳过)
+func (connMgr *ConnManager) Multicast(connIDs []uint64, msg SMsg) error {
+	conns := make([]SConnection, 0, len(connIDs))
+	for _, connID := range connIDs {
+		if conn, err := connMgr.Get(connID); err == nil {
+			conns = append(conns, conn)
+		}
+	}
+	return connMgr.multicast(conns, msg)
+}
+
+// packKey identifies the packed bytes, the connections with the same datapack and frame decoder setting
+// share them (标识封包结果，datapack以及是否有FrameDecoder相同的连接共享同一份封包数据)
+type packKey struct {
+	datapack        SDataPack
+	hasFrameDecoder bool
+}
+
+// multicast packs a copy of msg once per packKey and sends the bytes to the send queue of every connection,
+// the connections whose encryption handshake has not finished are skipped and the encrypted ones pack the
+// copy by SendBuffMsg, the failure of a connection, such as a full send queue, is logged and does not stop
+// the others, only the pack error of the shared bytes is returned
+// (每个packKey只封包一次msg的副本并将数据发送到每个连接的发送队列，加密握手未完成的连接会被跳过，加密连接通过
+// SendBuffMsg封包副本，单个连接的失败(例如发送队列已满)只记录日志，不影响其他连接，只返回共享数据的封包错误)
+func (connMgr *ConnManager) multicast(conns []SConnection, msg SMsg) error {
+	type packResult struct {
+		data []byte
+		err  error
+	}
+	packed := make(map[packKey]packResult)
+	var errs []error
+	for _, conn := range conns {
+		// the client can not decrypt the msg packed by the datapack before the handshake
+		// (客户端无法解密握手之前的datapack封包的消息)
+		if hs, ok := conn.(handshakeAwaiter); ok && hs.awaitingHandshake() {
+			continue
+		}
+		// an encrypted connection packs the msg itself, so its frames are queued in the order of the nonce counters
+		// (加密连接自行封包，使其帧按nonce计数器的顺序进入队列)
+		if conn.IsEncrypted() {
+			if err := conn.SendBuffMsg(copyMsg(msg, conn.HasFrameDecoder())); err != nil {
+				slog.Ins().Warnf("multicast msgID = %d to connID = %d error: %s", msg.GetCmd(), conn.GetConnID(), err)
+			}
+			continue
+		}
+		key := packKey{datapack: conn.GetDatapack(), hasFrameDecoder: conn.HasFrameDecoder()}
+		// a datapack that is not comparable can not be a map key, it is packed per connection
+		// (不可比较的datapack不能作为map的key，按连接封包)
+		cacheable := isComparable(key.datapack)
+		var (
+			result packResult
+			ok     bool
+		)
+		if cacheable {
+			result, ok = packed[key]
+		}
+		if !ok {
+			result.data, result.err = key.datapack.Pack(copyMsg(msg, key.hasFrameDecoder))
+			if result.err != nil {
+				errs = append(errs, result.err)
+			}
+			if cacheable {
+				packed[key] = result
+			}
+		}
+		if result.err != nil {
+			continue
+		}
+		if err := conn.SendBuffData(result.data); err != nil {
+			slog.Ins().Warnf("multicast msgID = %d to connID = %d error: %s", msg.GetCmd(), conn.GetConnID(), err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (connMgr *ConnManager) leaveGroupLocked(connID uint64, group string) {
+	if members, ok := connMgr.groups[group]; ok {
+		delete(members, connID)
+		if len(members) == 0 {
+			delete(connMgr.groups, group)
+		}
+	}
+	if groups, ok := connMgr.connGroups[connID]; ok {
+		delete(groups, group)
+		if len(groups) == 0 {
+			delete(connMgr.connGroups, connID)
+		}
+	}
+}
+
+func (connMgr *ConnManager) leaveAllGroups(connID uint64) {
+	connMgr.groupLock.Lock()
+	defer connMgr.groupLock.Unlock()
+	for group := range connMgr.connGroups[connID] {
+		connMgr.leaveGroupLocked(connID, group)
+	}
+}
@@ -0,0 +1,210 @@
+package sbus
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wwengg/threego/core/sconfig"
+	"github.com/wwengg/threego/core/slog"
+	"github.com/wwengg/threego/core/smsg"
+)
+
+func TestConnManagerBindUser(t *testing.T) {
+	slog.NewZapLog(&sconfig.Slog{Director: t.TempDir(), Level: "error"})
+	var unbound []uint64
+	connMgr := NewConnManager(WithOnUserUnbind(func(conn SConnection, uid, device string) {
+		unbound = append(unbound, conn.GetConnID())
+	}))
+	newConn := func(connID uint64) *Connection {
+		conn := NewConnection(nil, connID, 0, nil, nil, nil, nil, NewTcpDataPack(), connMgr, 0, 0).(*Connection)
+		connMgr.Add(conn)
+		return conn
+	}
+	pc, mobile, pc2 := newConn(1), newConn(2), newConn(3)
+
+	for _, conn := range []*Connection{pc, mobile, pc2} {
+		device := "pc"
+		if conn == mobile {
+			device = "mobile"
+		}
+		if err := connMgr.BindUser(conn, "u1", device); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the old connection of the same device is kicked with the reason (同设备的旧连接被踢下线并收到原因)
+	if pc.IsAlive() {
+		t.Fatal("the old pc connection is not stopped")
+	}
+	kick, err := pc.Datapack.Unpack(<-pc.msgBuffChan)
+	if err != nil || kick.GetCmd() != KickDefaultMsgID || string(kick.GetData()) != KickReasonLoginElsewhere {
+		t.Fatalf("unexpected kick message %+v, %v", kick, err)
+	}
+	if conns := connMgr.GetUserConns("u1"); len(conns) != 2 {
+		t.Fatalf("got %d connections, want 2", len(conns))
+	}
+	if conn, err := connMgr.GetUserConn("u1", "pc"); err != nil || conn != pc2 {
+		t.Fatalf("unexpected pc connection %v, %v", conn, err)
+	}
+	if uid, err := GetPropertyAs[string](pc2, PropertyKeyUID); err != nil || uid != "u1" {
+		t.Fatalf("unexpected uid property %v, %v", uid, err)
+	}
+
+	// the user is unbound when the connection is removed (连接删除时自动解绑)
+	connMgr.Remove(mobile)
+	connMgr.Remove(pc)
+	if _, err := connMgr.GetUserConn("u1", "mobile"); err != ErrConnNotFound {
+		t.Fatalf("expected ErrConnNotFound, got %v", err)
+	}
+	connMgr.UnbindUser(pc2)
+	if conns := connMgr.GetUserConns("u1"); len(conns) != 0 {
+		t.Fatalf("got %d connections, want 0", len(conns))
+	}
+	if _, err := pc2.GetProperty(PropertyKeyUID); err != ErrPropertyNotFound {
+		t.Fatalf("expected ErrPropertyNotFound, got %v", err)
+	}
+	if len(unbound) != 3 || unbound[0] != 1 || unbound[1] != 2 || unbound[2] != 3 {
+		t.Fatalf("unexpected unbind hooks %v", unbound)
+	}
+	if err := connMgr.BindUser(mobile, "u1", "mobile"); err != ErrConnNotFound {
+		t.Fatalf("expected ErrConnNotFound, got %v", err)
+	}
+}
+
+type countingDataPack struct {
+	SDataPack
+	packs int
+}
+
+func (dp *countingDataPack) Pack(msg SMsg) ([]byte, error) {
+	dp.packs++
+	return dp.SDataPack.Pack(msg)
+}
+
+func TestConnManagerGroupBroadcast(t *testing.T) {
+	slog.NewZapLog(&sconfig.Slog{Director: t.TempDir(), Level: "error"})
+	connMgr := NewConnManager()
+	datapack := &countingDataPack{SDataPack: NewTcpDataPack()}
+	var conns []*Connection
+	for i := uint64(1); i <= 4; i++ {
+		conn := NewConnection(nil, i, 0, nil, nil, nil, nil, datapack, connMgr, 0, 0).(*Connection)
+		connMgr.Add(conn)
+		conns = append(conns, conn)
+	}
+	for _, conn := range conns[:3] {
+		if err := connMgr.JoinGroup(conn, "room"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	received := func(conn *Connection) string {
+		select {
+		case data := <-conn.msgBuffChan:
+			msg, err := conn.Datapack.Unpack(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return string(msg.GetData())
+		default:
+			return ""
+		}
+	}
+
+	msg := NewNSQMsg(10, 0, smsg.SerializeNone, nil, []byte("hi"))
+	if err := connMgr.BroadcastToGroup("room", msg, conns[0].GetConnID()); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"", "hi", "hi", ""} {
+		if got := received(conns[i]); got != want {
+			t.Fatalf("conn %d received %q, want %q", i+1, got, want)
+		}
+	}
+	if datapack.packs != 1 {
+		t.Fatalf("packed %d times, want 1", datapack.packs)
+	}
+
+	if err := connMgr.Multicast([]uint64{1, 4, 99}, msg); err != nil {
+		t.Fatal(err)
+	}
+	if received(conns[0]) != "hi" || received(conns[3]) != "hi" || received(conns[1]) != "" {
+		t.Fatal("unexpected multicast receivers")
+	}
+
+	// the removed connection leaves its groups (删除的连接离开其所在分组)
+	connMgr.Remove(conns[1])
+	if groups := connMgr.GetConnGroups(conns[1]); len(groups) != 0 {
+		t.Fatalf("unexpected groups %v", groups)
+	}
+	connMgr.LeaveGroup(conns[2], "room")
+	if members := connMgr.GetGroupConns("room"); len(members) != 1 || members[0] != conns[0] {
+		t.Fatalf("unexpected members %v", members)
+	}
+
+	// the connection waiting for the encryption handshake is skipped (等待加密握手的连接会被跳过)
+	pending := NewConnection(nil, 5, 0, nil, nil, nil, nil, datapack, connMgr, 0, 0,
+		WithEncryption(EncryptionDefaultMsgID, true)).(*Connection)
+	connMgr.Add(pending)
+	// the caller's msg is not changed by the packing (封包不会修改调用方的msg)
+	msg.SetHasFrameDecoder(true)
+	if err := connMgr.Broadcast(msg); err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []int{0, 2, 3} {
+		if received(conns[i]) != "hi" {
+			t.Fatalf("conn %d did not receive the broadcast", i+1)
+		}
+	}
+	if received(pending) != "" {
+		t.Fatal("the connection waiting for the handshake received the broadcast")
+	}
+	if !msg.GetHasFrameDecoder() {
+		t.Fatal("the broadcast changed the caller's msg")
+	}
+}
+
+func TestConnManagerAddIndexConcurrent(t *testing.T) {
+	slog.NewZapLog(&sconfig.Slog{Director: t.TempDir(), Level: "error"})
+	connMgr := NewConnManager()
+	conns := make([]*Connection, 64)
+	for i := range conns {
+		conns[i] = NewConnection(nil, uint64(i+1), 0, nil, nil, nil, nil, NewTcpDataPack(), connMgr, 0, 0).(*Connection)
+		connMgr.Add(conns[i])
+	}
+
+	// AddIndex and SetProperty take the locks in opposite orders if AddIndex indexes under the shard locks
+	// (AddIndex在分片锁下建立索引时，与SetProperty获取锁的顺序相反)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var wg sync.WaitGroup
+		for _, conn := range conns {
+			wg.Add(1)
+			go func(conn *Connection) {
+				defer wg.Done()
+				for i := 0; i < 100; i++ {
+					conn.SetProperty(fmt.Sprintf("key%d", i%8), i)
+				}
+			}(conn)
+		}
+		for i := 0; i < 8; i++ {
+			connMgr.AddIndex(fmt.Sprintf("key%d", i))
+		}
+		wg.Wait()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("AddIndex deadlocks with SetProperty")
+	}
+	if found := connMgr.FindByProperty("key7", 95); len(found) != len(conns) {
+		t.Fatalf("unexpected indexed connections %d, want %d", len(found), len(conns))
+	}
+
+	// a removed connection is not indexed again (已删除的连接不会被再次索引)
+	connMgr.Remove(conns[0])
+	connMgr.indexConn(conns[0])
+	if found := connMgr.FindByProperty("key7", 95); len(found) != len(conns)-1 {
+		t.Fatalf("unexpected indexed connections %d, want %d", len(found), len(conns)-1)
+	}
+}
@@ -0,0 +1,197 @@
+package sbus
+
+import (
+	"errors"
+
+	"github.com/wwengg/threego/core/slog"
+	"github.com/wwengg/threego/core/smsg"
+)
+
+const (
+	// KickDefaultMsgID is the Cmd of the message sent to the kicked connection, the Data is the reason
+	// (发送给被踢连接的消息Cmd，Data为原因)
+	KickDefaultMsgID uint16 = 2
+
+	// The properties set on the connection by BindUser (BindUser设置到连接上的属性)
+	PropertyKeyUID    = "sbus.uid"
+	PropertyKeyDevice = "sbus.device"
+
+	KickReasonLoginElsewhere = "login from another place"
+)
+
+var ErrEmptyUID = errors.New("uid is empty")
+
+// UserBindHook is called after a user is bound to or unbound from a connection
+// (用户绑定到连接或从连接解绑后调用)
+type UserBindHook func(conn SConnection, uid, device string)
+
+type userBinding struct {
+	uid    string
+	device string
+}
+
+// WithKickMsgID sets the Cmd of the message sent to the kicked connection
+// (设置发送给被踢连接的消息Cmd)
+func WithKickMsgID(msgID uint16) ConnManagerOption {
+	return func(connMgr *ConnManager) {
+		connMgr.kickMsgID = msgID
+	}
+}
+
+// WithOnUserBind adds a hook called after BindUser (添加BindUser之后调用的钩子)
+func WithOnUserBind(hook UserBindHook) ConnManagerOption {
+	return func(connMgr *ConnManager) {
+		connMgr.onUserBind = append(connMgr.onUserBind, hook)
+	}
+}
+
+// WithOnUserUnbind adds a hook called after a user is unbound, by UnbindUser, by a new login of the same
+// device or by the connection stopping (添加用户解绑之后调用的钩子，包括UnbindUser、同设备新登录以及连接停止)
+func WithOnUserUnbind(hook UserBindHook) ConnManagerOption {
+	return func(connMgr *ConnManager) {
+		connMgr.onUserUnbind = append(connMgr.onUserUnbind, hook)
+	}
+}
+
+// AddUserHooks adds the hooks like WithOnUserBind and WithOnUserUnbind for the modules created after the
+// ConnManager, such as ClusterRouter, it must be called before serving, nil hooks are skipped
+// (为ConnManager之后创建的模块(例如ClusterRouter)添加钩子，与WithOnUserBind、WithOnUserUnbind相同，
+// 必须在开始服务之前调用，nil钩子会被跳过)
+func (connMgr *ConnManager) AddUserHooks(onBind, onUnbind UserBindHook) {
+	if onBind != nil {
+		connMgr.onUserBind = append(connMgr.onUserBind, onBind)
+	}
+	if onUnbind != nil {
+		connMgr.onUserUnbind = append(connMgr.onUserUnbind, onUnbind)
+	}
+}
+
+// BindUser binds uid and device to conn, a user can log in once per device, so the old connection of the
+// same device is kicked with KickReasonLoginElsewhere, binding conn to another user unbinds the old one,
+// the user is unbound automatically when conn stops
+// (将uid和device绑定到conn，每种设备只能登录一次，同设备的旧连接会以KickReasonLoginElsewhere被踢下线，
+// 将conn绑定到其他用户会先解绑原用户，连接停止时自动解绑)
+func (connMgr *ConnManager) BindUser(conn SConnection, uid, device string) error {
+	if uid == "" {
+		return ErrEmptyUID
+	}
+	connID := conn.GetConnID()
+
+	connMgr.userLock.Lock()
+	// checked under the lock, so a connection removed concurrently is never bound
+	// (在锁内检查，保证并发删除的连接不会被绑定)
+	if !connMgr.Connections.Has(conn.GetConnIdStr()) {
+		connMgr.userLock.Unlock()
+		return ErrConnNotFound
+	}
+	prev, hasPrev := connMgr.connUsers[connID]
+	if hasPrev && prev.uid == uid && prev.device == device {
+		connMgr.userLock.Unlock()
+		return nil
+	}
+	if hasPrev {
+		connMgr.removeUserLocked(connID, prev)
+	}
+	devices, ok := connMgr.users[uid]
+	if !ok {
+		devices = make(map[string]SConnection)
+		connMgr.users[uid] = devices
+	}
+	old := devices[device]
+	if old != nil {
+		delete(connMgr.connUsers, old.GetConnID())
+	}
+	devices[device] = conn
+	connMgr.connUsers[connID] = userBinding{uid: uid, device: device}
+	connMgr.userLock.Unlock()
+
+	if hasPrev {
+		connMgr.callUserHook(connMgr.onUserUnbind, conn, prev)
+	}
+	if old != nil {
+		connMgr.callUserHook(connMgr.onUserUnbind, old, userBinding{uid: uid, device: device})
+		slog.Ins().Infof("uid = %s login on device = %q again, kick connID = %d", uid, device, old.GetConnID())
+		connMgr.Kick(old, KickReasonLoginElsewhere)
+	}
+	conn.SetProperty(PropertyKeyUID, uid)
+	conn.SetProperty(PropertyKeyDevice, device)
+	connMgr.callUserHook(connMgr.onUserBind, conn, userBinding{uid: uid, device: device})
+	return nil
+}
+
+// UnbindUser unbinds the user from conn and removes the properties set by BindUser
+// (解除conn绑定的用户并删除BindUser设置的属性)
+func (connMgr *ConnManager) UnbindUser(conn SConnection) {
+	connMgr.unbindUser(conn, true)
+}
+
+// GetUserConns returns the connections of every device of uid (返回uid所有设备的连接)
+func (connMgr *ConnManager) GetUserConns(uid string) []SConnection {
+	connMgr.userLock.Lock()
+	defer connMgr.userLock.Unlock()
+
+	devices := connMgr.users[uid]
+	conns := make([]SConnection, 0, len(devices))
+	for _, conn := range devices {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// GetUserConn returns the connection of the device of uid (返回uid某个设备的连接)
+func (connMgr *ConnManager) GetUserConn(uid, device string) (SConnection, error) {
+	connMgr.userLock.Lock()
+	defer connMgr.userLock.Unlock()
+
+	if conn, ok := connMgr.users[uid][device]; ok {
+		return conn, nil
+	}
+	return nil, ErrConnNotFound
+}
+
+// Kick sends a message of the kick Cmd with the reason to conn and stops it, the message is sent before
+// the socket is closed (向conn发送包含原因的踢下线消息并停止连接，消息会在socket关闭之前发送)
+func (connMgr *ConnManager) Kick(conn SConnection, reason string) {
+	msg := NewNSQMsg(connMgr.kickMsgID, 0, smsg.SerializeNone, nil, []byte(reason))
+	if err := conn.SendBuffMsg(msg); err != nil {
+		slog.Ins().Warnf("send kick reason to connID = %d error: %s", conn.GetConnID(), err)
+	}
+	conn.Stop()
+}
+
+// unbindUser unbinds the user of conn, the properties are kept when conn stops so OnConnStop can still read them
+// (解除conn绑定的用户，连接停止时保留属性，使OnConnStop中仍然可以读取)
+func (connMgr *ConnManager) unbindUser(conn SConnection, removeProperties bool) {
+	connMgr.userLock.Lock()
+	binding, ok := connMgr.connUsers[conn.GetConnID()]
+	if ok {
+		connMgr.removeUserLocked(conn.GetConnID(), binding)
+	}
+	connMgr.userLock.Unlock()
+	if !ok {
+		return
+	}
+
+	if removeProperties {
+		conn.RemoveProperty(PropertyKeyUID)
+		conn.RemoveProperty(PropertyKeyDevice)
+	}
+	connMgr.callUserHook(connMgr.onUserUnbind, conn, binding)
+}
+
+func (connMgr *ConnManager) removeUserLocked(connID uint64, binding userBinding) {
+	delete(connMgr.connUsers, connID)
+	devices := connMgr.users[binding.uid]
+	if conn, ok := devices[binding.device]; ok && conn.GetConnID() == connID {
+		delete(devices, binding.device)
+		if len(devices) == 0 {
+			delete(connMgr.users, binding.uid)
+		}
+	}
+}
+
+func (connMgr *ConnManager) callUserHook(hooks []UserBindHook, conn SConnection, binding userBinding) {
+	for _, hook := range hooks {
+		hook(conn, binding.uid, binding.device)
+	}
+}
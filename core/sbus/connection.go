@@ -6,9 +6,12 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/quic-go/quic-go"
 	"github.com/wwengg/threego/core/slog"
+	"github.com/wwengg/threego/core/smsg"
 	"go.uber.org/zap"
 )
 
@@ -49,6 +52,87 @@ func PutMsgData(msgData *MsgData) {
 	MsgDataPool.Put(msgData)
 }
 
+// SendQueuePolicy decides what SendBuffData does when the send queue is full
+// (发送队列满时SendBuffData的处理策略)
+type SendQueuePolicy int
+
+const (
+	SendQueueBlock      SendQueuePolicy = iota // Block until SendBuffTimeout, then stop the connection (阻塞等待直到SendBuffTimeout超时，然后断开连接)
+	SendQueueDrop                              // Drop the data and return ErrSendQueueFull (丢弃数据并返回ErrSendQueueFull)
+	SendQueueDisconnect                        // Stop the connection and return ErrSendQueueFull (断开连接并返回ErrSendQueueFull)
+)
+
+const DefaultMaxMsgBuffChanLen uint32 = 1024
+
+// DefaultSendBuffTimeout bounds SendQueueBlock when SendBuffTimeout is not set, so a stalled peer can not
+// block the workers sending to it forever (SendBuffTimeout未设置时SendQueueBlock的阻塞上限，避免停滞的对端永久阻塞向其发送的worker)
+const DefaultSendBuffTimeout = 5 * time.Second
+
+// DefaultDrainTimeout bounds draining the send queue on stop, so a stalled peer can not keep the
+// connection open (停止时发送队列排空的时间上限，避免停滞的对端使连接无法关闭)
+const DefaultDrainTimeout = 5 * time.Second
+
+var (
+	ErrConnClosed       = errors.New("connection closed when send buff data")
+	ErrSendQueueFull    = errors.New("send buff queue is full")
+	ErrSendTimeout      = errors.New("send buff data timeout")
+	ErrPropertyNotFound = errors.New("no property found")
+	ErrPropertyType     = errors.New("property type mismatch")
+)
+
+// PropertyHook is called after a property of conn is set or removed, newValue is nil if it is removed
+// (conn的属性设置或删除后调用，删除时newValue为nil)
+type PropertyHook func(conn SConnection, key string, oldValue, newValue any)
+
+// GetPropertyAs returns the property of conn as T, ErrPropertyType is returned if it is not a T
+// (以T类型返回conn的属性，属性不是T类型时返回ErrPropertyType)
+func GetPropertyAs[T any](conn SConnection, key string) (T, error) {
+	var zero T
+	value, err := conn.GetProperty(key)
+	if err != nil {
+		return zero, err
+	}
+	v, ok := value.(T)
+	if !ok {
+		return zero, fmt.Errorf("%w: %s is %T, not %T", ErrPropertyType, key, value, zero)
+	}
+	return v, nil
+}
+
+// streamConn is implemented by the net.Conn running on a stream of a multiplexed connection, such as *QuicConn
+// (运行在多路复用连接的流上的net.Conn实现该接口，例如*QuicConn)
+type streamConn interface {
+	StreamID() quic.StreamID
+}
+
+type ConnOption func(c *Connection)
+
+// WithSendQueue sets the length of the send queue, the timeout of SendBuffData and the policy when the queue is full
+// (设置发送队列长度、SendBuffData的超时时间以及队列满时的处理策略)
+func WithSendQueue(maxMsgBuffChanLen uint32, sendBuffTimeout time.Duration, policy SendQueuePolicy) ConnOption {
+	return func(c *Connection) {
+		c.MaxMsgBuffChanLen = maxMsgBuffChanLen
+		c.SendBuffTimeout = sendBuffTimeout
+		c.SendQueuePolicy = policy
+	}
+}
+
+// WithDrainTimeout sets how long the writer drains the send queue on stop before the socket is closed,
+// DefaultDrainTimeout by default (设置停止时写协程排空发送队列的最长时间，超时后关闭socket，默认为DefaultDrainTimeout)
+func WithDrainTimeout(timeout time.Duration) ConnOption {
+	return func(c *Connection) {
+		c.DrainTimeout = timeout
+	}
+}
+
+// WithPropertyHook adds a hook called after a property is set or removed, it runs in the goroutine of the
+// caller and must not block (添加属性设置或删除后调用的钩子，在调用方协程中执行，不能阻塞)
+func WithPropertyHook(hook PropertyHook) ConnOption {
+	return func(c *Connection) {
+		c.propertyHooks = append(c.propertyHooks, hook)
+	}
+}
+
 type SConnection interface {
 	// Start the connection, make the current connection start working
 	// (启动连接，让当前连接开始工作)
@@ -70,21 +154,40 @@ type SConnection interface {
 	RemoteAddrString() string     // Get the remote address information of the connection as a string
 	GetConnVersion() int32
 
-	SendData(data []byte) error // Send data to the message queue to be sent to the remote TCP client later
-	SendMsg(msg SMsg) error
+	SendData(data []byte) error     // Send data directly to the remote TCP client (直接将数据发送给远程的TCP客户端)
+	SendMsg(msg SMsg) error         // Pack the msg and send it directly (封包后直接发送)
+	SendBuffData(data []byte) error // Send data to the send queue to be sent to the remote TCP client later (将数据发送到发送队列，由写协程发送给远程的TCP客户端)
+	SendBuffMsg(msg SMsg) error     // Pack the msg and send it to the send queue (封包后发送到发送队列)
+	// Send req as a Request with a new Seq and wait for the Response with the same Seq
+	// (以新的Seq将req作为Request发送，并等待Seq相同的Response)
+	Call(ctx context.Context, req SMsg) (SMsg, error)
 
-	SetProperty(key string, value string)   // Set connection property
-	GetProperty(key string) (string, error) // Get connection property
+	SetProperty(key string, value any)      // Set connection property
+	GetProperty(key string) (any, error)    // Get connection property, see GetPropertyAs for the typed getter
 	RemoveProperty(key string)              // Remove connection property
 	IsAlive() bool                          // Check if the current connection is alive(判断当前连接是否存活)
 	SetHeartBeat(checker SHeartbeatChecker) // Set the heartbeat detector (设置心跳检测器)
 
 	// 返回当前连接是否存在FrameDecoder
 	HasFrameDecoder() bool
+	// Get the underlying net.Conn, such as *QuicConn (获取底层的net.Conn，例如*QuicConn)
+	GetConn() net.Conn
+	// Get the datapack used to pack the messages of the connection (获取连接封包使用的datapack)
+	GetDatapack() SDataPack
+	// Whether the encryption handshake has finished, see WithEncryption (加密握手是否已完成)
+	IsEncrypted() bool
+
+	AddCloseCallback(handler, key interface{}, callback func()) // Add a close callback function (添加关闭回调函数)
+	RemoveCloseCallback(handler, key interface{})               // Remove a close callback function (删除关闭回调函数)
+	InvokeCloseCallbacks()                                      // Trigger the close callback function (触发关闭回调函数，独立协程完成)
+}
 
-	//AddCloseCallback(handler, key interface{}, callback func()) // Add a close callback function (添加关闭回调函数)
-	//RemoveCloseCallback(handler, key interface{})               // Remove a close callback function (删除关闭回调函数)
-	//InvokeCloseCallbacks()                                      // Trigger the close callback function (触发关闭回调函数，独立协程完成)
+// closeCallback is a close callback registered by a module, handler and key identify it
+// (模块注册的关闭回调，由handler和key标识)
+type closeCallback struct {
+	handler  interface{}
+	key      interface{}
+	callback func()
 }
 
 type Connection struct {
@@ -123,30 +226,100 @@ type Connection struct {
 	FrameDecoder SFrameDecoder
 
 	Datapack SDataPack
+	// datapackLock protects Datapack replaced by the encryption handshake (保护加密握手时替换的Datapack)
+	datapackLock sync.RWMutex
+	// sendLock orders the packing and queuing of an encrypted connection (保证加密连接封包与入队的顺序)
+	sendLock sync.Mutex
 
 	// msgLock is used for locking when users send and receive messages.
 	// (用户收发消息的Lock)
 	msgLock sync.RWMutex
 
+	// Buffered channel used for message communication between the business goroutines and the writer goroutine
+	// (有缓冲管道，用于业务协程与写协程之间的消息通信)
+	msgBuffChan chan []byte
+	// The length of msgBuffChan (发送队列长度)
+	MaxMsgBuffChanLen uint32
+	// The timeout of SendBuffData when the queue is full and the policy is SendQueueBlock, the connection is
+	// stopped when it expires, 0 means DefaultSendBuffTimeout and a negative value means no timeout
+	// (队列满且策略为SendQueueBlock时SendBuffData的超时时间，超时后断开连接，0表示DefaultSendBuffTimeout，负数表示不超时)
+	SendBuffTimeout time.Duration
+	// The policy when the send queue is full (发送队列满时的处理策略)
+	SendQueuePolicy SendQueuePolicy
+	// wait for the writer to drain msgBuffChan (等待写协程发送完msgBuffChan)
+	writerWg sync.WaitGroup
+	// wait for the reader and the other goroutines watching ctx, such as the idle monitor, to exit
+	// (等待读协程以及其他监听ctx的协程退出，例如空闲检测协程)
+	routineWg sync.WaitGroup
+	// The max time of draining msgBuffChan on stop (停止时排空msgBuffChan的最长时间)
+	DrainTimeout time.Duration
+	// The deadline of the writes while draining, in unix nano, 0 before stop (排空时写入的截止时间，停止前为0)
+	drainDeadline atomic.Int64
+
 	// property is the connection attribute. (链接属性)
-	Property map[string]string
+	Property map[string]any
+	// Called after a property is set or removed (属性设置或删除后调用)
+	propertyHooks []PropertyHook
 
 	// propertyLock protects the current property lock. (保护当前property的锁)
 	propertyLock sync.Mutex
 
 	IOReadBuffSize uint32
 
-	// Last activity time
-	// (最后一次活动时间)
-	lastActivityTime time.Time
+	// Last activity time, the last time data is read
+	// (最后一次活动时间，即最后一次读取到数据的时间)
+	lastActivityTime atomic.Int64
+	// The last time data is written (最后一次写入数据的时间)
+	lastWriteTime atomic.Int64
+
+	// The idle timeouts, 0 means disabled, see WithIdleTimeout (空闲超时时间，0表示不启用)
+	ReaderIdleTimeout time.Duration
+	WriterIdleTimeout time.Duration
+	AllIdleTimeout    time.Duration
+	// The deadline of writing the data to the socket, 0 means no deadline (写入socket的超时时间，0表示不超时)
+	WriteTimeout time.Duration
+	idleHandler  IdleHandler
+
+	// The token buckets of the connection, see WithRateLimit (连接的令牌桶)
+	rateLimit *connLimit
+	// The end-to-end encryption of the connection, see WithEncryption (连接的端到端加密)
+	encryption *connEncryption
 
 	hc SHeartbeatChecker
 
+	// readFunc, sendFunc and closeFunc replace the Read, Write and Close of Conn for
+	// the transports that are not a plain byte stream, such as WebSocket
+	// (对于WebSocket这类非字节流的传输方式，用于替换Conn的Read、Write以及Close)
+	readFunc  func(buffer []byte) ([]byte, error)
+	sendFunc  func(data []byte) error
+	closeFunc func() error
+	// The deadlines of those transports must be set on themselves, such as *websocket.Conn
+	// (这些传输方式的超时时间必须设置在其自身上，例如*websocket.Conn)
+	readDeadlineFunc  func(t time.Time) error
+	writeDeadlineFunc func(t time.Time) error
+
 	heartBeatDuration time.Duration
+
+	// self is the SConnection handed to the callbacks, tasks and ConnManager, it is the outer type when
+	// Connection is embedded, such as *WsConnection
+	// (传给回调、任务以及ConnManager的SConnection，Connection被嵌入时为外层类型，例如*WsConnection)
+	self SConnection
+
+	// The Seq of the last Call (最后一次Call的Seq)
+	seq atomic.Uint64
+	// The Calls waiting for the Response by Seq (按Seq等待Response的Call)
+	pending     map[uint64]chan SMsg
+	pendingLock sync.Mutex
+
+	// The close callbacks in the order they were added (按添加顺序保存的关闭回调)
+	closeCallbacks []closeCallback
+	// Whether InvokeCloseCallbacks has been called (InvokeCloseCallbacks是否已经调用过)
+	closeCallbacksInvoked bool
+	closeCallbackLock     sync.Mutex
 }
 
-func NewConnection(conn net.Conn, connId uint64, connVersion int32, taskHandler STaskHandler, OnConnStart, OnConnStop func(conn SConnection), frameDecoder SFrameDecoder, datapack SDataPack, connManager SConnManager, IOReadBuffSize uint32, heartbeatDuration time.Duration) SConnection {
-	return &Connection{
+func NewConnection(conn net.Conn, connId uint64, connVersion int32, taskHandler STaskHandler, OnConnStart, OnConnStop func(conn SConnection), frameDecoder SFrameDecoder, datapack SDataPack, connManager SConnManager, IOReadBuffSize uint32, heartbeatDuration time.Duration, opts ...ConnOption) SConnection {
+	c := &Connection{
 		Conn:              conn,
 		ConnID:            connId,
 		ConnIdStr:         fmt.Sprintf("%d", connId),
@@ -161,24 +334,45 @@ func NewConnection(conn net.Conn, connId uint64, connVersion int32, taskHandler
 		connManager:       connManager,
 		heartBeatDuration: heartbeatDuration,
 	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.init()
+	return c
+}
+
+// init creates ctx and msgBuffChan, so that Stop() and SendBuffData() are safe to call before Start()
+// (创建ctx以及msgBuffChan，保证Start()之前调用Stop()以及SendBuffData()也是安全的)
+func (bc *Connection) init() {
+	bc.ctx, bc.cancel = context.WithCancel(context.Background())
+	if bc.self == nil {
+		bc.self = bc
+	}
+	if bc.MaxMsgBuffChanLen == 0 {
+		bc.MaxMsgBuffChanLen = DefaultMaxMsgBuffChanLen
+	}
+	if bc.DrainTimeout <= 0 {
+		bc.DrainTimeout = DefaultDrainTimeout
+	}
+	bc.msgBuffChan = make(chan []byte, bc.MaxMsgBuffChanLen)
 }
 
 // 更新心跳检测时间
 func (c *Connection) updateActivity() {
-	c.lastActivityTime = time.Now()
+	c.lastActivityTime.Store(time.Now().UnixNano())
 }
 
 func (bc *Connection) callOnConnStart() {
 	if bc.OnConnStart != nil {
 		slog.Ins().Info("CallOnConnStart....")
-		bc.OnConnStart(bc)
+		bc.OnConnStart(bc.self)
 	}
 }
 
 func (bc *Connection) callOnConnStop() {
 	if bc.OnConnStop != nil {
 		slog.Ins().Info("callOnConnStop....")
-		bc.OnConnStop(bc)
+		bc.OnConnStop(bc.self)
 	}
 }
 
@@ -186,6 +380,16 @@ func (bc *Connection) isClosed() bool {
 	return bc.ctx == nil || bc.ctx.Err() != nil
 }
 
+// read reads the next chunk of data, the returned slice may share the memory of buffer
+// (读取下一段数据，返回的切片可能与buffer共享内存)
+func (bc *Connection) read(buffer []byte) ([]byte, error) {
+	if bc.readFunc != nil {
+		return bc.readFunc(buffer)
+	}
+	n, err := bc.Conn.Read(buffer)
+	return buffer[:n], err
+}
+
 func (bc *Connection) StartReader() {
 	slog.Ins().Infof("[Reader Goroutine is running]")
 	defer slog.Ins().Infof("%s [conn Reader exit!]", bc.ConnIdStr)
@@ -205,68 +409,50 @@ func (bc *Connection) StartReader() {
 			// 停止循环 不读了，连接断开啦！！
 			return
 		default:
-			if n, err := bc.Conn.Read(buffer); err != nil {
-				slog.Ins().Errorf("read msg head [read datalen=%d], error = %s", n, err)
+			bc.setReadDeadline()
+			if data, err := bc.read(buffer); err != nil {
+				if bc.handleReadTimeout(err) {
+					continue
+				}
+				slog.Ins().Errorf("read msg head [read datalen=%d], error = %s", len(data), err)
 				return
 			} else {
+				n := len(data)
 				if n == 0 {
 					continue
 				}
-				if n > 0 && bc.hc != nil {
-					bc.updateActivity()
-				}
+				bc.updateActivity()
 				// Deal with the custom protocol fragmentation problem, added by uuxia 2023-03-21
 				// (处理自定义协议断粘包问题)
 				if bc.FrameDecoder != nil {
 					// Decode the 0-n bytes of data read
 					// (为读取到的0-n个字节的数据进行解码)
-					bufArrays, err2 := bc.FrameDecoder.Decode(buffer[0:n])
-					if bufArrays == nil {
-						continue
+					bufArrays, err2 := bc.FrameDecoder.Decode(data)
+					if err2 != nil {
+						// 发送过长数据包或协议错误，错误的帧已被丢弃
+						slog.Ins().Error(err2.Error())
 					}
 					for _, bytes := range bufArrays {
-						msg, err := bc.Datapack.Unpack(bytes)
+						msg, err := bc.GetDatapack().Unpack(bytes)
 						if err != nil {
 							slog.Ins().Error(err.Error())
 							continue
 						}
-						// Get the current client's Request data
-						// (得到当前客户端请求的Request数据)
-						task := GetTask(bc, msg)
-						// 如果cmd为心跳包，不走后续逻辑，直接心跳保活 发送心跳包给客户端
-						if task.GetCmd() == bc.hc.Cmd() {
-							err := bc.hc.SendHeartBeatMsg()
-							if err != nil {
-								slog.Ins().Error("SendHeartBeatMsg", zap.Error(err))
-								return
-							}
-							continue
+						if err := bc.dispatchMsg(msg); err != nil {
+							return
 						}
-						bc.TaskHandler.SendTaskToTaskQueue(task)
-					}
-					if err2 != nil {
-						slog.Ins().Error(err2.Error())
-						continue // 发送过长数据包或协议错误
 					}
 				} else {
-					msg, err := bc.Datapack.Unpack(buffer[0:n])
+					// The buffer is reused by the next read, so unpack a copy of it
+					// (buffer会被下一次读取复用，所以拆包一份拷贝)
+					msg, err := bc.GetDatapack().Unpack(append([]byte(nil), data...))
 					if err != nil {
 						slog.Ins().Error(err.Error())
 						continue
 					}
-					// Get the current client's Request data
-					// (得到当前客户端请求的Request数据)
-					task := GetTask(bc, msg)
-					// 如果cmd为心跳包，不走后续逻辑，直接心跳保活 发送心跳包给客户端
-					if task.GetCmd() == bc.hc.Cmd() {
-						err := bc.hc.SendHeartBeatMsg()
-						if err != nil {
-							slog.Ins().Error("SendHeartBeatMsg", zap.Error(err))
-							return
-						}
-						continue
+					if err := bc.dispatchMsg(msg); err != nil {
+						return
 					}
-					bc.TaskHandler.SendTaskToTaskQueue(task)
 				}
 			}
 
@@ -274,41 +460,191 @@ func (bc *Connection) StartReader() {
 	}
 }
 
+// StartWriter is the goroutine that writes the data in msgBuffChan to the client,
+// it drains msgBuffChan before exiting
+// (写协程，将msgBuffChan中的数据发送给客户端，退出前会发送完msgBuffChan中的数据)
+func (bc *Connection) StartWriter() {
+	slog.Ins().Infof("[Writer Goroutine is running]")
+	defer slog.Ins().Infof("%s [conn Writer exit!]", bc.ConnIdStr)
+	defer bc.writerWg.Done()
+
+	for {
+		select {
+		case data := <-bc.msgBuffChan:
+			if err := bc.write(data); err != nil {
+				slog.Ins().Errorf("Send Buff Data error:, %s Conn Writer exit", err)
+				bc.Stop()
+				return
+			}
+		case <-bc.ctx.Done():
+			bc.drainDeadline.Store(time.Now().Add(bc.DrainTimeout).UnixNano())
+			for {
+				select {
+				case data := <-bc.msgBuffChan:
+					if err := bc.write(data); err != nil {
+						slog.Ins().Errorf("Send Buff Data error:, %s Conn Writer exit", err)
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// dispatchMsg sends the msg to the TaskHandler, or handles it directly if it is a heartbeat,
+// the reader exits if an error is returned
+// (将消息交给TaskHandler，心跳消息则直接处理，返回错误时读协程退出)
+func (bc *Connection) dispatchMsg(msg SMsg) error {
+	return bc.dispatch(msg, false)
+}
+
+// dispatchDatagram unpacks a QUIC datagram by the current datapack and dispatches it like the msgs read
+// from the stream, the encryption handshake must be sent on the stream
+// (使用当前的datapack拆包QUIC datagram，并与从流中读取的消息一样分发，加密握手必须在流上发送)
+func (bc *Connection) dispatchDatagram(data []byte) error {
+	msg, err := datagramPack(bc.GetDatapack()).Unpack(data)
+	if err != nil {
+		return err
+	}
+	if bc.encryption != nil && msg.GetCmd() == bc.encryption.msgID {
+		return ErrDatagramHandshake
+	}
+	return bc.dispatch(msg, true)
+}
+
+func (bc *Connection) dispatch(msg SMsg, datagram bool) error {
+	// Get the current client's Request data
+	// (得到当前客户端请求的Request数据)
+	if msg.GetMessageType() == smsg.Response && bc.resolveCall(msg) {
+		return nil
+	}
+	if !bc.checkRateLimit(msg) {
+		return nil
+	}
+	if !bc.checkEncryption(msg) {
+		return nil
+	}
+	task := GetTask(bc.self, msg)
+	if sc, ok := bc.Conn.(streamConn); ok {
+		task.Set(TaskKeyStreamID, sc.StreamID())
+	}
+	if datagram {
+		task.Set(TaskKeyDatagram, true)
+	}
+	// 如果cmd为心跳包，不走后续逻辑，直接心跳保活
+	if bc.hc != nil && task.GetCmd() == bc.hc.Cmd() {
+		return bc.handleHeartbeat(task)
+	}
+	// A rejected task has been replied, so the reader goes on (被拒绝的任务已经回复，读协程继续)
+	_ = bc.TaskHandler.SendTaskToTaskQueue(task)
+	return nil
+}
+
+// handleHeartbeat runs the heartbeat router if there is one, otherwise sends the heartbeat msg back to the client
+// (存在心跳路由则执行心跳路由，否则发送心跳包给客户端)
+func (bc *Connection) handleHeartbeat(task STask) error {
+	defer PutTask(task)
+	if router := bc.hc.Router(); router != nil {
+		task.BindRouter(router)
+		if err := task.Call(); err != nil {
+			slog.Ins().Error("heartbeat router", zap.Error(err))
+		}
+		return nil
+	}
+	if err := bc.hc.SendHeartBeatMsg(); err != nil {
+		slog.Ins().Error("SendHeartBeatMsg", zap.Error(err))
+		return err
+	}
+	return nil
+}
+
 // Start()
 func (bc *Connection) Start() {
-	bc.ctx, bc.cancel = context.WithCancel(context.Background())
+	if bc.ctx == nil {
+		bc.init()
+	}
 
 	bc.callOnConnStart()
+	bc.updateActivity()
+	bc.lastWriteTime.Store(bc.lastActivityTime.Load())
 	// Start heartbeating detection
 	if bc.hc != nil {
 		bc.hc.Start()
-		bc.updateActivity()
+	}
+	if bc.WriterIdleTimeout > 0 || bc.AllIdleTimeout > 0 {
+		bc.goRoutine(bc.startIdleMonitor)
 	}
 
 	// Start the Goroutine for reading data from the client
 	// (开启用户从客户端读取数据流程的Goroutine)
-	go bc.StartReader()
+	bc.goRoutine(bc.StartReader)
+	// Start the Goroutine for writing data back to the client
+	// (开启用于写回客户端数据流程的Goroutine)
+	bc.writerWg.Add(1)
+	go bc.StartWriter()
 
 	select {
 	case <-bc.ctx.Done():
 		// If the user has registered a close callback for the connection, it should be called explicitly at this moment.
 		// (如果用户注册了该链接的	关闭回调业务，那么在此刻应该显示调用)
 		bc.callOnConnStop()
+		go bc.InvokeCloseCallbacks()
 
 		if bc.hc != nil {
 			bc.hc.Stop()
 		}
 
-		_ = bc.Conn.Close()
+		// Wait for the writer to drain the send queue before closing the socket, a stalled peer is cut
+		// off after DrainTimeout, closing the socket unblocks the pending write
+		// (关闭socket之前等待写协程发送完队列中的数据，对端停滞时在DrainTimeout后关闭，关闭socket会解除阻塞的写入)
+		drained := make(chan struct{})
+		go func() {
+			bc.writerWg.Wait()
+			close(drained)
+		}()
+		timer := time.NewTimer(bc.DrainTimeout)
+		select {
+		case <-drained:
+		case <-timer.C:
+			slog.Ins().Warnf("connID = %d drain send queue timeout, close it", bc.ConnID)
+		}
+		timer.Stop()
+		bc.closeSocket()
+		<-drained
+		// closing the socket unblocks the reader, so no goroutine of the connection is left after Start returns
+		// (关闭socket会解除读协程的阻塞，因此Start返回后连接不会遗留协程)
+		bc.routineWg.Wait()
 		if bc.connManager != nil {
-			bc.connManager.Remove(bc)
+			bc.connManager.Remove(bc.self)
 		}
 		slog.Ins().Debugf("Conn Stop() ...ConnID = %d", bc.ConnID)
 		return
 	}
 }
+
+// goRoutine runs fn in a goroutine that Start waits for before returning (在Start返回之前会等待的协程中运行fn)
+func (bc *Connection) goRoutine(fn func()) {
+	bc.routineWg.Add(1)
+	go func() {
+		defer bc.routineWg.Done()
+		fn()
+	}()
+}
+
+func (bc *Connection) closeSocket() {
+	if bc.closeFunc != nil {
+		_ = bc.closeFunc()
+	} else if bc.Conn != nil {
+		_ = bc.Conn.Close()
+	}
+}
+
 func (bc *Connection) Stop() {
-	bc.cancel()
+	if bc.cancel != nil {
+		bc.cancel()
+	}
 }
 func (bc *Connection) Context() context.Context {
 	return bc.ctx
@@ -328,45 +664,204 @@ func (bc *Connection) LocalAddrString() string  { return bc.Conn.LocalAddr().Str
 func (bc *Connection) RemoteAddrString() string { return bc.Conn.RemoteAddr().String() }
 func (bc *Connection) GetConnVersion() int32    { return bc.ConnVersion }
 func (bc *Connection) HasFrameDecoder() bool    { return bc.FrameDecoder != nil }
+func (bc *Connection) GetConn() net.Conn        { return bc.Conn }
+func (bc *Connection) GetDatapack() SDataPack {
+	bc.datapackLock.RLock()
+	defer bc.datapackLock.RUnlock()
+	return bc.Datapack
+}
+
 func (bc *Connection) SendData(data []byte) error {
-	bc.msgLock.RLock()
-	defer bc.msgLock.RUnlock()
+	if bc.isClosed() == true {
+		return errors.New("Connection closed when send Data")
+	}
+	return bc.write(data)
+}
+
+// write writes data to the socket, the lock makes sure the data written by
+// SendData and the writer goroutine never interleave
+// (将数据写入socket，加锁保证SendData与写协程写入的数据不会交错)
+func (bc *Connection) write(data []byte) (err error) {
+	bc.msgLock.Lock()
+	defer bc.msgLock.Unlock()
 	defer func() {
-		if err := recover(); err != nil {
-			slog.Ins().Errorf("SendData connID=%d, panic err=%v", bc.GetConnID(), err)
+		if r := recover(); r != nil {
+			slog.Ins().Errorf("SendData connID=%d, panic err=%v", bc.GetConnID(), r)
+			err = fmt.Errorf("send data panic: %v", r)
 		}
 	}()
-	if bc.isClosed() == true {
-		return errors.New("Connection closed when send Data")
+	var deadline time.Time
+	if bc.WriteTimeout > 0 {
+		deadline = time.Now().Add(bc.WriteTimeout)
+	}
+	if drain := bc.drainDeadline.Load(); drain > 0 && (deadline.IsZero() || drain < deadline.UnixNano()) {
+		deadline = time.Unix(0, drain)
+	}
+	if !deadline.IsZero() {
+		bc.setWriteDeadline(deadline)
+	}
+	if bc.sendFunc != nil {
+		err = bc.sendFunc(data)
+	} else {
+		_, err = bc.Conn.Write(data)
 	}
-	_, err := bc.Conn.Write(data)
 	if err != nil {
 		slog.Ins().Errorf("SendMsg err data = %+v, err = %+v", data, err)
 		return err
 	} else {
+		bc.lastWriteTime.Store(time.Now().UnixNano())
 		slog.Ins().Debug("SendMsg data success")
 	}
 	return nil
 }
-func (bc *Connection) SendMsg(msg SMsg) error {
+
+// pack packs msg and passes the data to send while holding the read lock of the datapack, so no frame packed
+// before the encryption handshake is queued after its response, the sends of an encrypted connection are
+// serialized too, so the frames are queued in the order of their nonce counters
+// (持有datapack读锁封包msg并将数据交给send，使握手之前封包的帧不会排在握手响应之后，
+// 加密连接的发送也会串行化，使帧按nonce计数器的顺序进入队列)
+func (bc *Connection) pack(msg SMsg, send func([]byte) error) error {
+	if bc.encryption != nil {
+		bc.sendLock.Lock()
+		defer bc.sendLock.Unlock()
+	}
+	bc.datapackLock.RLock()
+	defer bc.datapackLock.RUnlock()
 	msg.SetHasFrameDecoder(bc.HasFrameDecoder()) // 判断该连接是否需要编码器，pack的时候就可以选择性pack
-	if data, err := bc.Datapack.Pack(msg); err == nil {
-		slog.Ins().Debug("pack", zap.Any("msg", msg))
-		return bc.SendData(data)
-	} else {
+	data, err := bc.Datapack.Pack(msg)
+	if err != nil {
 		return err
 	}
+	slog.Ins().Debug("pack", zap.Any("msg", msg))
+	return send(data)
+}
+
+// SendMsg packs and writes the msg directly, on an encrypted connection it is queued like SendBuffMsg, or it
+// would overtake the queued frames with smaller nonce counters
+// (封包并直接写出msg，加密连接上与SendBuffMsg一样进入队列，否则会超过队列中nonce计数器更小的帧)
+func (bc *Connection) SendMsg(msg SMsg) error {
+	if bc.encryption != nil {
+		return bc.SendBuffMsg(msg)
+	}
+	return bc.pack(msg, bc.SendData)
+}
+
+// SendBuffData sends data to the send queue, what happens when the queue is full depends on SendQueuePolicy
+// (将数据发送到发送队列，队列满时的行为由SendQueuePolicy决定)
+func (bc *Connection) SendBuffData(data []byte) error {
+	if bc.isClosed() == true {
+		return ErrConnClosed
+	}
+
+	select {
+	case bc.msgBuffChan <- data:
+		return nil
+	default:
+	}
+
+	switch bc.SendQueuePolicy {
+	case SendQueueDrop:
+		slog.Ins().Warnf("connID=%d send buff queue is full, drop data", bc.ConnID)
+		return ErrSendQueueFull
+	case SendQueueDisconnect:
+		slog.Ins().Warnf("connID=%d send buff queue is full, stop the connection", bc.ConnID)
+		bc.Stop()
+		return ErrSendQueueFull
+	default:
+		var timeout <-chan time.Time
+		sendBuffTimeout := bc.SendBuffTimeout
+		if sendBuffTimeout == 0 {
+			sendBuffTimeout = DefaultSendBuffTimeout
+		}
+		if sendBuffTimeout > 0 {
+			timer := time.NewTimer(sendBuffTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case bc.msgBuffChan <- data:
+			return nil
+		case <-timeout:
+			slog.Ins().Warnf("connID=%d send buff data timeout, stop the connection", bc.ConnID)
+			bc.Stop()
+			return ErrSendTimeout
+		case <-bc.ctx.Done():
+			return ErrConnClosed
+		}
+	}
+}
+
+func (bc *Connection) SendBuffMsg(msg SMsg) error {
+	return bc.pack(msg, bc.SendBuffData)
 }
-func (bc *Connection) SetProperty(key string, value string) {
+
+// Call sends req as a Request with a new Seq and waits for the Response with the same Seq, it returns
+// ctx.Err() if ctx is done first, or ErrConnClosed if the connection stops first
+// (以新的Seq将req作为Request发送并等待Seq相同的Response，ctx先结束时返回ctx.Err()，连接先停止时返回ErrConnClosed)
+func (bc *Connection) Call(ctx context.Context, req SMsg) (SMsg, error) {
+	if bc.isClosed() {
+		return nil, ErrConnClosed
+	}
+	seq := bc.seq.Add(1)
+	req.SetSeq(seq)
+	req.SetMessageType(smsg.Request)
+
+	ch := make(chan SMsg, 1)
+	bc.pendingLock.Lock()
+	if bc.pending == nil {
+		bc.pending = make(map[uint64]chan SMsg)
+	}
+	bc.pending[seq] = ch
+	bc.pendingLock.Unlock()
+	defer func() {
+		bc.pendingLock.Lock()
+		delete(bc.pending, seq)
+		bc.pendingLock.Unlock()
+	}()
+
+	if err := bc.SendBuffMsg(req); err != nil {
+		return nil, err
+	}
+	select {
+	case resp := <-ch:
+		return resp, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-bc.ctx.Done():
+		return nil, ErrConnClosed
+	}
+}
+
+// resolveCall delivers the Response to the Call waiting for its Seq, it returns false if no Call is waiting
+// (将Response交给等待其Seq的Call，没有Call在等待时返回false)
+func (bc *Connection) resolveCall(msg SMsg) bool {
+	bc.pendingLock.Lock()
+	ch, ok := bc.pending[msg.GetSeq()]
+	if ok {
+		delete(bc.pending, msg.GetSeq())
+	}
+	bc.pendingLock.Unlock()
+	if ok {
+		ch <- msg
+	}
+	return ok
+}
+
+func (bc *Connection) SetProperty(key string, value any) {
 	bc.propertyLock.Lock()
-	defer bc.propertyLock.Unlock()
 	if bc.Property == nil {
-		bc.Property = make(map[string]string)
+		bc.Property = make(map[string]any)
 	}
-
+	oldValue := bc.Property[key]
 	bc.Property[key] = value
+	if bc.connManager != nil {
+		bc.connManager.OnPropertyChange(bc.self, key, oldValue, value)
+	}
+	bc.propertyLock.Unlock()
+
+	bc.callPropertyHooks(key, oldValue, value)
 }
-func (bc *Connection) GetProperty(key string) (string, error) {
+func (bc *Connection) GetProperty(key string) (any, error) {
 	bc.propertyLock.Lock()
 	defer bc.propertyLock.Unlock()
 
@@ -374,27 +869,122 @@ func (bc *Connection) GetProperty(key string) (string, error) {
 		return value, nil
 	}
 
-	return "", errors.New("no property found")
+	return nil, ErrPropertyNotFound
 }
 func (bc *Connection) RemoveProperty(key string) {
+	bc.propertyLock.Lock()
+	oldValue, ok := bc.Property[key]
+	if !ok {
+		bc.propertyLock.Unlock()
+		return
+	}
+	delete(bc.Property, key)
+	if bc.connManager != nil {
+		bc.connManager.OnPropertyChange(bc.self, key, oldValue, nil)
+	}
+	bc.propertyLock.Unlock()
+
+	bc.callPropertyHooks(key, oldValue, nil)
+}
+
+// rangeProperties calls fn with every property while holding the property lock, so the ConnManager can
+// index them without racing with SetProperty
+// (持有property锁时对每个属性调用fn，使ConnManager建立索引时不会与SetProperty竞争)
+func (bc *Connection) rangeProperties(fn func(key string, value any)) {
 	bc.propertyLock.Lock()
 	defer bc.propertyLock.Unlock()
+	for key, value := range bc.Property {
+		fn(key, value)
+	}
+}
 
-	delete(bc.Property, key)
+func (bc *Connection) callPropertyHooks(key string, oldValue, newValue any) {
+	for _, hook := range bc.propertyHooks {
+		hook(bc.self, key, oldValue, newValue)
+	}
 }
 func (bc *Connection) IsAlive() bool {
 	if bc.isClosed() {
 		return false
 	}
-	// Check the last activity time of the connection. If it's beyond the heartbeat interval,
+	// The heartbeat interval is used with a heartbeat checker, otherwise the ReaderIdleTimeout,
+	// without both only the closed state counts
+	// (有心跳检测器时使用心跳间隔，否则使用ReaderIdleTimeout，两者都没有时只判断是否关闭)
+	timeout := bc.ReaderIdleTimeout
+	if bc.hc != nil && bc.heartBeatDuration > 0 {
+		timeout = bc.heartBeatDuration
+	}
+	if timeout <= 0 {
+		return true
+	}
+	// Check the last activity time of the connection. If it's beyond the timeout,
 	// then the connection is considered dead.
-	// (检查连接最后一次活动时间，如果超过心跳间隔，则认为连接已经死亡)
-	return time.Now().Sub(bc.lastActivityTime) < bc.heartBeatDuration
+	// (检查连接最后一次活动时间，如果超过超时时间，则认为连接已经死亡)
+	return time.Since(time.Unix(0, bc.lastActivityTime.Load())) < timeout
 }
 func (bc *Connection) SetHeartBeat(checker SHeartbeatChecker) {
 	bc.hc = checker
 }
 
-// func (bc *BaseConnection) AddCloseCallback(handler, key interface{}, callback func()) {}
-// func (bc *BaseConnection) RemoveCloseCallback(handler, key interface{})               {}
-// func (bc *BaseConnection) InvokeCloseCallbacks()
+// AddCloseCallback adds a callback invoked once when the connection stops, a callback with the same handler
+// and key is replaced, the callback is invoked at once in a new goroutine if the connection has stopped already
+// (添加连接停止时调用一次的回调，handler和key相同的回调会被替换，连接已经停止时立即在新协程中调用)
+func (bc *Connection) AddCloseCallback(handler, key interface{}, callback func()) {
+	if callback == nil {
+		return
+	}
+	bc.closeCallbackLock.Lock()
+	if bc.closeCallbacksInvoked {
+		bc.closeCallbackLock.Unlock()
+		go bc.invokeCloseCallback(closeCallback{handler: handler, key: key, callback: callback})
+		return
+	}
+	defer bc.closeCallbackLock.Unlock()
+	for i := range bc.closeCallbacks {
+		if bc.closeCallbacks[i].handler == handler && bc.closeCallbacks[i].key == key {
+			bc.closeCallbacks[i].callback = callback
+			return
+		}
+	}
+	bc.closeCallbacks = append(bc.closeCallbacks, closeCallback{handler: handler, key: key, callback: callback})
+}
+
+// RemoveCloseCallback removes the callback added with handler and key (删除以handler和key添加的回调)
+func (bc *Connection) RemoveCloseCallback(handler, key interface{}) {
+	bc.closeCallbackLock.Lock()
+	defer bc.closeCallbackLock.Unlock()
+	for i := range bc.closeCallbacks {
+		if bc.closeCallbacks[i].handler == handler && bc.closeCallbacks[i].key == key {
+			bc.closeCallbacks = append(bc.closeCallbacks[:i], bc.closeCallbacks[i+1:]...)
+			return
+		}
+	}
+}
+
+// InvokeCloseCallbacks invokes the close callbacks in the order they were added, only the first call
+// takes effect, a panic in a callback does not stop the others
+// (按添加顺序调用关闭回调，只有第一次调用生效，某个回调panic不影响其他回调)
+func (bc *Connection) InvokeCloseCallbacks() {
+	bc.closeCallbackLock.Lock()
+	if bc.closeCallbacksInvoked {
+		bc.closeCallbackLock.Unlock()
+		return
+	}
+	bc.closeCallbacksInvoked = true
+	callbacks := bc.closeCallbacks
+	bc.closeCallbacks = nil
+	bc.closeCallbackLock.Unlock()
+
+	for _, cb := range callbacks {
+		bc.invokeCloseCallback(cb)
+	}
+}
+
+func (bc *Connection) invokeCloseCallback(cb closeCallback) {
+	defer func() {
+		if err := recover(); err != nil {
+			slog.Ins().Errorf("close callback of connID = %d, handler = %v, key = %v panic: %v", bc.ConnID, cb.handler, cb.key, err)
+		}
+	}()
+	cb.callback()
+}
@@ -0,0 +1,274 @@
+package sbus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/wwengg/threego/core/sconfig"
+	"github.com/wwengg/threego/core/slog"
+	"github.com/wwengg/threego/core/smsg"
+)
+
+func TestConnectionCall(t *testing.T) {
+	slog.NewZapLog(&sconfig.Slog{Director: t.TempDir(), Level: "error"})
+	conn := NewConnection(nil, 1, 0, nil, nil, nil, nil, NewTcpDataPack(), nil, 0, 0).(*Connection)
+
+	// the peer answers the requests in the send queue in reverse order (对端逆序回复发送队列中的请求)
+	go func() {
+		var reqs []SMsg
+		for len(reqs) < 2 {
+			req, err := conn.Datapack.Unpack(<-conn.msgBuffChan)
+			if err != nil || req.GetMessageType() != smsg.Request {
+				t.Errorf("unexpected request %+v, %v", req, err)
+				return
+			}
+			reqs = append(reqs, req)
+		}
+		for i := len(reqs) - 1; i >= 0; i-- {
+			_ = conn.dispatchMsg(NewResponseMsg(reqs[i], RetOK, reqs[i].GetData()))
+		}
+	}()
+
+	results := make(chan error, 2)
+	for _, body := range []string{"a", "b"} {
+		body := body
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			resp, err := conn.Call(ctx, NewNSQMsg(1, 0, smsg.SerializeNone, nil, []byte(body)))
+			if err == nil && string(resp.GetData()) != body {
+				err = errors.New("response of " + body + " is " + string(resp.GetData()))
+			}
+			results <- err
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-results; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestConnectionCallTimeoutAndStop(t *testing.T) {
+	slog.NewZapLog(&sconfig.Slog{Director: t.TempDir(), Level: "error"})
+	conn := NewConnection(nil, 1, 0, nil, nil, nil, nil, NewTcpDataPack(), nil, 0, 0).(*Connection)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := conn.Call(ctx, NewNSQMsg(1, 0, smsg.SerializeNone, nil, nil)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected DeadlineExceeded, got %v", err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		conn.Stop()
+	}()
+	if _, err := conn.Call(context.Background(), NewNSQMsg(1, 0, smsg.SerializeNone, nil, nil)); !errors.Is(err, ErrConnClosed) {
+		t.Fatalf("expected ErrConnClosed, got %v", err)
+	}
+	if len(conn.pending) != 0 {
+		t.Fatalf("expected no pending call, got %d", len(conn.pending))
+	}
+}
+
+func TestConnectionCloseCallbacks(t *testing.T) {
+	slog.NewZapLog(&sconfig.Slog{Director: t.TempDir(), Level: "error"})
+	conn := NewConnection(nil, 1, 0, nil, nil, nil, nil, NewTcpDataPack(), nil, 0, 0)
+
+	calls := make(chan string, 8)
+	conn.AddCloseCallback("room", 1, func() { calls <- "room" })
+	conn.AddCloseCallback("chat", 1, func() { panic("chat") })
+	conn.AddCloseCallback("presence", 1, func() { calls <- "presence" })
+	conn.AddCloseCallback("presence", 2, func() { calls <- "removed" })
+	conn.RemoveCloseCallback("presence", 2)
+	// the callback with the same handler and key is replaced (handler和key相同的回调会被替换)
+	conn.AddCloseCallback("room", 1, func() { calls <- "room replaced" })
+
+	conn.InvokeCloseCallbacks()
+	conn.InvokeCloseCallbacks()
+	conn.AddCloseCallback("late", 1, func() { calls <- "late" })
+
+	for _, want := range []string{"room replaced", "presence", "late"} {
+		select {
+		case got := <-calls:
+			if got != want {
+				t.Fatalf("got callback %q, want %q", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("callback %q not invoked", want)
+		}
+	}
+	select {
+	case got := <-calls:
+		t.Fatalf("unexpected callback %q", got)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestConnectionPropertyIndex(t *testing.T) {
+	slog.NewZapLog(&sconfig.Slog{Director: t.TempDir(), Level: "error"})
+	connMgr := NewConnManager()
+	connMgr.AddIndex("uid")
+
+	var changes []string
+	hook := WithPropertyHook(func(conn SConnection, key string, oldValue, newValue any) {
+		changes = append(changes, fmt.Sprintf("%s:%v->%v", key, oldValue, newValue))
+	})
+	a := NewConnection(nil, 1, 0, nil, nil, nil, nil, NewTcpDataPack(), connMgr, 0, 0, hook)
+	b := NewConnection(nil, 2, 0, nil, nil, nil, nil, NewTcpDataPack(), connMgr, 0, 0)
+	connMgr.Add(a)
+	a.SetProperty("uid", int64(123))
+	// the properties set before Add are indexed by Add (Add之前设置的属性由Add建立索引)
+	b.SetProperty("uid", int64(123))
+	connMgr.Add(b)
+
+	if uid, err := GetPropertyAs[int64](a, "uid"); err != nil || uid != 123 {
+		t.Fatalf("unexpected uid %v, %v", uid, err)
+	}
+	if _, err := GetPropertyAs[string](a, "uid"); !errors.Is(err, ErrPropertyType) {
+		t.Fatalf("expected ErrPropertyType, got %v", err)
+	}
+	if conns := connMgr.FindByProperty("uid", int64(123)); len(conns) != 2 {
+		t.Fatalf("found %d connections, want 2", len(conns))
+	}
+
+	a.SetProperty("uid", int64(456))
+	connMgr.Remove(b)
+	if conns := connMgr.FindByProperty("uid", int64(123)); len(conns) != 0 {
+		t.Fatalf("found %d connections, want 0", len(conns))
+	}
+	if conns := connMgr.FindByProperty("uid", int64(456)); len(conns) != 1 || conns[0] != a {
+		t.Fatalf("unexpected connections %v", conns)
+	}
+	a.RemoveProperty("uid")
+	if conns := connMgr.FindByProperty("uid", int64(456)); len(conns) != 0 {
+		t.Fatalf("found %d connections, want 0", len(conns))
+	}
+
+	want := []string{"uid:<nil>->123", "uid:123->456", "uid:456-><nil>"}
+	if fmt.Sprint(changes) != fmt.Sprint(want) {
+		t.Fatalf("hook calls %v, want %v", changes, want)
+	}
+}
+
+func TestConnectionIdleTimeout(t *testing.T) {
+	slog.NewZapLog(&sconfig.Slog{Director: t.TempDir(), Level: "error"})
+
+	events := make(chan IdleState, 16)
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := NewConnection(server, 1, 0, nil, nil, nil, nil, NewTcpDataPack(), nil, 64, 0,
+		WithIdleTimeout(30*time.Millisecond, 30*time.Millisecond, 0),
+		WithIdleHandler(func(conn SConnection, state IdleState) { events <- state }))
+	started := make(chan struct{})
+	go func() {
+		defer close(started)
+		conn.Start()
+	}()
+	// wait for Start to return, so it does not log after the test (等待Start返回，避免测试结束后仍在打印日志)
+	defer func() {
+		conn.Stop()
+		<-started
+	}()
+
+	seen := make(map[IdleState]bool)
+	for !seen[ReaderIdle] || !seen[WriterIdle] {
+		select {
+		case state := <-events:
+			seen[state] = true
+		case <-time.After(time.Second):
+			t.Fatalf("idle events %v, want ReaderIdle and WriterIdle", seen)
+		}
+	}
+	// the handler keeps the connection open, the reader goes on after the timeout
+	// (处理函数保持连接打开，读协程在超时后继续读取)
+	if conn.Context().Err() != nil {
+		t.Fatal("the connection is stopped with an IdleHandler")
+	}
+
+	// without a handler the connection is stopped on ReaderIdle (没有处理函数时ReaderIdle会停止连接)
+	server2, client2 := net.Pipe()
+	defer client2.Close()
+	conn2 := NewConnection(server2, 2, 0, nil, nil, nil, nil, NewTcpDataPack(), nil, 64, 0,
+		WithIdleTimeout(20*time.Millisecond, 0, 0))
+	started2 := make(chan struct{})
+	go func() {
+		defer close(started2)
+		conn2.Start()
+	}()
+	select {
+	case <-started2:
+	case <-time.After(time.Second):
+		t.Fatal("the idle connection is not stopped")
+	}
+}
+
+func TestConnectionSendQueuePolicies(t *testing.T) {
+	slog.NewZapLog(&sconfig.Slog{Director: t.TempDir(), Level: "error"})
+
+	for _, tc := range []struct {
+		name    string
+		policy  SendQueuePolicy
+		wantErr error
+		stopped bool
+	}{
+		{"block", SendQueueBlock, ErrSendTimeout, true},
+		{"drop", SendQueueDrop, ErrSendQueueFull, false},
+		{"disconnect", SendQueueDisconnect, ErrSendQueueFull, true},
+	} {
+		// the writer is not started, so the queue of length 1 is full after the first data
+		// (写协程未启动，长度为1的队列在第一份数据之后就满了)
+		conn := NewConnection(nil, 1, 0, nil, nil, nil, nil, NewTcpDataPack(), nil, 0, 0,
+			WithSendQueue(1, 10*time.Millisecond, tc.policy))
+		if err := conn.SendBuffData([]byte("first")); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if err := conn.SendBuffData([]byte("second")); !errors.Is(err, tc.wantErr) {
+			t.Fatalf("%s: err = %v, want %v", tc.name, err, tc.wantErr)
+		}
+		if stopped := conn.Context().Err() != nil; stopped != tc.stopped {
+			t.Fatalf("%s: stopped = %v, want %v", tc.name, stopped, tc.stopped)
+		}
+		if tc.stopped {
+			if err := conn.SendBuffData([]byte("third")); !errors.Is(err, ErrConnClosed) {
+				t.Fatalf("%s: expected ErrConnClosed after stop, got %v", tc.name, err)
+			}
+		}
+	}
+}
+
+func TestConnectionStopStalledPeer(t *testing.T) {
+	slog.NewZapLog(&sconfig.Slog{Director: t.TempDir(), Level: "error"})
+
+	// the client never reads, so the writes to the pipe block (客户端从不读取，写入管道会阻塞)
+	server, client := net.Pipe()
+	defer client.Close()
+	connMgr := NewConnManager()
+	conn := NewConnection(server, 1, 0, nil, nil, nil, nil, NewTcpDataPack(), connMgr, 64, 0,
+		WithDrainTimeout(50*time.Millisecond))
+	connMgr.Add(conn)
+	started := make(chan struct{})
+	go func() {
+		defer close(started)
+		conn.Start()
+	}()
+	for i := 0; i < 4; i++ {
+		if err := conn.SendBuffData([]byte("stalled")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conn.Stop()
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("the connection with a stalled peer is not stopped")
+	}
+	if connMgr.Len() != 0 {
+		t.Fatal("the stopped connection is not removed from the ConnManager")
+	}
+}
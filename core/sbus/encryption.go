@@ -0,0 +1,356 @@
+package sbus
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/wwengg/threego/core/slog"
+	"github.com/wwengg/threego/core/smsg"
+	"github.com/wwengg/threego/core/utils"
+)
+
+const (
+	// EncryptionDefaultMsgID is the Cmd of the handshake, the Data of the request is the X25519 public key of
+	// the client and the Data of the response is the one of the server
+	// (握手消息的Cmd，请求的Data为客户端的X25519公钥，响应的Data为服务端的公钥)
+	EncryptionDefaultMsgID uint16 = 4
+	// RetEncryptionRequired is the Ret of the response replied to the message sent before the handshake
+	// (握手之前发送的消息的响应Ret)
+	RetEncryptionRequired uint16 = 426
+
+	// The HKDF info of the AES-256-GCM keys of both directions (两个方向的AES-256-GCM密钥的HKDF info)
+	encryptionClientKeyInfo = "sbus aes-256-gcm client to server key"
+	encryptionServerKeyInfo = "sbus aes-256-gcm server to client key"
+	encryptionKeyLen        = 32
+
+	// The nonce prefixes of the frames on the stream and the QUIC datagrams, each has its own counter
+	// (流上的帧以及QUIC datagram的nonce前缀，各自有独立的计数器)
+	cipherStreamNonce   uint32 = 0
+	cipherDatagramNonce uint32 = 1
+)
+
+var (
+	ErrEncryptionRequired  = errors.New("encryption handshake required")
+	ErrAlreadyEncrypted    = errors.New("connection is already encrypted")
+	ErrEncryptedCompressed = errors.New("the data of an encrypted msg must not be compressed by the inner datapack")
+	ErrDatagramHandshake   = errors.New("the encryption handshake must not be sent as a datagram")
+	ErrEncryptedPlainMeta  = errors.New("the meta of an encrypted msg must be inside the ciphertext")
+	ErrReplayedFrame       = errors.New("the nonce counter of the encrypted frame does not increase")
+)
+
+type connEncryption struct {
+	msgID    uint16
+	required bool
+	done     atomic.Bool
+}
+
+// WithEncryption enables the end-to-end encryption negotiated by the handshake of handshakeMsgID on the
+// connection, when required is true the messages before the handshake are rejected with RetEncryptionRequired,
+// nothing should be pushed to the connection before its handshake finishes, or the client may not decrypt it,
+// Broadcast, BroadcastToGroup and Multicast skip such connections. SendMsg queues the msgs like SendBuffMsg on
+// such a connection, so the frames reach the client in the order of their nonce counters.
+// The X25519 exchange is not authenticated, it protects against passive sniffing only, an active
+// man-in-the-middle can negotiate a key with each side, use TLS (WithTLS) when the server must be authenticated
+// (开启通过handshakeMsgID握手协商的端到端加密，required为true时握手之前的消息以RetEncryptionRequired拒绝，
+// 握手完成之前不应向连接推送消息，否则客户端可能无法解密，Broadcast、BroadcastToGroup以及Multicast会跳过这些连接。
+// 该连接上的SendMsg与SendBuffMsg一样进入发送队列，使帧按nonce计数器的顺序到达客户端。
+// X25519密钥交换没有认证，只能防止被动窃听，主动的中间人可以分别与双方协商密钥，需要认证服务端时请使用TLS(WithTLS))
+func WithEncryption(handshakeMsgID uint16, required bool) ConnOption {
+	return func(c *Connection) {
+		c.encryption = &connEncryption{msgID: handshakeMsgID, required: required}
+	}
+}
+
+// IsEncrypted returns whether the handshake of the connection has finished (返回连接是否已完成加密握手)
+func (bc *Connection) IsEncrypted() bool {
+	return bc.encryption != nil && bc.encryption.done.Load()
+}
+
+// handshakeAwaiter is implemented by the connections that may wait for the encryption handshake, such as *Connection
+// (可能等待加密握手的连接实现该接口，例如*Connection)
+type handshakeAwaiter interface {
+	awaitingHandshake() bool
+}
+
+// awaitingHandshake reports whether the encryption is enabled and its handshake has not finished
+// (返回是否开启了加密且握手尚未完成)
+func (bc *Connection) awaitingHandshake() bool {
+	return bc.encryption != nil && !bc.encryption.done.Load()
+}
+
+// checkEncryption handles the handshake in the reader, so the next frame is unpacked by the new datapack,
+// it returns false if the msg should not be dispatched
+// (在读协程中处理握手，使下一帧由新的datapack拆包，消息不需要分发时返回false)
+func (bc *Connection) checkEncryption(msg SMsg) bool {
+	enc := bc.encryption
+	if enc == nil {
+		return true
+	}
+	if msg.GetCmd() == enc.msgID {
+		if err := bc.handshake(msg); err != nil {
+			slog.Ins().Warnf("connID = %d encryption handshake error: %s", bc.ConnID, err)
+			if err := bc.SendBuffMsg(NewErrorResponseMsg(msg, RetBadRequest, err.Error())); err != nil {
+				slog.Ins().Errorf("reply handshake error to connID = %d error: %s", bc.ConnID, err)
+			}
+		}
+		return false
+	}
+	if enc.required && !enc.done.Load() {
+		slog.Ins().Debugf("connID = %d msgID = %d is sent before the encryption handshake", bc.ConnID, msg.GetMsgId())
+		if err := bc.SendBuffMsg(NewErrorResponseMsg(msg, RetEncryptionRequired, ErrEncryptionRequired.Error())); err != nil {
+			slog.Ins().Errorf("reply encryption required to connID = %d error: %s", bc.ConnID, err)
+		}
+		return false
+	}
+	return true
+}
+
+// handshake queues the public key of the server in plaintext and switches to the CipherDataPack, both under
+// the lock of the datapack, so the frames packed by the CipherDataPack are queued after the response
+// (以明文将服务端公钥放入发送队列并切换到CipherDataPack，两者都在datapack的锁内完成，
+// 使CipherDataPack封包的帧排在响应之后)
+func (bc *Connection) handshake(req SMsg) error {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	serverPub := key.PublicKey().Bytes()
+	clientKey, serverKey, err := deriveSessionKeys(key, req.GetData(), req.GetData(), serverPub)
+	if err != nil {
+		return err
+	}
+
+	resp := NewResponseMsg(req, RetOK, serverPub)
+	resp.SetHasFrameDecoder(bc.HasFrameDecoder())
+	bc.datapackLock.Lock()
+	defer bc.datapackLock.Unlock()
+	if bc.encryption.done.Load() {
+		return ErrAlreadyEncrypted
+	}
+	dp, err := NewCipherDataPack(bc.Datapack, serverKey, clientKey)
+	if err != nil {
+		return err
+	}
+	data, err := bc.Datapack.Pack(resp)
+	if err != nil {
+		return err
+	}
+	if err := bc.SendBuffData(data); err != nil {
+		return err
+	}
+	bc.Datapack = dp
+	bc.encryption.done.Store(true)
+	return nil
+}
+
+// deriveSessionKeys derives the AES-256 keys of both directions from the X25519 shared secret by HKDF-SHA256,
+// both public keys are the salt so the keys are bound to the handshake
+// (通过HKDF-SHA256从X25519共享密钥派生两个方向的AES-256密钥，双方公钥作为salt，使密钥与本次握手绑定)
+func deriveSessionKeys(key *ecdh.PrivateKey, peerPub, clientPub, serverPub []byte) (clientKey, serverKey []byte, err error) {
+	peer, err := ecdh.X25519().NewPublicKey(peerPub)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	secret, err := key.ECDH(peer)
+	if err != nil {
+		return nil, nil, err
+	}
+	salt := append(append(make([]byte, 0, len(clientPub)+len(serverPub)), clientPub...), serverPub...)
+	if clientKey, err = hkdf.Key(sha256.New, secret, salt, encryptionClientKeyInfo, encryptionKeyLen); err != nil {
+		return nil, nil, err
+	}
+	if serverKey, err = hkdf.Key(sha256.New, secret, salt, encryptionServerKeyInfo, encryptionKeyLen); err != nil {
+		return nil, nil, err
+	}
+	return clientKey, serverKey, nil
+}
+
+// ClientHandshake is the client side of the encryption handshake, the server key it receives is not
+// authenticated (加密握手的客户端，其收到的服务端公钥未经认证)
+type ClientHandshake struct {
+	key *ecdh.PrivateKey
+}
+
+func NewClientHandshake() (*ClientHandshake, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &ClientHandshake{key: key}, nil
+}
+
+// Request returns the handshake request of msgID (返回msgID的握手请求)
+func (h *ClientHandshake) Request(msgID uint16) SMsg {
+	msg := NewNSQMsg(msgID, RetOK, smsg.SerializeNone, nil, h.key.PublicKey().Bytes())
+	msg.CompressType = smsg.None
+	msg.MessageType = smsg.Request
+	return msg
+}
+
+// DataPack returns the CipherDataPack wrapping inner with the keys negotiated by the handshake response
+// (返回以握手响应协商的密钥包装inner的CipherDataPack)
+func (h *ClientHandshake) DataPack(inner SDataPack, resp SMsg) (*CipherDataPack, error) {
+	if resp.GetRet() != RetOK {
+		return nil, fmt.Errorf("encryption handshake failed, ret = %d", resp.GetRet())
+	}
+	clientPub := h.key.PublicKey().Bytes()
+	clientKey, serverKey, err := deriveSessionKeys(h.key, resp.GetData(), clientPub, resp.GetData())
+	if err != nil {
+		return nil, err
+	}
+	return NewCipherDataPack(inner, clientKey, serverKey)
+}
+
+// CipherDataPack encrypts the messages packed by the inner datapack with AES-GCM, the compressed data and the
+// meta are encrypted, the rest of the header is authenticated. Every frame carries the counter of its nonce, a
+// frame whose counter does not increase is rejected as a replay, so the frames must be unpacked in the order
+// they are packed, the datagrams have a counter of their own, see DatagramPack
+// (使用AES-GCM加密内部datapack封包的消息，压缩后的数据以及meta被加密，header的其余部分参与认证。
+// 每一帧都带有其nonce的计数器，计数器没有递增的帧被当作重放拒绝，因此帧必须按封包的顺序拆包，datagram有独立的计数器，见DatagramPack)
+type CipherDataPack struct {
+	SDataPack
+	seal, open cipher.AEAD
+	nonce      uint32
+	sent       atomic.Uint64
+	received   atomic.Uint64
+	datagram   *CipherDataPack
+	// Data shorter than CompressThreshold is not compressed, copied from the inner TcpDataPack or NsqDataPack
+	// (长度小于CompressThreshold的数据不压缩，从内部的TcpDataPack或NsqDataPack复制)
+	CompressThreshold uint32
+}
+
+// NewCipherDataPack creates a CipherDataPack packing with sealKey and unpacking with openKey, each direction
+// has a key of its own (创建以sealKey封包、以openKey拆包的CipherDataPack，每个方向有独立的密钥)
+func NewCipherDataPack(inner SDataPack, sealKey, openKey []byte) (*CipherDataPack, error) {
+	seal, err := utils.NewAESGCM(sealKey)
+	if err != nil {
+		return nil, err
+	}
+	open, err := utils.NewAESGCM(openKey)
+	if err != nil {
+		return nil, err
+	}
+	dp := &CipherDataPack{SDataPack: inner, seal: seal, open: open, nonce: cipherStreamNonce}
+	switch p := inner.(type) {
+	case *TcpDataPack:
+		dp.CompressThreshold = p.CompressThreshold
+	case *NsqDataPack:
+		dp.CompressThreshold = p.CompressThreshold
+	}
+	dp.datagram = &CipherDataPack{SDataPack: inner, seal: seal, open: open, nonce: cipherDatagramNonce,
+		CompressThreshold: dp.CompressThreshold}
+	dp.datagram.datagram = dp.datagram
+	return dp, nil
+}
+
+// DatagramPack returns the CipherDataPack of the QUIC datagrams, which share the keys and have counters of
+// their own, a datagram arriving after a later one is dropped
+// (返回QUIC datagram的CipherDataPack，与当前datapack共用密钥但有独立的计数器，晚于后发datagram到达的datagram会被丢弃)
+func (dp *CipherDataPack) DatagramPack() SDataPack {
+	return dp.datagram
+}
+
+func (dp *CipherDataPack) Pack(msg SMsg) ([]byte, error) {
+	compressType, data, err := compressData(msg.GetCompressType(), msg.GetData(), dp.CompressThreshold)
+	if err != nil {
+		return nil, err
+	}
+	var bb = bytes.NewBuffer(make([]byte, 0, 1+4+len(msg.GetMeta())*64+len(data)))
+	bb.WriteByte(byte(compressType))
+	bb.Write(make([]byte, 4))
+	EncodeMetadata(msg.GetMeta(), bb)
+	plaintext := bb.Bytes()
+	binary.BigEndian.PutUint32(plaintext[1:], uint32(len(plaintext)-5))
+	plaintext = append(plaintext, data...)
+	// pack a copy, the msg may be packed by the other connections too (封包副本，该消息可能也会被其他连接封包)
+	encrypted := &NSQMsg{
+		Cmd:             msg.GetCmd(),
+		Ret:             msg.GetRet(),
+		Version:         msg.GetVersion(),
+		SerializeType:   msg.GetSerializeType(),
+		CompressType:    smsg.None,
+		MessageType:     msg.GetMessageType(),
+		Seq:             msg.GetSeq(),
+		hasFrameDecoder: msg.GetHasFrameDecoder(),
+	}
+	encrypted.Data = utils.AESGCMSealCounter(dp.seal, dp.nonce, dp.sent.Add(1), plaintext, cipherAdditionalData(encrypted))
+	return dp.SDataPack.Pack(encrypted)
+}
+
+func (dp *CipherDataPack) Unpack(binaryData []byte) (SMsg, error) {
+	m, err := dp.SDataPack.Unpack(binaryData)
+	if err != nil {
+		return nil, err
+	}
+	msg, ok := m.(*NSQMsg)
+	if !ok {
+		return nil, fmt.Errorf("cipher datapack: unsupported msg type %T", m)
+	}
+	if msg.CompressType != smsg.None {
+		return nil, ErrEncryptedCompressed
+	}
+	if len(msg.Metadata) > 0 {
+		return nil, ErrEncryptedPlainMeta
+	}
+	counter, plaintext, err := utils.AESGCMOpenCounter(dp.open, dp.nonce, msg.Data, cipherAdditionalData(msg))
+	if err != nil {
+		return nil, fmt.Errorf("cipher datapack: decrypt cmd %d: %w", msg.Cmd, err)
+	}
+	// the counter is checked after the authentication, so a forged frame can not move it
+	// (认证之后再检查计数器，使伪造的帧无法推进计数器)
+	for {
+		last := dp.received.Load()
+		if counter <= last {
+			return nil, fmt.Errorf("%w: %d <= %d", ErrReplayedFrame, counter, last)
+		}
+		if dp.received.CompareAndSwap(last, counter) {
+			break
+		}
+	}
+	if len(plaintext) < 5 {
+		return nil, utils.ErrCiphertextTooShort
+	}
+	msg.CompressType = smsg.CompressType(plaintext[0])
+	metaLen := binary.BigEndian.Uint32(plaintext[1:])
+	if uint64(metaLen) > uint64(len(plaintext)-5) {
+		return nil, fmt.Errorf("%w: declared %d, remaining %d", ErrMetaLenExceeded, metaLen, len(plaintext)-5)
+	}
+	if metaLen > 0 {
+		if msg.Metadata, err = DecodeMetadata(metaLen, plaintext[5:5+metaLen]); err != nil {
+			return nil, err
+		}
+	}
+	if msg.Data, err = decompressData(msg.CompressType, plaintext[5+metaLen:]); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// cipherAdditionalData returns the header authenticated with the ciphertext, the layout of NsqDataPack from
+// the Cmd to the Seq (返回与密文一起认证的header，即NsqDataPack从Cmd到Seq的布局)
+func cipherAdditionalData(msg SMsg) []byte {
+	ad := make([]byte, 14)
+	binary.BigEndian.PutUint16(ad, msg.GetCmd())
+	binary.BigEndian.PutUint16(ad[2:], msg.GetRet())
+	ad[4] = msg.GetVersion()
+	ad[5] = byte(msg.GetSerializeType())<<4 | (byte(msg.GetCompressType())<<2)&0x0C | byte(msg.GetMessageType())&0x03
+	binary.BigEndian.PutUint64(ad[6:], msg.GetSeq())
+	return ad
+}
+
+// datagramPack returns the datapack of the QUIC datagrams of a connection using dp
+// (返回使用dp的连接的QUIC datagram的datapack)
+func datagramPack(dp SDataPack) SDataPack {
+	if p, ok := dp.(interface{ DatagramPack() SDataPack }); ok {
+		return p.DatagramPack()
+	}
+	return dp
+}
@@ -0,0 +1,246 @@
+package sbus
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/wwengg/threego/core/sconfig"
+	"github.com/wwengg/threego/core/slog"
+	"github.com/wwengg/threego/core/smsg"
+)
+
+type replyRouter struct {
+	BaseRouter
+}
+
+func (r *replyRouter) Handle(task STask) error {
+	return task.GetConnection().SendBuffMsg(NewResponseMsg(task.GetMessage(), RetOK, task.GetData()))
+}
+
+type pipeClient struct {
+	t       *testing.T
+	conn    net.Conn
+	decoder SFrameDecoder
+	frames  [][]byte
+	dp      SDataPack
+}
+
+func (c *pipeClient) send(msg SMsg) {
+	c.t.Helper()
+	msg.SetHasFrameDecoder(true)
+	data, err := c.dp.Pack(msg)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if _, err := c.conn.Write(data); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *pipeClient) recvFrame() []byte {
+	c.t.Helper()
+	buf := make([]byte, 4096)
+	for len(c.frames) == 0 {
+		_ = c.conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		frames, err := c.decoder.Decode(buf[:n])
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		c.frames = append(c.frames, frames...)
+	}
+	frame := c.frames[0]
+	c.frames = c.frames[1:]
+	return frame
+}
+
+func (c *pipeClient) recv() SMsg {
+	c.t.Helper()
+	msg, err := c.dp.Unpack(c.recvFrame())
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return msg
+}
+
+func TestConnectionEncryption(t *testing.T) {
+	slog.NewZapLog(&sconfig.Slog{Director: t.TempDir(), Level: "error"})
+
+	mh := NewTaskHandler(1, 16)
+	mh.AddRouter(10, &replyRouter{})
+	mh.StartWorkerPool()
+	defer mh.Stop()
+
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := NewConnection(server, 1, 0, mh, nil, nil, NewLengthFieldFrameDecoder(TcpLengthField()), NewTcpDataPack(), nil, 64, 0,
+		WithEncryption(EncryptionDefaultMsgID, true))
+	started := make(chan struct{})
+	go func() {
+		defer close(started)
+		conn.Start()
+	}()
+	defer func() {
+		conn.Stop()
+		<-started
+	}()
+
+	c := &pipeClient{t: t, conn: client, decoder: NewLengthFieldFrameDecoder(TcpLengthField()), dp: NewTcpDataPack()}
+	// the messages before the handshake are rejected (握手之前的消息被拒绝)
+	c.send(NewNSQMsg(10, 0, smsg.SerializeNone, nil, []byte("plain")))
+	if resp := c.recv(); resp.GetRet() != RetEncryptionRequired {
+		t.Fatalf("unexpected ret %d, want RetEncryptionRequired", resp.GetRet())
+	}
+
+	hs, err := NewClientHandshake()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.send(hs.Request(EncryptionDefaultMsgID))
+	cipherDP, err := hs.DataPack(c.dp, c.recv())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.dp = cipherDP
+	if !conn.IsEncrypted() {
+		t.Fatal("the connection is not encrypted after the handshake")
+	}
+
+	body := bytes.Repeat([]byte("secret payload "), 64)
+	c.send(NewNSQMsg(10, 0, smsg.SerializeNone, nil, body))
+	frame := c.recvFrame()
+	if bytes.Contains(frame, []byte("secret payload")) {
+		t.Fatal("the payload is sent in plaintext")
+	}
+	resp, err := cipherDP.Unpack(frame)
+	if err != nil || !bytes.Equal(resp.GetData(), body) || resp.GetCompressType() != smsg.Gzip {
+		t.Fatalf("unexpected echo %d bytes, compress type %v, %v", len(resp.GetData()), resp.GetCompressType(), err)
+	}
+
+	// a tampered frame fails the authentication (被篡改的帧无法通过认证)
+	frame[len(frame)-1] ^= 0xFF
+	if _, err := cipherDP.Unpack(frame); err == nil {
+		t.Fatal("expected the tampered frame to fail")
+	}
+}
+
+func TestConnectionEncryptionHandshakeOrder(t *testing.T) {
+	slog.NewZapLog(&sconfig.Slog{Director: t.TempDir(), Level: "error"})
+
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := NewConnection(server, 1, 0, nil, nil, nil, NewLengthFieldFrameDecoder(TcpLengthField()), NewTcpDataPack(), nil, 64, 0,
+		WithEncryption(EncryptionDefaultMsgID, false))
+	started := make(chan struct{})
+	go func() {
+		defer close(started)
+		conn.Start()
+	}()
+	defer func() {
+		conn.Stop()
+		<-started
+	}()
+
+	// the pushes racing with the handshake are either plaintext before its response or encrypted after it
+	// (与握手竞争的推送要么是响应之前的明文，要么是响应之后的密文)
+	const pushes = 200
+	go func() {
+		for i := 0; i < pushes; i++ {
+			if err := conn.SendBuffMsg(NewNSQMsg(11, 0, smsg.SerializeNone, nil, []byte("push"))); err != nil {
+				return
+			}
+		}
+	}()
+	c := &pipeClient{t: t, conn: client, decoder: NewLengthFieldFrameDecoder(TcpLengthField()), dp: NewTcpDataPack()}
+	hs, err := NewClientHandshake()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.send(hs.Request(EncryptionDefaultMsgID))
+	for received := 0; received < pushes; {
+		msg := c.recv()
+		if msg.GetCmd() == EncryptionDefaultMsgID {
+			if c.dp, err = hs.DataPack(c.dp, msg); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if msg.GetCmd() != 11 || string(msg.GetData()) != "push" {
+			t.Fatalf("unexpected push cmd %d data %q", msg.GetCmd(), msg.GetData())
+		}
+		received++
+	}
+	if _, ok := c.dp.(*CipherDataPack); !ok {
+		t.Fatal("no handshake response is received")
+	}
+}
+
+func TestCipherDataPack(t *testing.T) {
+	clientKey, serverKey := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+	client, err := NewCipherDataPack(NewTcpDataPack(), clientKey, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewCipherDataPack(NewTcpDataPack(), serverKey, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pack := func(dp SDataPack, meta map[string]string) []byte {
+		t.Helper()
+		msg := NewNSQMsg(10, 0, smsg.SerializeNone, meta, []byte("buy"))
+		msg.MessageType = smsg.Request
+		data, err := dp.Pack(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	// the meta is encrypted and restored (meta被加密并还原)
+	first := pack(client, map[string]string{"token": "secret-token"})
+	if bytes.Contains(first, []byte("secret-token")) {
+		t.Fatal("the meta is sent in plaintext")
+	}
+	msg, err := server.Unpack(first)
+	if err != nil || msg.GetMeta()["token"] != "secret-token" || string(msg.GetData()) != "buy" || msg.GetMessageType() != smsg.Request {
+		t.Fatalf("unexpected msg %+v, %v", msg, err)
+	}
+
+	// a replayed frame and a frame older than the last one are rejected (重放的帧以及早于上一帧的帧被拒绝)
+	second, third := pack(client, nil), pack(client, nil)
+	if _, err := server.Unpack(first); !errors.Is(err, ErrReplayedFrame) {
+		t.Fatalf("unexpected replay error %v", err)
+	}
+	if _, err := server.Unpack(third); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Unpack(second); !errors.Is(err, ErrReplayedFrame) {
+		t.Fatalf("unexpected reordered error %v", err)
+	}
+
+	// the header is authenticated, flipping the MessageType fails (header参与认证，修改MessageType会失败)
+	tampered := pack(client, nil)
+	tampered[5] ^= 0x03
+	if _, err := server.Unpack(tampered); err == nil {
+		t.Fatal("expected the tampered header to fail")
+	}
+
+	// the key of a direction does not open the frames of the other one (一个方向的密钥无法解开另一个方向的帧)
+	if _, err := client.Unpack(pack(client, nil)); err == nil {
+		t.Fatal("expected the frame of the other direction to fail")
+	}
+
+	// the datagrams have counters of their own (datagram有独立的计数器)
+	if _, err := server.DatagramPack().Unpack(pack(client.DatagramPack(), nil)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Unpack(pack(client.DatagramPack(), nil)); err == nil {
+		t.Fatal("expected the datagram to fail on the stream")
+	}
+}
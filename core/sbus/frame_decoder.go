@@ -0,0 +1,211 @@
+package sbus
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	ErrFrameTooLong       = errors.New("frame length exceeds MaxFrameLength")
+	ErrFrameLengthInvalid = errors.New("invalid frame length")
+)
+
+// LengthField describes where the length field is and how to calculate the frame length,
+// the semantics are the same as netty's LengthFieldBasedFrameDecoder
+// (描述长度字段的位置以及帧长度的计算方式，语义与netty的LengthFieldBasedFrameDecoder一致)
+//
+//	frameLength = LengthFieldOffset + LengthFieldLength + lengthFieldValue + LengthAdjustment
+//
+// e.g. A 4 bytes length field that contains the length of the body, and strip the length field
+// (例：4字节长度字段表示body长度，解码后去掉长度字段)
+//
+//	BEFORE DECODE (16 bytes)        AFTER DECODE (12 bytes)
+//	+--------+----------------+      +----------------+
+//	| Length | Actual Content |----->| Actual Content |
+//	| 0x000C | "HELLO, WORLD" |      | "HELLO, WORLD" |
+//	+--------+----------------+      +----------------+
+//
+//	LengthField{LengthFieldOffset: 0, LengthFieldLength: 4, LengthAdjustment: 0, InitialBytesToStrip: 4}
+type LengthField struct {
+	// The byte order of the length field, default binary.BigEndian
+	// (长度字段的字节序，默认大端)
+	Order binary.ByteOrder
+	// The maximum length of the frame, an error is returned if the frame is longer than this,
+	// 0 means TcpMaxFrameLength, so a peer can not make the decoder buffer a huge half frame
+	// (帧的最大长度，超过后返回错误，0表示TcpMaxFrameLength，使对端无法让解码器缓存超大的半包)
+	MaxFrameLength uint64
+	// The offset of the length field (长度字段的偏移量)
+	LengthFieldOffset int
+	// The length of the length field, 1, 2, 3, 4 or 8 (长度字段的字节数)
+	LengthFieldLength int
+	// The compensation value to add to the value of the length field (长度字段值的补偿值)
+	LengthAdjustment int
+	// The number of first bytes to strip out from the decoded frame (解码后的帧需要跳过的字节数)
+	InitialBytesToStrip int
+}
+
+type LengthFieldFrameDecoder struct {
+	LengthField
+	lengthFieldEndOffset int
+
+	// in caches the bytes of the half frames (缓存半包数据)
+	in []byte
+	// the remaining bytes of a too long frame that should be discarded (超长帧剩余需要丢弃的字节数)
+	bytesToDiscard int64
+
+	lock sync.Mutex
+}
+
+// NewLengthFieldFrameDecoder creates a frame decoder, it panics if the LengthField is invalid.
+// A decoder caches half frames, so it must not be shared between connections
+// (创建一个断粘包解码器，LengthField不合法时panic。解码器会缓存半包，不能在连接之间共享)
+func NewLengthFieldFrameDecoder(lf LengthField) SFrameDecoder {
+	if lf.Order == nil {
+		lf.Order = binary.BigEndian
+	}
+	if lf.MaxFrameLength == 0 {
+		lf.MaxFrameLength = TcpMaxFrameLength
+	}
+	switch lf.LengthFieldLength {
+	case 1, 2, 3, 4, 8:
+	default:
+		panic(fmt.Sprintf("unsupported LengthFieldLength: %d (expected: 1, 2, 3, 4, or 8)", lf.LengthFieldLength))
+	}
+	if lf.LengthFieldOffset < 0 {
+		panic(fmt.Sprintf("LengthFieldOffset must be a non-negative integer: %d", lf.LengthFieldOffset))
+	}
+	if lf.InitialBytesToStrip < 0 {
+		panic(fmt.Sprintf("InitialBytesToStrip must be a non-negative integer: %d", lf.InitialBytesToStrip))
+	}
+	if uint64(lf.LengthFieldOffset) > lf.MaxFrameLength-uint64(lf.LengthFieldLength) {
+		panic(fmt.Sprintf("MaxFrameLength (%d) must be equal to or greater than LengthFieldOffset (%d) + LengthFieldLength (%d)",
+			lf.MaxFrameLength, lf.LengthFieldOffset, lf.LengthFieldLength))
+	}
+	return &LengthFieldFrameDecoder{
+		LengthField:          lf,
+		lengthFieldEndOffset: lf.LengthFieldOffset + lf.LengthFieldLength,
+	}
+}
+
+// Decode appends buff to the cached bytes and returns all the complete frames.
+// Bad frames are skipped and the first error is returned together with the good frames
+// (将buff追加到缓存中并返回所有完整的帧，错误的帧会被跳过，返回第一个错误以及正确解码的帧)
+func (d *LengthFieldFrameDecoder) Decode(buff []byte) ([][]byte, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.bytesToDiscard > 0 {
+		buff = d.discard(buff)
+	}
+	d.in = append(d.in, buff...)
+
+	var (
+		frames   [][]byte
+		firstErr error
+	)
+	offset := 0
+	for {
+		frame, n, err := d.decode(d.in[offset:])
+		offset += n
+		if err != nil {
+			// The bad bytes are consumed, keep decoding the rest
+			// (错误的数据已被消耗，继续解码剩余数据)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if frame == nil {
+			break
+		}
+		frames = append(frames, frame)
+	}
+	d.compact(offset)
+	return frames, firstErr
+}
+
+// decode decodes one frame from in, returns the frame and the number of consumed bytes.
+// A nil frame means the bytes are not enough for a frame
+// (从in中解码一帧，返回帧以及消耗的字节数，帧为nil表示数据不足一帧)
+func (d *LengthFieldFrameDecoder) decode(in []byte) ([]byte, int, error) {
+	if len(in) < d.lengthFieldEndOffset {
+		return nil, 0, nil
+	}
+
+	frameLength := int64(d.getUnadjustedFrameLength(in[d.LengthFieldOffset:d.lengthFieldEndOffset]))
+	if frameLength < 0 {
+		return nil, len(in), fmt.Errorf("%w: negative pre-adjustment length field: %d", ErrFrameLengthInvalid, frameLength)
+	}
+	frameLength += int64(d.LengthAdjustment) + int64(d.lengthFieldEndOffset)
+	if frameLength < int64(d.lengthFieldEndOffset) {
+		return nil, len(in), fmt.Errorf("%w: adjusted frame length (%d) is less than lengthFieldEndOffset: %d",
+			ErrFrameLengthInvalid, frameLength, d.lengthFieldEndOffset)
+	}
+
+	if uint64(frameLength) > d.MaxFrameLength {
+		// Discard the whole too long frame to keep the stream in sync
+		// (丢弃整个超长帧，保证后续数据流仍然对齐)
+		if frameLength > int64(len(in)) {
+			d.bytesToDiscard = frameLength - int64(len(in))
+			return nil, len(in), fmt.Errorf("%w: %d > %d", ErrFrameTooLong, frameLength, d.MaxFrameLength)
+		}
+		return nil, int(frameLength), fmt.Errorf("%w: %d > %d", ErrFrameTooLong, frameLength, d.MaxFrameLength)
+	}
+
+	if int64(len(in)) < frameLength {
+		return nil, 0, nil
+	}
+
+	if int64(d.InitialBytesToStrip) > frameLength {
+		return nil, int(frameLength), fmt.Errorf("%w: adjusted frame length (%d) is less than InitialBytesToStrip: %d",
+			ErrFrameLengthInvalid, frameLength, d.InitialBytesToStrip)
+	}
+
+	// Copy the frame, because in will be reused
+	// (拷贝一份帧数据，in会被复用)
+	frame := make([]byte, int(frameLength)-d.InitialBytesToStrip)
+	copy(frame, in[d.InitialBytesToStrip:frameLength])
+	return frame, int(frameLength), nil
+}
+
+func (d *LengthFieldFrameDecoder) getUnadjustedFrameLength(buf []byte) uint64 {
+	switch d.LengthFieldLength {
+	case 1:
+		return uint64(buf[0])
+	case 2:
+		return uint64(d.Order.Uint16(buf))
+	case 3:
+		if d.Order == binary.LittleEndian {
+			return uint64(buf[0]) | uint64(buf[1])<<8 | uint64(buf[2])<<16
+		}
+		return uint64(buf[2]) | uint64(buf[1])<<8 | uint64(buf[0])<<16
+	case 4:
+		return uint64(d.Order.Uint32(buf))
+	default:
+		return d.Order.Uint64(buf)
+	}
+}
+
+// discard drops the remaining bytes of a too long frame, returns the bytes left
+// (丢弃超长帧剩余的字节，返回剩下的数据)
+func (d *LengthFieldFrameDecoder) discard(buff []byte) []byte {
+	if int64(len(buff)) <= d.bytesToDiscard {
+		d.bytesToDiscard -= int64(len(buff))
+		return nil
+	}
+	buff = buff[d.bytesToDiscard:]
+	d.bytesToDiscard = 0
+	return buff
+}
+
+// compact moves the half frame to the beginning of the cache
+// (将半包数据移动到缓存开头)
+func (d *LengthFieldFrameDecoder) compact(offset int) {
+	if offset == 0 {
+		return
+	}
+	n := copy(d.in, d.in[offset:])
+	d.in = d.in[:n]
+}
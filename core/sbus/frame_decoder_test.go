@@ -0,0 +1,98 @@
+package sbus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func lengthPrefixed(body []byte) []byte {
+	buf := make([]byte, 4+len(body))
+	binary.BigEndian.PutUint32(buf, uint32(len(body)))
+	copy(buf[4:], body)
+	return buf
+}
+
+func TestLengthFieldFrameDecoderStickyAndSplit(t *testing.T) {
+	decoder := NewLengthFieldFrameDecoder(LengthField{
+		LengthFieldLength:   4,
+		InitialBytesToStrip: 4,
+	})
+
+	stream := append(lengthPrefixed([]byte("hello")), lengthPrefixed([]byte("world!"))...)
+	stream = append(stream, lengthPrefixed([]byte("threego"))...)
+
+	// split the stream at every possible position (在每个位置拆分数据流)
+	for i := 0; i <= len(stream); i++ {
+		var frames [][]byte
+		for _, part := range [][]byte{stream[:i], stream[i:]} {
+			got, err := decoder.Decode(part)
+			if err != nil {
+				t.Fatalf("split at %d: unexpected error %v", i, err)
+			}
+			frames = append(frames, got...)
+		}
+		if len(frames) != 3 {
+			t.Fatalf("split at %d: expected 3 frames, got %d", i, len(frames))
+		}
+		for j, want := range []string{"hello", "world!", "threego"} {
+			if string(frames[j]) != want {
+				t.Fatalf("split at %d: frame %d = %q, want %q", i, j, frames[j], want)
+			}
+		}
+	}
+}
+
+func TestLengthFieldFrameDecoderHeaderAndAdjustment(t *testing.T) {
+	// | magic 2 bytes | length 2 bytes(little endian, total frame length) | body |
+	decoder := NewLengthFieldFrameDecoder(LengthField{
+		Order:             binary.LittleEndian,
+		LengthFieldOffset: 2,
+		LengthFieldLength: 2,
+		LengthAdjustment:  -4,
+	})
+	frame := []byte{0xCA, 0xFE, 7, 0, 'a', 'b', 'c'}
+	frames, err := decoder.Decode(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 1 || !bytes.Equal(frames[0], frame) {
+		t.Fatalf("unexpected frames %v", frames)
+	}
+}
+
+func TestLengthFieldFrameDecoderTooLong(t *testing.T) {
+	decoder := NewLengthFieldFrameDecoder(LengthField{
+		MaxFrameLength:      16,
+		LengthFieldLength:   4,
+		InitialBytesToStrip: 4,
+	})
+
+	tooLong := lengthPrefixed(bytes.Repeat([]byte{'x'}, 32))
+	frames, err := decoder.Decode(tooLong[:10])
+	if !errors.Is(err, ErrFrameTooLong) {
+		t.Fatalf("expected ErrFrameTooLong, got %v", err)
+	}
+	if len(frames) != 0 {
+		t.Fatalf("expected no frames, got %d", len(frames))
+	}
+
+	// the rest of the too long frame is discarded and the stream stays in sync
+	// (超长帧剩余部分被丢弃，后续数据流仍然对齐)
+	frames, err = decoder.Decode(append(tooLong[10:], lengthPrefixed([]byte("ok"))...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 1 || string(frames[0]) != "ok" {
+		t.Fatalf("unexpected frames %q", frames)
+	}
+}
+
+func TestLengthFieldFrameDecoderDefaultMax(t *testing.T) {
+	decoder := NewLengthFieldFrameDecoder(LengthField{LengthFieldLength: 4, InitialBytesToStrip: 4})
+	// a length of about 4GB is rejected before any of the frame is buffered (约4GB的长度在缓存帧之前就被拒绝)
+	if _, err := decoder.Decode([]byte{0xFF, 0xFF, 0xFF, 0xF0, 'x'}); !errors.Is(err, ErrFrameTooLong) {
+		t.Fatalf("expected ErrFrameTooLong, got %v", err)
+	}
+}
@@ -0,0 +1,160 @@
+package sbus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/wwengg/threego/core/smsg"
+)
+
+// The Ret of the response msg (响应消息的Ret)
+const (
+	RetOK            uint16 = 0
+	RetBadRequest    uint16 = 400 // The request can not be decoded (请求无法解码)
+	RetInternalError uint16 = 500 // The handler returned an error that is not a *RetError (处理函数返回了非*RetError的错误)
+)
+
+// MetaKeyError is the meta key of the error message in the response msg
+// (响应消息中错误信息的meta key)
+const MetaKeyError = "err"
+
+// RetError is returned by the function handlers to reply a specific Ret
+// (函数式处理函数返回RetError以回复指定的Ret)
+type RetError struct {
+	Ret uint16
+	Msg string
+}
+
+func NewRetError(ret uint16, msg string) *RetError {
+	return &RetError{Ret: ret, Msg: msg}
+}
+
+func (e *RetError) Error() string {
+	return fmt.Sprintf("ret = %d, %s", e.Ret, e.Msg)
+}
+
+// NewResponseMsg creates the response of the req with the same Cmd, Seq, SerializeType and CompressType
+// (创建req的响应消息，Cmd、Seq、SerializeType以及CompressType与req相同)
+func NewResponseMsg(req SMsg, ret uint16, data []byte) *NSQMsg {
+	msg := NewNSQMsg(req.GetCmd(), ret, req.GetSerializeType(), nil, data)
+	msg.Version = req.GetVersion()
+	msg.CompressType = req.GetCompressType()
+	msg.MessageType = smsg.Response
+	msg.Seq = req.GetSeq()
+	return msg
+}
+
+// NewErrorResponseMsg creates the response of the req carrying the error message in the meta
+// (创建在meta中携带错误信息的req响应消息)
+func NewErrorResponseMsg(req SMsg, ret uint16, errMsg string) *NSQMsg {
+	msg := NewResponseMsg(req, ret, nil)
+	msg.Metadata = map[string]string{MetaKeyError: errMsg}
+	return msg
+}
+
+type taskCtxKey struct{}
+
+// ContextWithTask returns a copy of ctx carrying the task (返回携带task的ctx副本)
+func ContextWithTask(ctx context.Context, task STask) context.Context {
+	return context.WithValue(ctx, taskCtxKey{}, task)
+}
+
+// TaskFromContext returns the task passed to the function handler, the task must not be used
+// after the handler returns because it is put back to the TaskPool
+// (返回传给函数式处理函数的task，task会被放回TaskPool，所以处理函数返回之后不能再使用)
+func TaskFromContext(ctx context.Context) (STask, bool) {
+	task, ok := ctx.Value(taskCtxKey{}).(STask)
+	return task, ok
+}
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// FuncRouter binds a function handler like func(ctx context.Context, req *Req) (*Resp, error)
+// (绑定形如func(ctx context.Context, req *Req) (*Resp, error)的函数式处理函数)
+type FuncRouter struct {
+	BaseRouter
+	fn      reflect.Value
+	reqType reflect.Type
+}
+
+// NewFuncRouter creates a router from fn, the request is decoded by smsg.Codecs according to its
+// SerializeType, and the response is encoded by the same codec and sent back by SendBuffMsg with
+// the same Seq, the tasks without a connection, such as the NSQ ones, get context.Background() and are not
+// replied. It panics if fn is not func(context.Context, *Req) (Resp, error)
+// (根据fn创建路由，请求根据其SerializeType由smsg.Codecs解码，响应使用相同的编解码器编码，并以相同的Seq通过
+// SendBuffMsg回复，没有连接的任务(例如NSQ的任务)使用context.Background()且不回复。fn的形式不是func(context.Context, *Req) (Resp, error)时panic)
+func NewFuncRouter(fn interface{}) SRouter {
+	v := reflect.ValueOf(fn)
+	t := v.Type()
+	if t.Kind() != reflect.Func || t.NumIn() != 2 || t.NumOut() != 2 ||
+		t.In(0) != contextType || t.In(1).Kind() != reflect.Ptr || t.Out(1) != errorType {
+		panic(fmt.Sprintf("sbus: handler must be func(context.Context, *Req) (Resp, error), got %s", t))
+	}
+	return &FuncRouter{
+		fn:      v,
+		reqType: t.In(1).Elem(),
+	}
+}
+
+func (r *FuncRouter) Handle(task STask) error {
+	reqMsg := task.GetMessage()
+	codec, ok := smsg.Codecs[reqMsg.GetSerializeType()]
+	if !ok {
+		err := fmt.Errorf("sbus: unknown serialize type %d", reqMsg.GetSerializeType())
+		return r.reply(task, NewErrorResponseMsg(reqMsg, RetBadRequest, err.Error()), err)
+	}
+
+	req := reflect.New(r.reqType)
+	if err := codec.Decode(task.GetData(), req.Interface()); err != nil {
+		return r.reply(task, NewErrorResponseMsg(reqMsg, RetBadRequest, err.Error()), err)
+	}
+
+	ctx := context.Background()
+	if conn := task.GetConnection(); conn != nil {
+		ctx = conn.Context()
+	}
+	ctx = ContextWithTask(ctx, task)
+	out := r.fn.Call([]reflect.Value{reflect.ValueOf(ctx), req})
+	if err, _ := out[1].Interface().(error); err != nil {
+		var retErr *RetError
+		if errors.As(err, &retErr) {
+			return r.reply(task, NewErrorResponseMsg(reqMsg, retErr.Ret, retErr.Msg), err)
+		}
+		return r.reply(task, NewErrorResponseMsg(reqMsg, RetInternalError, err.Error()), err)
+	}
+
+	var data []byte
+	if resp := out[0]; !isNilValue(resp) {
+		var err error
+		if data, err = codec.Encode(resp.Interface()); err != nil {
+			return r.reply(task, NewErrorResponseMsg(reqMsg, RetInternalError, err.Error()), err)
+		}
+	}
+	return r.reply(task, NewResponseMsg(reqMsg, RetOK, data), nil)
+}
+
+// reply sends the response if the task has a connection, the error of the handler takes precedence over
+// the error of sending (任务有连接时发送响应，处理函数的错误优先于发送的错误)
+func (r *FuncRouter) reply(task STask, resp SMsg, err error) error {
+	conn := task.GetConnection()
+	if conn == nil {
+		return err
+	}
+	if sendErr := conn.SendBuffMsg(resp); err == nil {
+		err = sendErr
+	}
+	return err
+}
+
+func isNilValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice:
+		return v.IsNil()
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+package sbus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/nsqio/go-nsq"
+	"github.com/wwengg/threego/core/sconfig"
+	"github.com/wwengg/threego/core/slog"
+	"github.com/wwengg/threego/core/smsg"
+)
+
+type echoReq struct {
+	Name string `json:"name"`
+}
+
+type echoResp struct {
+	Greeting string `json:"greeting"`
+}
+
+func echoHandler(ctx context.Context, req *echoReq) (*echoResp, error) {
+	if _, ok := TaskFromContext(ctx); !ok {
+		return nil, NewRetError(RetInternalError, "no task in ctx")
+	}
+	if req.Name == "" {
+		return nil, NewRetError(RetBadRequest, "name is empty")
+	}
+	return &echoResp{Greeting: "hello " + req.Name}, nil
+}
+
+// callFuncRouter runs the router on a connection that is not started and returns the queued response
+// (在未启动的连接上执行路由并返回队列中的响应)
+func callFuncRouter(t *testing.T, router SRouter, req SMsg) SMsg {
+	t.Helper()
+	conn := NewConnection(nil, 1, 0, nil, nil, nil, nil, NewTcpDataPack(), nil, 0, 0).(*Connection)
+	task := GetTask(conn, req)
+	task.BindRouter(router)
+	_ = task.Call()
+
+	select {
+	case data := <-conn.msgBuffChan:
+		resp, err := conn.Datapack.Unpack(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	default:
+		t.Fatal("no response is sent")
+		return nil
+	}
+}
+
+func TestFuncRouter(t *testing.T) {
+	slog.NewZapLog(&sconfig.Slog{Director: t.TempDir(), Level: "error"})
+	router := NewFuncRouter(echoHandler)
+
+	data, _ := json.Marshal(&echoReq{Name: "threego"})
+	req := NewNSQMsg(100, 0, smsg.JSON, nil, data)
+	req.MessageType = smsg.Request
+	req.Seq = 42
+	resp := callFuncRouter(t, router, req)
+	if resp.GetRet() != RetOK || resp.GetSeq() != 42 || resp.GetCmd() != 100 || resp.GetMessageType() != smsg.Response {
+		t.Fatalf("unexpected response header %+v", resp)
+	}
+	var out echoResp
+	if err := json.Unmarshal(resp.GetData(), &out); err != nil || out.Greeting != "hello threego" {
+		t.Fatalf("unexpected response %q, %v", resp.GetData(), err)
+	}
+
+	// RetError is replied with its Ret and message (RetError以其Ret以及错误信息回复)
+	req = NewNSQMsg(100, 0, smsg.JSON, nil, []byte(`{}`))
+	resp = callFuncRouter(t, router, req)
+	if resp.GetRet() != RetBadRequest || resp.GetMeta()[MetaKeyError] != "name is empty" {
+		t.Fatalf("unexpected error response %+v", resp)
+	}
+
+	// the request that can not be decoded (无法解码的请求)
+	req = NewNSQMsg(100, 0, smsg.JSON, nil, []byte(`not json`))
+	if resp = callFuncRouter(t, router, req); resp.GetRet() != RetBadRequest {
+		t.Fatalf("unexpected ret %d", resp.GetRet())
+	}
+}
+
+func TestNewFuncRouterInvalidSignature(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic")
+		}
+	}()
+	NewFuncRouter(func(req *echoReq) (*echoResp, error) { return nil, nil })
+}
+
+func TestFuncRouterNsq(t *testing.T) {
+	slog.NewZapLog(&sconfig.Slog{Director: t.TempDir(), Level: "error"})
+	// the NSQ tasks have no connection, the func runs with context.Background() and the error is returned
+	// to NSQ instead of replied (NSQ任务没有连接，函数使用context.Background()执行，错误返回给NSQ而不是回复)
+	greetings := make(chan string, 1)
+	n := &Nsq{Apis: make(map[int32]SRouter)}
+	n.addRouter(100, NewFuncRouter(func(ctx context.Context, req *echoReq) (*echoResp, error) {
+		resp, err := echoHandler(ctx, req)
+		if err == nil {
+			greetings <- resp.Greeting
+		}
+		return resp, err
+	}))
+	handle := func(data []byte) error {
+		t.Helper()
+		body, err := NsqDataPackObj.Pack(NewNSQMsg(100, 0, smsg.JSON, nil, data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n.HandleMessage(&nsq.Message{Body: body})
+	}
+
+	if err := handle([]byte(`{"name":"nsq"}`)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case greeting := <-greetings:
+		if greeting != "hello nsq" {
+			t.Fatalf("unexpected greeting %q", greeting)
+		}
+	default:
+		t.Fatal("the func is not called")
+	}
+	var retErr *RetError
+	if err := handle([]byte(`{}`)); !errors.As(err, &retErr) || retErr.Ret != RetBadRequest {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+package sbus
+
+import (
+	"context"
+	"fmt"
+)
+
+// funcTask runs a function on the workers, it belongs to the lane of conn in the ordered dispatch mode
+// (在worker上执行的函数任务，顺序分发模式下属于conn所在的队列)
+type funcTask struct {
+	BaseRequest
+	conn SConnection
+	fn   func()
+	// called instead of fn if the task is rejected by the OverloadPolicy (任务被OverloadPolicy拒绝时代替fn调用)
+	onReject func(err error)
+}
+
+func (t *funcTask) GetConnection() SConnection { return t.conn }
+func (t *funcTask) CallFunc()                  { t.fn() }
+
+// Submit runs fn on a worker, it returns the error of the OverloadPolicy if fn is rejected
+// (在worker上执行fn，fn被拒绝时返回OverloadPolicy的错误)
+func (mh *TaskHandler) Submit(fn func()) error {
+	return mh.SendTaskToTaskQueue(&funcTask{fn: fn})
+}
+
+// SubmitToConn runs fn on the same lane as the tasks of conn, so in the ordered dispatch mode fn never
+// runs concurrently with the handlers of conn and can safely touch its state
+// (在与conn的任务相同的队列上执行fn，顺序分发模式下fn不会与conn的处理函数并发执行，可以安全地访问其状态)
+func (mh *TaskHandler) SubmitToConn(conn SConnection, fn func()) error {
+	return mh.SendTaskToTaskQueue(&funcTask{conn: conn, fn: fn})
+}
+
+// Future is the result of SubmitFuture (SubmitFuture的结果)
+type Future[T any] struct {
+	done chan struct{}
+	val  T
+	err  error
+}
+
+func newFuture[T any]() *Future[T] {
+	return &Future[T]{done: make(chan struct{})}
+}
+
+func (f *Future[T]) complete(val T, err error) {
+	f.val, f.err = val, err
+	close(f.done)
+}
+
+// Done is closed when the result is ready (结果就绪时关闭)
+func (f *Future[T]) Done() <-chan struct{} {
+	return f.done
+}
+
+// Get waits for the result, it returns ctx.Err() if ctx is done first
+// (等待结果，ctx先结束时返回ctx.Err())
+func (f *Future[T]) Get(ctx context.Context) (T, error) {
+	select {
+	case <-f.done:
+		return f.val, f.err
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+// SubmitFuture runs fn on the lane of conn like SubmitToConn, conn can be nil, the panic of fn and
+// the rejection by the OverloadPolicy are returned as the error of the Future
+// (与SubmitToConn一样在conn的队列上执行fn，conn可以为nil，fn的panic以及被OverloadPolicy拒绝都作为Future的错误返回)
+func SubmitFuture[T any](mh STaskHandler, conn SConnection, fn func() (T, error)) *Future[T] {
+	f := newFuture[T]()
+	task := &funcTask{
+		conn: conn,
+		fn: func() {
+			var (
+				val T
+				err error
+			)
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("sbus: panic in submitted func: %v", r)
+				}
+				f.complete(val, err)
+			}()
+			val, err = fn()
+		},
+		onReject: func(err error) {
+			var zero T
+			f.complete(zero, err)
+		},
+	}
+	if err := mh.SendTaskToTaskQueue(task); err != nil {
+		// onReject may have completed the future already (onReject可能已经完成了future)
+		select {
+		case <-f.done:
+		default:
+			var zero T
+			f.complete(zero, err)
+		}
+	}
+	return f
+}
@@ -0,0 +1,183 @@
+package sbus
+
+import (
+	"sync"
+	"time"
+
+	"github.com/wwengg/threego/core/slog"
+	"github.com/wwengg/threego/core/smsg"
+)
+
+type HeartbeatChecker struct {
+	interval time.Duration // Heartbeat detection interval (心跳检测时间间隔)
+	// The interval of sending the messages made by makeMsg, 0 means the checker only answers the heartbeats
+	// of the client (发送makeMsg生成的消息的间隔，0表示只应答客户端的心跳)
+	sendInterval time.Duration
+	quitChan     chan struct{} // Quit signal (退出信号)
+	stopOnce     sync.Once
+	wg           sync.WaitGroup
+
+	makeMsg          HeartBeatMsgFunc // User-defined heartbeat message processing method (用户自定义的心跳检测消息处理方法)
+	onRemoteNotAlive OnRemoteNotAlive // User-defined method for handling remote connections that are not alive (用户自定义的远程连接不存活时的处理方法)
+	cmd              uint16           // Heartbeat message ID (心跳的消息ID)
+	router           SRouter          // User-defined heartbeat message business processing router (用户自定义的心跳检测消息业务处理路由)
+
+	conn SConnection // Bound connection (绑定的链接)
+}
+
+// makeDefaultMsg is the default heartbeat message
+// (默认的心跳消息)
+func makeDefaultMsg(conn SConnection) SMsg {
+	msg := NewNSQMsg(HeartBeatDefaultMsgID, 0, smsg.SerializeNone, nil, []byte("ping"))
+	msg.CompressType = smsg.None
+	return msg
+}
+
+// notAliveDefaultFunc stops the connection that is not alive
+// (默认的远程连接不存活时的处理方法，停止连接)
+func notAliveDefaultFunc(conn SConnection) {
+	slog.Ins().Infof("Remote connection %s is not alive, stop it", conn.RemoteAddrString())
+	conn.Stop()
+}
+
+func NewHeartbeatChecker(interval time.Duration) SHeartbeatChecker {
+	return &HeartbeatChecker{
+		interval:         interval,
+		quitChan:         make(chan struct{}),
+		makeMsg:          makeDefaultMsg,
+		onRemoteNotAlive: notAliveDefaultFunc,
+		cmd:              HeartBeatDefaultMsgID,
+	}
+}
+
+// NewHeartbeatCheckerWithOption creates a heartbeat checker, the empty fields of the option use the defaults
+// (创建心跳检测器，option中为空的字段使用默认值)
+func NewHeartbeatCheckerWithOption(interval time.Duration, option *HeartBeatOption) SHeartbeatChecker {
+	checker := NewHeartbeatChecker(interval).(*HeartbeatChecker)
+	if option == nil {
+		return checker
+	}
+	if option.MakeMsg != nil {
+		checker.makeMsg = option.MakeMsg
+	}
+	if option.OnRemoteNotAlive != nil {
+		checker.onRemoteNotAlive = option.OnRemoteNotAlive
+	}
+	if option.HeartBeatMsgID != 0 {
+		checker.cmd = uint16(option.HeartBeatMsgID)
+	}
+	checker.sendInterval = option.SendInterval
+	checker.router = option.Router
+	return checker
+}
+
+func (h *HeartbeatChecker) SetOnRemoteNotAlive(f OnRemoteNotAlive) {
+	if f != nil {
+		h.onRemoteNotAlive = f
+	}
+}
+
+func (h *HeartbeatChecker) SetHeartbeatMsgFunc(f HeartBeatMsgFunc) {
+	if f != nil {
+		h.makeMsg = f
+	}
+}
+
+func (h *HeartbeatChecker) BindRouter(cmd uint16, router SRouter) {
+	h.cmd = cmd
+	h.router = router
+}
+
+func (h *HeartbeatChecker) start() {
+	defer h.wg.Done()
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	// a nil channel never fires if the checker does not send (不发送心跳时nil channel永远不会触发)
+	var sendC <-chan time.Time
+	if h.sendInterval > 0 {
+		sendTicker := time.NewTicker(h.sendInterval)
+		defer sendTicker.Stop()
+		sendC = sendTicker.C
+	}
+	for {
+		select {
+		case <-ticker.C:
+			h.check()
+		case <-sendC:
+			h.send()
+		case <-h.quitChan:
+			return
+		}
+	}
+}
+
+// Start starts the heartbeat detection, it does nothing if the interval is not positive
+// (启动心跳检测，心跳间隔不为正数时不做任何事)
+func (h *HeartbeatChecker) Start() {
+	if h.interval <= 0 {
+		return
+	}
+	h.wg.Add(1)
+	go h.start()
+}
+
+// Stop stops the checker and waits for its goroutine to exit, so it must not be called from OnRemoteNotAlive
+// (停止检测器并等待其协程退出，因此不能在OnRemoteNotAlive中调用)
+func (h *HeartbeatChecker) Stop() {
+	h.stopOnce.Do(func() {
+		slog.Ins().Debugf("heartbeat checker stop")
+		close(h.quitChan)
+	})
+	h.wg.Wait()
+}
+
+// SendHeartBeatMsg sends the heartbeat message made by HeartBeatMsgFunc through the send queue
+// (通过发送队列发送HeartBeatMsgFunc生成的心跳消息)
+func (h *HeartbeatChecker) SendHeartBeatMsg() error {
+	msg := h.makeMsg(h.conn)
+	return h.conn.SendBuffMsg(msg)
+}
+
+func (h *HeartbeatChecker) send() {
+	if h.conn == nil || !h.conn.IsAlive() {
+		return
+	}
+	if err := h.SendHeartBeatMsg(); err != nil {
+		slog.Ins().Debugf("send heartbeat to connID = %d error: %s", h.conn.GetConnID(), err)
+	}
+}
+
+func (h *HeartbeatChecker) check() {
+	if h.conn == nil {
+		return
+	}
+	if !h.conn.IsAlive() {
+		h.onRemoteNotAlive(h.conn)
+	}
+}
+
+func (h *HeartbeatChecker) BindConn(conn SConnection) {
+	h.conn = conn
+}
+
+// Clone clones the checker without the bound connection, every connection needs its own checker
+// (克隆一个未绑定连接的心跳检测器，每个连接都需要独立的检测器)
+func (h *HeartbeatChecker) Clone() SHeartbeatChecker {
+	return &HeartbeatChecker{
+		interval:         h.interval,
+		sendInterval:     h.sendInterval,
+		quitChan:         make(chan struct{}),
+		makeMsg:          h.makeMsg,
+		onRemoteNotAlive: h.onRemoteNotAlive,
+		cmd:              h.cmd,
+		router:           h.router,
+	}
+}
+
+func (h *HeartbeatChecker) Cmd() uint16 {
+	return h.cmd
+}
+
+func (h *HeartbeatChecker) Router() SRouter {
+	return h.router
+}
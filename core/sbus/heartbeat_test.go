@@ -0,0 +1,102 @@
+package sbus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/wwengg/threego/core/sconfig"
+	"github.com/wwengg/threego/core/slog"
+	"github.com/wwengg/threego/core/smsg"
+)
+
+type heartbeatRouter struct {
+	BaseRouter
+	handled chan uint64
+}
+
+func (r *heartbeatRouter) Handle(task STask) error {
+	r.handled <- task.GetConnection().GetConnID()
+	return nil
+}
+
+func TestHeartbeatCheckerSendAndNotAlive(t *testing.T) {
+	slog.NewZapLog(&sconfig.Slog{Director: t.TempDir(), Level: "error"})
+	notAlive := make(chan uint64, 4)
+	checker := NewHeartbeatCheckerWithOption(10*time.Millisecond, &HeartBeatOption{
+		SendInterval:     10 * time.Millisecond,
+		OnRemoteNotAlive: func(conn SConnection) { notAlive <- conn.GetConnID() },
+	})
+
+	// the alive connection gets the messages of HeartBeatMsgFunc (存活的连接收到HeartBeatMsgFunc生成的消息)
+	alive := NewConnection(nil, 1, 0, nil, nil, nil, nil, NewTcpDataPack(), nil, 0, time.Minute).(*Connection)
+	alive.updateActivity()
+	hc := checker.Clone()
+	hc.BindConn(alive)
+	alive.SetHeartBeat(hc)
+	hc.Start()
+	defer hc.Stop()
+	select {
+	case data := <-alive.msgBuffChan:
+		msg, err := alive.Datapack.Unpack(data)
+		if err != nil || msg.GetCmd() != HeartBeatDefaultMsgID || string(msg.GetData()) != "ping" {
+			t.Fatalf("unexpected heartbeat %+v, %v", msg, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no heartbeat is sent")
+	}
+
+	// the connection without activity is reported (没有活动的连接被上报)
+	dead := NewConnection(nil, 2, 0, nil, nil, nil, nil, NewTcpDataPack(), nil, 0, 20*time.Millisecond)
+	hc2 := checker.Clone()
+	hc2.BindConn(dead)
+	dead.SetHeartBeat(hc2)
+	hc2.Start()
+	defer hc2.Stop()
+	select {
+	case connID := <-notAlive:
+		if connID != 2 {
+			t.Fatalf("connID %d is reported not alive, want 2", connID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the dead connection is not reported")
+	}
+}
+
+func TestHeartbeatDispatch(t *testing.T) {
+	slog.NewZapLog(&sconfig.Slog{Director: t.TempDir(), Level: "error"})
+	ping := func() SMsg { return NewNSQMsg(HeartBeatDefaultMsgID, 0, smsg.SerializeNone, nil, []byte("ping")) }
+
+	// the heartbeat is handled by the router instead of being echoed (心跳由路由处理而不是回显)
+	router := &heartbeatRouter{handled: make(chan uint64, 1)}
+	routed := NewConnection(nil, 1, 0, nil, nil, nil, nil, NewTcpDataPack(), nil, 0, 0).(*Connection)
+	routed.SetHeartBeat(NewHeartbeatCheckerWithOption(time.Minute, &HeartBeatOption{Router: router}))
+	if err := routed.dispatchMsg(ping()); err != nil {
+		t.Fatal(err)
+	}
+	if connID := <-router.handled; connID != 1 || len(routed.msgBuffChan) != 0 {
+		t.Fatalf("unexpected router call for connID %d, %d queued", connID, len(routed.msgBuffChan))
+	}
+
+	// without a router the heartbeat is echoed (没有路由时回显心跳)
+	echoed := NewConnection(nil, 2, 0, nil, nil, nil, nil, NewTcpDataPack(), nil, 0, 0).(*Connection)
+	hc := NewHeartbeatChecker(time.Minute)
+	hc.BindConn(echoed)
+	echoed.SetHeartBeat(hc)
+	if err := echoed.dispatchMsg(ping()); err != nil {
+		t.Fatal(err)
+	}
+	if len(echoed.msgBuffChan) != 1 {
+		t.Fatalf("%d heartbeats are echoed, want 1", len(echoed.msgBuffChan))
+	}
+
+	// without a checker the heartbeat is an ordinary task and the connection is alive
+	// (没有检测器时心跳是普通任务，连接保持存活)
+	mh := NewTaskHandler(1, 4)
+	plain := NewConnection(nil, 3, 0, mh, nil, nil, nil, NewTcpDataPack(), nil, 0, time.Millisecond)
+	if err := plain.(*Connection).dispatchMsg(ping()); err != nil {
+		t.Fatal(err)
+	}
+	if mh.QueueLen() != 1 || !plain.IsAlive() {
+		t.Fatalf("queue len = %d, alive = %v", mh.QueueLen(), plain.IsAlive())
+	}
+}
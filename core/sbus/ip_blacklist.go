@@ -0,0 +1,158 @@
+package sbus
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrBlocked = errors.New("remote IP is in the blacklist")
+
+// PropertyKeyClientIP is the client IP resolved before the connection is created, such as the one behind the
+// trusted proxies of a WebSocket upgrade, the rate limiter bans it instead of the IP of the remote address
+// (创建连接之前解析出的客户端IP，例如WebSocket升级时可信代理之后的IP，限流封禁的是它而不是远端地址的IP)
+const PropertyKeyClientIP = "sbus.clientIP" // string
+
+// IPBlacklist blocks the remote IPs, the entries are IPs or CIDRs added for ever, or IPs banned for a while
+// (封禁远端IP，条目为永久添加的IP或CIDR，或者临时封禁的IP)
+type IPBlacklist struct {
+	mu    sync.RWMutex
+	nets  map[string]*net.IPNet
+	bans  map[string]time.Time // IP -> the time the ban expires (IP -> 封禁到期时间)
+	clock func() time.Time
+}
+
+// NewIPBlacklist creates the blacklist with the IPs or CIDRs, such as "10.0.0.1" and "192.168.0.0/16"
+// (以IP或CIDR创建黑名单，例如"10.0.0.1"和"192.168.0.0/16")
+func NewIPBlacklist(entries ...string) (*IPBlacklist, error) {
+	bl := &IPBlacklist{
+		nets:  make(map[string]*net.IPNet),
+		bans:  make(map[string]time.Time),
+		clock: time.Now,
+	}
+	for _, entry := range entries {
+		if err := bl.Add(entry); err != nil {
+			return nil, err
+		}
+	}
+	return bl, nil
+}
+
+// Add blocks the IP or CIDR for ever (永久封禁IP或CIDR)
+func (bl *IPBlacklist) Add(entry string) error {
+	ipNet, err := parseIPNet(entry)
+	if err != nil {
+		return err
+	}
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	bl.nets[ipNet.String()] = ipNet
+	return nil
+}
+
+// Remove unblocks the IP or CIDR added by Add or banned by Ban (解除Add添加或Ban封禁的IP或CIDR)
+func (bl *IPBlacklist) Remove(entry string) {
+	ipNet, err := parseIPNet(entry)
+	if err != nil {
+		return
+	}
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	delete(bl.nets, ipNet.String())
+	delete(bl.bans, ipNet.IP.String())
+}
+
+// Ban blocks the IP for duration (封禁IP一段时间)
+func (bl *IPBlacklist) Ban(ip net.IP, duration time.Duration) {
+	if ip == nil || duration <= 0 {
+		return
+	}
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	bl.bans[ip.String()] = bl.clock().Add(duration)
+}
+
+// Contains reports whether the IP is blocked, the expired bans are removed
+// (判断IP是否被封禁，过期的封禁会被删除)
+func (bl *IPBlacklist) Contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	key := ip.String()
+	bl.mu.RLock()
+	expire, banned := bl.bans[key]
+	if banned && bl.clock().Before(expire) {
+		bl.mu.RUnlock()
+		return true
+	}
+	for _, ipNet := range bl.nets {
+		if ipNet.Contains(ip) {
+			bl.mu.RUnlock()
+			return true
+		}
+	}
+	bl.mu.RUnlock()
+
+	if banned {
+		bl.mu.Lock()
+		if expire, ok := bl.bans[key]; ok && !bl.clock().Before(expire) {
+			delete(bl.bans, key)
+		}
+		bl.mu.Unlock()
+	}
+	return false
+}
+
+func parseIPNet(entry string) (*net.IPNet, error) {
+	if strings.Contains(entry, "/") {
+		_, ipNet, err := net.ParseCIDR(entry)
+		return ipNet, err
+	}
+	ip := net.ParseIP(entry)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP %q", entry)
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// clientIP returns PropertyKeyClientIP if it is set, otherwise the IP of the remote address
+// (设置了PropertyKeyClientIP时返回它，否则返回远端地址的IP)
+func (bc *Connection) clientIP() net.IP {
+	if ip, err := GetPropertyAs[string](bc, PropertyKeyClientIP); err == nil {
+		return net.ParseIP(ip)
+	}
+	if bc.Conn == nil {
+		return nil
+	}
+	return addrIP(bc.RemoteAddr())
+}
+
+// addrIP returns the IP of addr, nil if it has none (返回addr的IP，没有时返回nil)
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	case nil:
+		return nil
+	}
+	return hostIP(addr.String())
+}
+
+// hostIP returns the IP of "host:port" or "host", nil if the host is not an IP
+// (返回"host:port"或"host"的IP，host不是IP时返回nil)
+func hostIP(hostport string) net.IP {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,61 @@
+package sbus
+
+import (
+	"fmt"
+	"runtime"
+	"time"
+
+	"github.com/wwengg/threego/core/slog"
+)
+
+// TaskKeyCost is the time.Duration the rest of the chain took, set by TimingMiddleware
+// (链上剩余部分的耗时time.Duration，由TimingMiddleware设置)
+const TaskKeyCost = "sbus.cost"
+
+// RecoveryMiddleware recovers the panic of the rest of the chain, logs the stack and aborts the task with the panic as the error
+// (捕获链上剩余部分的panic，打印堆栈并以panic作为错误终止任务)
+func RecoveryMiddleware() MiddlewareFunc {
+	return func(task STask) {
+		defer func() {
+			if err := recover(); err != nil {
+				var errStack = make([]byte, 4096)
+				n := runtime.Stack(errStack, false)
+				slog.Ins().Errorf("panic in msgID = %d: %v, stack: %s", task.GetMsgID(), err, errStack[:n])
+				task.AbortWithError(fmt.Errorf("sbus: panic in msgID %d: %v", task.GetMsgID(), err))
+			}
+		}()
+		task.Next()
+	}
+}
+
+// LoggerMiddleware logs the connection, msgID, cost and error of every task
+// (打印每个任务的连接、msgID、耗时以及错误)
+func LoggerMiddleware() MiddlewareFunc {
+	return func(task STask) {
+		start := time.Now()
+		task.Next()
+		cost := time.Since(start)
+
+		conn := task.GetConnection()
+		if err := task.GetErr(); err != nil {
+			slog.Ins().Errorf("[sbus] connID = %d | %s | msgID = %d | %v | error: %s", conn.GetConnID(), conn.RemoteAddrString(), task.GetMsgID(), cost, err)
+			return
+		}
+		slog.Ins().Infof("[sbus] connID = %d | %s | msgID = %d | %v", conn.GetConnID(), conn.RemoteAddrString(), task.GetMsgID(), cost)
+	}
+}
+
+// TimingMiddleware sets the cost of the rest of the chain by TaskKeyCost, and warns if it is slower than
+// slowThreshold, 0 means never warn
+// (通过TaskKeyCost设置链上剩余部分的耗时，耗时超过slowThreshold时打印警告，0表示不警告)
+func TimingMiddleware(slowThreshold time.Duration) MiddlewareFunc {
+	return func(task STask) {
+		start := time.Now()
+		task.Next()
+		cost := time.Since(start)
+		task.Set(TaskKeyCost, cost)
+		if slowThreshold > 0 && cost > slowThreshold {
+			slog.Ins().Warnf("[sbus] slow task msgID = %d cost %v > %v", task.GetMsgID(), cost, slowThreshold)
+		}
+	}
+}
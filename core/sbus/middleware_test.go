@@ -0,0 +1,87 @@
+package sbus
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/wwengg/threego/core/smsg"
+)
+
+type traceRouter struct {
+	BaseRouter
+	trace *[]string
+	err   error
+}
+
+func (r *traceRouter) PreHandle(task STask) { *r.trace = append(*r.trace, "pre") }
+
+func (r *traceRouter) Handle(task STask) error {
+	*r.trace = append(*r.trace, "handle")
+	return r.err
+}
+
+func (r *traceRouter) PostHandle(task STask) { *r.trace = append(*r.trace, "post") }
+
+func traceMiddleware(trace *[]string, name string) MiddlewareFunc {
+	return func(task STask) {
+		*trace = append(*trace, name+" before")
+		task.Next()
+		*trace = append(*trace, name+" after")
+	}
+}
+
+func TestTaskMiddlewareChain(t *testing.T) {
+	var trace []string
+	task := GetTask(nil, NewNSQMsg(1, 0, smsg.SerializeNone, nil, nil))
+	task.BindRouter(&traceRouter{trace: &trace})
+	task.BindMiddleware([]MiddlewareFunc{traceMiddleware(&trace, "a"), traceMiddleware(&trace, "b")})
+	if err := task.Call(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a before", "b before", "pre", "handle", "post", "b after", "a after"}
+	if !reflect.DeepEqual(trace, want) {
+		t.Fatalf("trace = %v, want %v", trace, want)
+	}
+}
+
+func TestTaskMiddlewareAbort(t *testing.T) {
+	var trace []string
+	errDenied := errors.New("denied")
+	task := GetTask(nil, NewNSQMsg(1, 0, smsg.SerializeNone, nil, nil))
+	task.BindRouter(&traceRouter{trace: &trace})
+	task.BindMiddleware([]MiddlewareFunc{
+		traceMiddleware(&trace, "a"),
+		func(task STask) { task.AbortWithError(errDenied) },
+		traceMiddleware(&trace, "c"),
+	})
+	if err := task.Call(); !errors.Is(err, errDenied) {
+		t.Fatalf("expected errDenied, got %v", err)
+	}
+	if !task.IsAborted() {
+		t.Fatal("expected the task to be aborted")
+	}
+	want := []string{"a before", "a after"}
+	if !reflect.DeepEqual(trace, want) {
+		t.Fatalf("trace = %v, want %v", trace, want)
+	}
+}
+
+func TestTaskMiddlewareRouterError(t *testing.T) {
+	var trace []string
+	errHandle := errors.New("handle failed")
+	var seen error
+	task := GetTask(nil, NewNSQMsg(1, 0, smsg.SerializeNone, nil, nil))
+	task.BindRouter(&traceRouter{trace: &trace, err: errHandle})
+	task.BindMiddleware([]MiddlewareFunc{func(task STask) {
+		task.Next()
+		seen = task.GetErr()
+	}})
+	if err := task.Call(); !errors.Is(err, errHandle) || !errors.Is(seen, errHandle) {
+		t.Fatalf("expected errHandle, got %v and %v", err, seen)
+	}
+	// PostHandle is skipped when Handle fails (Handle失败时跳过PostHandle)
+	if want := []string{"pre", "handle"}; !reflect.DeepEqual(trace, want) {
+		t.Fatalf("trace = %v, want %v", trace, want)
+	}
+}
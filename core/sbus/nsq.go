@@ -216,6 +216,7 @@ func NewNsq(workPoolSize, maxTaskQueueLen, maxNsqDataChanLen uint32, channel, ns
 		//	TaskHandler: taskHandler,
 		//},
 		//taskHandler:       taskHandler,
+		Apis:              make(map[int32]SRouter),
 		startWriterFlag:   0,
 		producers:         make([]*NsqProducer, 0),
 		Consumers:         make([]*NsqConsumer, 0),
@@ -316,12 +317,7 @@ func (n *Nsq) HandleMessage(message *nsq.Message) error {
 			slog.Ins().Errorf("panic in HandleMessage: %v, stack: %s", err, errStack[:n])
 		}
 	}()
-	// 支持自定义dataPack
-	dataPack := n.dataPack
-	if dataPack == nil {
-		dataPack = NsqDataPackObj
-	}
-	if msg, err := dataPack.Unpack(message.Body); err != nil {
+	if msg, err := n.getDataPack().Unpack(message.Body); err != nil {
 		slog.Ins().Error("Nsq Consumer Unpack Data err", zap.Error(err))
 		return nil
 	} else {
@@ -354,6 +350,14 @@ func (n *Nsq) HandleMessage(message *nsq.Message) error {
 	return nil
 }
 
+// getDataPack returns the custom dataPack, NsqDataPackObj by default (返回自定义dataPack，默认为NsqDataPackObj)
+func (n *Nsq) getDataPack() SDataPack {
+	if n.dataPack == nil {
+		return NsqDataPackObj
+	}
+	return n.dataPack
+}
+
 func (n *Nsq) StartWriter(p *NsqProducer) {
 	slog.Ins().Infof("Nsq Writer Goroutine is running")
 	defer slog.Ins().Infof("[Nsq Writer exit!]")
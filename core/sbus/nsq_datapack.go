@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"runtime"
 
 	"github.com/smallnest/rpcx/util"
@@ -14,12 +15,17 @@ import (
 var nsqDataHeaderLen uint32 = 13
 
 type NsqDataPack struct {
+	// Data shorter than CompressThreshold is not compressed, 0 means always compress
+	// (长度小于CompressThreshold的数据不压缩，0表示总是压缩)
+	CompressThreshold uint32
 }
 
 var NsqDataPackObj = new(NsqDataPack)
 
 var ErrMetaKVMissing = errors.New("wrong metadata lines. some keys or values are missing")
 
+var ErrMetaLenExceeded = errors.New("declared meta length exceeds the remaining bytes")
+
 //+------+-------+---------+---------------+--------------+-------------+-------+------------+--------------+-------------+------------+
 //| CMD  |  Ret  | version | SerializeType | CompressType | messageType |  seq  |  meta len  |   meta data  |   data len  |    data    |
 //| 2字节 |  2字节 |  1字节  |     4bit      |     2bit     |      2bit   | 8字节  |    4字节    |     n字节    |      4字节   |    n字节    |
@@ -48,35 +54,51 @@ func (dp *NsqDataPack) Pack(msg SMsg) ([]byte, error) {
 	// Create a buffer to store the bytes
 	// (创建一个存放bytes字节的缓冲)
 	dataBuff := bytes.NewBuffer([]byte{})
+	if err := packMsg(dataBuff, msg, dp.CompressThreshold); err != nil {
+		return nil, err
+	}
+
+	return dataBuff.Bytes(), nil
+}
 
+// packMsg compresses the data and writes the header, meta and data of the msg into dataBuff,
+// shared by NsqDataPack and TcpDataPack
+// (压缩数据并将msg的header、meta和data写入dataBuff，NsqDataPack和TcpDataPack共用)
+func packMsg(dataBuff *bytes.Buffer, msg SMsg, compressThreshold uint32) error {
+	// Compress the data first, the CompressType written into the header may be changed to None
+	// (先压缩数据，写入header的CompressType可能会变为None)
+	compressType, data, err := compressData(msg.GetCompressType(), msg.GetData(), compressThreshold)
+	if err != nil {
+		return err
+	}
 	// Write the cmd
 	if err := binary.Write(dataBuff, binary.BigEndian, msg.GetCmd()); err != nil {
-		return nil, err
+		return err
 	}
 
 	// Write the ret
 	if err := binary.Write(dataBuff, binary.BigEndian, msg.GetRet()); err != nil {
-		return nil, err
+		return err
 	}
 
 	// Write the version
 	if err := binary.Write(dataBuff, binary.BigEndian, msg.GetVersion()); err != nil {
-		return nil, err
+		return err
 	}
 	var oneByte [1]byte
 	// SerializeType
 	oneByte[0] = (oneByte[0] &^ 0xF0) | (byte(msg.GetSerializeType()) << 4)
 	// CompressType
-	oneByte[0] = (oneByte[0] &^ 0x0C) | ((byte(msg.GetCompressType()) << 2) & 0x0C)
+	oneByte[0] = (oneByte[0] &^ 0x0C) | ((byte(compressType) << 2) & 0x0C)
 	// messageType
 	oneByte[0] = (oneByte[0] &^ 0x03) | (byte(msg.GetMessageType()) & 0x03)
 	// Write the oneByte
 	if err := binary.Write(dataBuff, binary.BigEndian, oneByte); err != nil {
-		return nil, err
+		return err
 	}
 	// Write the seq
 	if err := binary.Write(dataBuff, binary.BigEndian, msg.GetSeq()); err != nil {
-		return nil, err
+		return err
 	}
 	// Write the meta
 	var bb = bytes.NewBuffer(make([]byte, 0, len(msg.GetMeta())*64))
@@ -84,20 +106,19 @@ func (dp *NsqDataPack) Pack(msg SMsg) ([]byte, error) {
 	meta := bb.Bytes()
 	// Write the meta len
 	if err := binary.Write(dataBuff, binary.BigEndian, uint32(len(meta))); err != nil {
-		return nil, err
+		return err
 	}
 	if err := binary.Write(dataBuff, binary.BigEndian, meta); err != nil {
-		return nil, err
+		return err
 	}
 	// Write the data
-	if err := binary.Write(dataBuff, binary.BigEndian, uint32(len(msg.GetData()))); err != nil {
-		return nil, err
+	if err := binary.Write(dataBuff, binary.BigEndian, uint32(len(data))); err != nil {
+		return err
 	}
-	if err := binary.Write(dataBuff, binary.BigEndian, msg.GetData()); err != nil {
-		return nil, err
+	if err := binary.Write(dataBuff, binary.BigEndian, data); err != nil {
+		return err
 	}
-
-	return dataBuff.Bytes(), nil
+	return nil
 }
 
 // Unpack unpacks the message (decompresses the data)
@@ -117,23 +138,50 @@ func (dp *NsqDataPack) Unpack(binaryData []byte) (SMsg, error) {
 	// Only unpack the header information to obtain the data length and message ID
 	// (只解压head的信息，得到dataLen和msgID)
 	msg := &NSQMsg{}
+	metaLen, err := unpackHeader(dataBuff, msg)
+	if err != nil {
+		return nil, err
+	}
+	// Read the data
+	var dataLen uint32
+	if err := binary.Read(dataBuff, binary.BigEndian, &dataLen); err != nil {
+		return nil, err
+	}
+	if dataLen > 0 {
+		// Read the metaData
+		// 包大小可能大于65535 所以全都返回吧
+		msg.Data = binaryData[22+metaLen:]
+	}
+	// Decompress the data (解压数据)
+	if msg.Data, err = decompressData(msg.CompressType, msg.Data); err != nil {
+		return nil, err
+	}
+
+	// Only the header data needs to be unpacked, and then another data read is performed from the connection based on the header length
+	// (这里只需要把head的数据拆包出来就可以了，然后再通过head的长度，再从conn读取一次数据)
+	return msg, nil
+}
 
+// unpackHeader reads the header and meta from dataBuff into msg, returns the meta length,
+// shared by NsqDataPack and TcpDataPack
+// (从dataBuff中读取header和meta到msg，返回meta长度，NsqDataPack和TcpDataPack共用)
+func unpackHeader(dataBuff *bytes.Reader, msg *NSQMsg) (uint32, error) {
 	// Read the Cmd
 	if err := binary.Read(dataBuff, binary.BigEndian, &msg.Cmd); err != nil {
-		return nil, err
+		return 0, err
 	}
 
 	// Read the Ret
 	if err := binary.Read(dataBuff, binary.BigEndian, &msg.Ret); err != nil {
-		return nil, err
+		return 0, err
 	}
 	// Read the Version
 	if err := binary.Read(dataBuff, binary.BigEndian, &msg.Version); err != nil {
-		return nil, err
+		return 0, err
 	}
 	onebyte := [1]byte{}
 	if err := binary.Read(dataBuff, binary.BigEndian, &onebyte); err != nil {
-		return nil, err
+		return 0, err
 	}
 	// Read the SerializeType
 	msg.SerializeType = smsg.SerializeType((onebyte[0] & 0xF0) >> 4)
@@ -143,39 +191,31 @@ func (dp *NsqDataPack) Unpack(binaryData []byte) (SMsg, error) {
 	msg.MessageType = smsg.MessageType(onebyte[0] & 0x03)
 	// Read the seq
 	if err := binary.Read(dataBuff, binary.BigEndian, &msg.Seq); err != nil {
-		return nil, err
+		return 0, err
 	}
 	// Read the meta
 	var metaLen uint32
 	if err := binary.Read(dataBuff, binary.BigEndian, &metaLen); err != nil {
-		return nil, err
+		return 0, err
+	}
+	// Validate the declared meta length before allocating, it comes from the client
+	// (分配内存之前校验声明的meta长度，它来自客户端)
+	if remain := dataBuff.Len(); uint64(metaLen) > uint64(remain) {
+		return 0, fmt.Errorf("%w: declared %d, remaining %d", ErrMetaLenExceeded, metaLen, remain)
 	}
 	if metaLen > 0 {
 		metaData := make([]byte, metaLen)
 		// Read the metaData
 		if err := binary.Read(dataBuff, binary.BigEndian, &metaData); err != nil {
-			return nil, err
+			return 0, err
 		}
 		if m, err := DecodeMetadata(metaLen, metaData); err != nil {
-			return nil, err
+			return 0, err
 		} else {
 			msg.Metadata = m
 		}
 	}
-	// Read the data
-	var dataLen uint32
-	if err := binary.Read(dataBuff, binary.BigEndian, &dataLen); err != nil {
-		return nil, err
-	}
-	if dataLen > 0 {
-		// Read the metaData
-		// 包大小可能大于65535 所以全都返回吧
-		msg.Data = binaryData[22+metaLen:]
-	}
-
-	// Only the header data needs to be unpacked, and then another data read is performed from the connection based on the header length
-	// (这里只需要把head的数据拆包出来就可以了，然后再通过head的长度，再从conn读取一次数据)
-	return msg, nil
+	return metaLen, nil
 }
 
 // len,string,len,string,......
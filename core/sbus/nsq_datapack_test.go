@@ -1,9 +1,12 @@
 package sbus
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 
 	"github.com/wwengg/threego/core/smsg"
+	"github.com/wwengg/threego/core/utils"
 
 	//"github.com/wwengg/threego/proto/pbbase"
 	"testing"
@@ -34,3 +37,69 @@ func TestNewNsqDataPack(t *testing.T) {
 		}
 	}
 }
+
+func TestNsqDataPackCompress(t *testing.T) {
+	data := bytes.Repeat([]byte("threego "), 64)
+	for _, compressType := range []smsg.CompressType{smsg.None, smsg.Gzip, smsg.Brotli} {
+		pack := NewNsqDataPack()
+		msg := NewNSQMsg(1, 1, smsg.ProtoBuffer, nil, data)
+		msg.CompressType = compressType
+		packData, err := pack.Pack(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		unpacked, err := pack.Unpack(packData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if unpacked.GetCompressType() != compressType || !bytes.Equal(unpacked.GetData(), data) {
+			t.Fatalf("compress type %d: round trip mismatch", compressType)
+		}
+	}
+}
+
+func TestNsqDataPackCompressThreshold(t *testing.T) {
+	pack := &NsqDataPack{CompressThreshold: 1024}
+	msg := NewNSQMsg(1, 1, smsg.ProtoBuffer, nil, []byte("small"))
+	packData, err := pack.Pack(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unpacked, err := pack.Unpack(packData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unpacked.GetCompressType() != smsg.None || string(unpacked.GetData()) != "small" {
+		t.Fatalf("data below threshold should not be compressed, got type %d", unpacked.GetCompressType())
+	}
+}
+
+func TestNsqDataPackUnknownCompressType(t *testing.T) {
+	msg := NewNSQMsg(1, 1, smsg.ProtoBuffer, nil, []byte("data"))
+	msg.CompressType = smsg.CompressType(3)
+	_, err := NewNsqDataPack().Pack(msg)
+	var compressErr *UnknownCompressTypeError
+	if !errors.As(err, &compressErr) || compressErr.CompressType != 3 {
+		t.Fatalf("expected UnknownCompressTypeError, got %v", err)
+	}
+}
+
+func TestNsqDataPackUnzipLimit(t *testing.T) {
+	defer func(limit int64) { utils.MaxUnzipSize = limit }(utils.MaxUnzipSize)
+	utils.MaxUnzipSize = 1024
+
+	// a small zipped payload that inflates beyond the limit (压缩后很小但解压后超出上限的数据)
+	data := bytes.Repeat([]byte{0}, 64<<10)
+	for _, compressType := range []smsg.CompressType{smsg.Gzip, smsg.Brotli} {
+		pack := NewNsqDataPack()
+		msg := NewNSQMsg(1, 1, smsg.ProtoBuffer, nil, data)
+		msg.CompressType = compressType
+		packData, err := pack.Pack(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := pack.Unpack(packData); !errors.Is(err, utils.ErrUnzipTooLarge) {
+			t.Fatalf("compress type %d: expected ErrUnzipTooLarge, got %v", compressType, err)
+		}
+	}
+}
@@ -14,6 +14,8 @@ type SMsg interface {
 	GetCompressType() smsg.CompressType
 	GetMessageType() smsg.MessageType
 	GetSeq() uint64
+	SetSeq(seq uint64)
+	SetMessageType(messageType smsg.MessageType)
 	GetMeta() map[string]string
 	GetData() []byte // Gets the content of the message(获取消息内容)
 	//
@@ -37,6 +39,9 @@ type NSQMsg struct {
 	Metadata      map[string]string
 	Data          []byte
 	nsqMessage    *nsq.Message
+	// whether the connection which sends this msg has a FrameDecoder
+	// (发送此消息的连接是否存在FrameDecoder)
+	hasFrameDecoder bool
 }
 
 func NewNSQMsg(Cmd uint16, ret uint16, sType smsg.SerializeType, md map[string]string, data []byte) *NSQMsg {
@@ -47,11 +52,30 @@ func NewNSQMsg(Cmd uint16, ret uint16, sType smsg.SerializeType, md map[string]s
 		SerializeType: sType,
 		CompressType:  smsg.Gzip,
 		MessageType:   smsg.Response,
-		Seq:           123456789812322,
+		Seq:           0,
 		Metadata:      md,
 		Data:          data,
 	}
 }
+
+// copyMsg returns a shallow copy of msg for a connection, so packing it does not change the caller's msg,
+// which may be packed by the other connections too
+// (返回msg的浅拷贝，封包时不会修改调用方的msg，该msg可能也会被其他连接封包)
+func copyMsg(msg SMsg, hasFrameDecoder bool) *NSQMsg {
+	return &NSQMsg{
+		Cmd:             msg.GetCmd(),
+		Ret:             msg.GetRet(),
+		Version:         msg.GetVersion(),
+		SerializeType:   msg.GetSerializeType(),
+		CompressType:    msg.GetCompressType(),
+		MessageType:     msg.GetMessageType(),
+		Seq:             msg.GetSeq(),
+		Metadata:        msg.GetMeta(),
+		Data:            msg.GetData(),
+		hasFrameDecoder: hasFrameDecoder,
+	}
+}
+
 func (m *NSQMsg) GetMsgId() int32 {
 	return int32(m.Cmd)
 }
@@ -78,6 +102,14 @@ func (m *NSQMsg) GetSeq() uint64 {
 	return m.Seq
 }
 
+func (m *NSQMsg) SetSeq(seq uint64) {
+	m.Seq = seq
+}
+
+func (m *NSQMsg) SetMessageType(messageType smsg.MessageType) {
+	m.MessageType = messageType
+}
+
 func (m *NSQMsg) GetMeta() map[string]string {
 	return m.Metadata
 }
@@ -94,5 +126,5 @@ func (m *NSQMsg) GetNsqMessage() *nsq.Message {
 	return m.nsqMessage
 }
 
-func (m *NSQMsg) GetHasFrameDecoder() bool                { return false }
-func (m *NSQMsg) SetHasFrameDecoder(hasFrameDevoder bool) {}
+func (m *NSQMsg) GetHasFrameDecoder() bool                { return m.hasFrameDecoder }
+func (m *NSQMsg) SetHasFrameDecoder(hasFrameDevoder bool) { m.hasFrameDecoder = hasFrameDevoder }
@@ -3,16 +3,128 @@ package sbus
 import (
 	"context"
 	"crypto/tls"
-	"github.com/quic-go/quic-go"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/quic-go/quic-go"
 )
 
-type QuicConn struct {
-	conn  net.PacketConn
+// QuicSession is a QUIC connection carrying one or more streams, every stream is a QuicConn and
+// runs as a sbus connection of its own, the QUIC connection is closed when its last stream is closed
+// (QuicSession是承载一个或多个流的QUIC连接，每个流都是一个QuicConn，并作为独立的sbus连接运行，
+// 最后一个流关闭时关闭QUIC连接)
+type QuicSession struct {
 	qconn quic.Connection
 
-	stream quic.Stream
+	// the number of the streams not closed (未关闭的流数量)
+	refs      atomic.Int32
+	closeOnce sync.Once
+}
+
+func newQuicSession(qconn quic.Connection) *QuicSession {
+	return &QuicSession{qconn: qconn}
+}
+
+// AcceptStream waits for and returns the next stream opened by the peer
+// (等待并返回对端打开的下一个流)
+func (s *QuicSession) AcceptStream(ctx context.Context) (*QuicConn, error) {
+	stream, err := s.qconn.AcceptStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.newQuicConn(stream), nil
+}
+
+// OpenStream opens a new stream to the peer, such as a server-initiated data stream
+// (向对端打开一个新的流，例如服务端发起的数据流)
+func (s *QuicSession) OpenStream(ctx context.Context) (*QuicConn, error) {
+	stream, err := s.qconn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.newQuicConn(stream), nil
+}
+
+func (s *QuicSession) newQuicConn(stream quic.Stream) *QuicConn {
+	s.refs.Add(1)
+	return &QuicConn{
+		session: s,
+		stream:  stream,
+	}
+}
+
+func (s *QuicSession) release() {
+	if s.refs.Add(-1) <= 0 {
+		_ = s.Close()
+	}
+}
+
+// SupportsDatagrams reports whether both sides enabled the QUIC datagrams (RFC 9221)
+// (双方是否都开启了QUIC datagram)
+func (s *QuicSession) SupportsDatagrams() bool {
+	return s.qconn.ConnectionState().SupportsDatagrams
+}
+
+// SendDatagram sends the data as an unreliable datagram, it may be lost or reordered
+// (以不可靠的datagram发送数据，可能丢失或乱序)
+func (s *QuicSession) SendDatagram(data []byte) error {
+	return s.qconn.SendDatagram(data)
+}
+
+// SendDatagramMsg packs the msg without the length field and sends it as a datagram
+// (不带长度字段封包，并以datagram发送)
+func (s *QuicSession) SendDatagramMsg(datapack SDataPack, msg SMsg) error {
+	data, err := datagramPack(datapack).Pack(copyMsg(msg, false))
+	if err != nil {
+		return err
+	}
+	return s.SendDatagram(data)
+}
+
+func (s *QuicSession) ReceiveDatagram(ctx context.Context) ([]byte, error) {
+	return s.qconn.ReceiveDatagram(ctx)
+}
+
+// Context is done when the QUIC connection is closed (QUIC连接关闭时Done)
+func (s *QuicSession) Context() context.Context {
+	return s.qconn.Context()
+}
+
+func (s *QuicSession) RemoteAddr() net.Addr {
+	return s.qconn.RemoteAddr()
+}
+
+// CloseWithError closes the QUIC connection and all its streams, it is only executed once
+// (关闭QUIC连接以及其上所有的流，只执行一次)
+func (s *QuicSession) CloseWithError(code quic.ApplicationErrorCode, msg string) error {
+	var err error
+	s.closeOnce.Do(func() {
+		err = s.qconn.CloseWithError(code, msg)
+	})
+	return err
+}
+
+func (s *QuicSession) Close() error {
+	return s.CloseWithError(0, "")
+}
+
+// QuicSessionOf returns the QuicSession of the connection if it runs on a QUIC stream
+// (如果连接运行在QUIC流上，返回其QuicSession)
+func QuicSessionOf(conn SConnection) (*QuicSession, bool) {
+	qc, ok := conn.GetConn().(*QuicConn)
+	if !ok {
+		return nil, false
+	}
+	return qc.session, true
+}
+
+type QuicConn struct {
+	session *QuicSession
+
+	stream    quic.Stream
+	closeOnce sync.Once
 }
 
 // Read implements the Conn Read method.
@@ -27,41 +139,69 @@ func (c *QuicConn) Write(b []byte) (int, error) {
 
 // LocalAddr returns the local network address.
 func (c *QuicConn) LocalAddr() net.Addr {
-	return c.qconn.LocalAddr()
+	return c.session.qconn.LocalAddr()
 }
 
 // RemoteAddr returns the remote network address.
 func (c *QuicConn) RemoteAddr() net.Addr {
-	return c.qconn.RemoteAddr()
+	return c.session.qconn.RemoteAddr()
 }
 
-// Close closes the connection.
+// Close closes both directions of the stream, and closes the QUIC connection if it is the last stream.
 func (c *QuicConn) Close() error {
-	if c.stream != nil {
-		return c.stream.Close()
-	}
+	var err error
+	c.closeOnce.Do(func() {
+		c.stream.CancelRead(0)
+		err = c.stream.Close()
+		c.session.release()
+	})
+	return err
+}
 
-	return nil
+// StreamID returns the ID of the stream (返回流ID)
+func (c *QuicConn) StreamID() quic.StreamID {
+	return c.stream.StreamID()
 }
 
-// SetDeadline sets the deadline associated with the listener. A zero time value disables the deadline.
+// Session returns the QUIC connection the stream belongs to (返回流所属的QUIC连接)
+func (c *QuicConn) Session() *QuicSession {
+	return c.session
+}
+
+// SetDeadline sets the read and write deadlines of the stream. A zero time value disables the deadline.
 func (c *QuicConn) SetDeadline(t time.Time) error {
-	return c.conn.SetDeadline(t)
+	return c.stream.SetDeadline(t)
 }
 
 // SetReadDeadline implements the Conn SetReadDeadline method.
 func (c *QuicConn) SetReadDeadline(t time.Time) error {
-	return c.conn.SetReadDeadline(t)
+	return c.stream.SetReadDeadline(t)
 }
 
 // SetWriteDeadline implements the Conn SetWriteDeadline method.
 func (c *QuicConn) SetWriteDeadline(t time.Time) error {
-	return c.conn.SetWriteDeadline(t)
+	return c.stream.SetWriteDeadline(t)
 }
 
+// DefaultQuicStreamAcceptTimeout is the time Accept waits for the first stream of a QUIC connection
+// (Accept等待QUIC连接第一个流的时间)
+const DefaultQuicStreamAcceptTimeout = 10 * time.Second
+
 type QuicListener struct {
 	conn       net.PacketConn
 	quicServer *quic.Listener
+
+	// The time Accept waits for the first stream of a QUIC connection, 0 means DefaultQuicStreamAcceptTimeout,
+	// the connections without a stream in time are closed
+	// (Accept等待QUIC连接第一个流的时间，0表示DefaultQuicStreamAcceptTimeout，超时未打开流的连接会被关闭)
+	StreamAcceptTimeout time.Duration
+
+	// The first streams accepted by the session goroutines of Accept (Accept的会话协程接收到的第一个流)
+	streams    chan net.Conn
+	streamOnce sync.Once
+	// done is closed when the accept loop of Accept exits, err is the reason (Accept的accept循环退出时关闭，err为原因)
+	done chan struct{}
+	err  error
 }
 
 func NewQuicListener(c net.PacketConn, tlsConf *tls.Config, quicConfig *quic.Config) (*QuicListener, error) {
@@ -73,6 +213,8 @@ func NewQuicListener(c net.PacketConn, tlsConf *tls.Config, quicConfig *quic.Con
 	return &QuicListener{
 		conn:       c,
 		quicServer: ln,
+		streams:    make(chan net.Conn),
+		done:       make(chan struct{}),
 	}, nil
 }
 
@@ -80,24 +222,64 @@ func (q *QuicListener) Accept() (net.Conn, error) {
 	return q.AcceptContext(context.Background())
 }
 
-// AcceptContext waits for and returns the next connection to the listener.
+// AcceptContext waits for the next connection and returns its first stream, the QUIC connection
+// is closed when the returned conn is closed, the first streams are accepted in a goroutine per
+// connection, so a client that never opens a stream does not block the others
+// (等待下一个连接并返回其第一个流，关闭返回的conn时QUIC连接也会关闭，
+// 每个连接在独立的协程中接收第一个流，从不打开流的客户端不会阻塞其他连接)
 func (q *QuicListener) AcceptContext(ctx context.Context) (net.Conn, error) {
-	conn, err := q.quicServer.Accept(ctx)
-	if err != nil {
-		return nil, err
+	q.streamOnce.Do(func() {
+		go q.acceptStreamLoop()
+	})
+	select {
+	case conn := <-q.streams:
+		return conn, nil
+	case <-q.done:
+		return nil, q.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
-	stream, err := conn.AcceptStream(ctx)
-	if err != nil {
-		return nil, err
+}
+
+func (q *QuicListener) acceptStreamLoop() {
+	for {
+		session, err := q.AcceptSession(context.Background())
+		if err != nil {
+			q.err = err
+			close(q.done)
+			return
+		}
+		go q.acceptFirstStream(session)
 	}
+}
 
-	qconn := &QuicConn{
-		conn:   q.conn,
-		qconn:  conn,
-		stream: stream,
+func (q *QuicListener) acceptFirstStream(session *QuicSession) {
+	timeout := q.StreamAcceptTimeout
+	if timeout <= 0 {
+		timeout = DefaultQuicStreamAcceptTimeout
 	}
+	ctx, cancel := context.WithTimeout(session.Context(), timeout)
+	defer cancel()
+	qconn, err := session.AcceptStream(ctx)
+	if err != nil {
+		_ = session.CloseWithError(0, "no stream")
+		return
+	}
+	select {
+	case q.streams <- qconn:
+	case <-q.done:
+		_ = qconn.Close()
+	}
+}
 
-	return qconn, nil
+// AcceptSession waits for and returns the next QUIC connection, the streams are accepted by the caller
+// (等待并返回下一个QUIC连接，由调用方accept其上的流)
+func (q *QuicListener) AcceptSession(ctx context.Context) (*QuicSession, error) {
+	conn, err := q.quicServer.Accept(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return newQuicSession(conn), nil
 }
 
 // Close closes the listener.
@@ -0,0 +1,277 @@
+package sbus
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/wwengg/threego/core/sconfig"
+	"github.com/wwengg/threego/core/slog"
+	"github.com/wwengg/threego/core/smsg"
+	"github.com/wwengg/threego/core/utils"
+)
+
+// quicRouter replies the stream ID to the stream msgs and the connID to the datagrams
+// (流消息回复流ID，datagram回复连接ID)
+type quicRouter struct {
+	BaseRouter
+}
+
+func (r *quicRouter) Handle(task STask) error {
+	conn := task.GetConnection()
+	if datagram, _ := task.Get(TaskKeyDatagram); datagram == true {
+		session, _ := QuicSessionOf(conn)
+		return session.SendDatagramMsg(conn.GetDatapack(), NewNSQMsg(task.GetCmd(), RetOK, smsg.SerializeNone, nil, []byte(conn.GetConnIdStr())))
+	}
+	streamID, _ := task.Get(TaskKeyStreamID)
+	return conn.SendBuffMsg(NewNSQMsg(task.GetCmd(), RetOK, smsg.SerializeNone, nil, []byte(fmt.Sprint(streamID))))
+}
+
+type quicClient struct {
+	t     *testing.T
+	qconn quic.Connection
+	dp    SDataPack
+}
+
+func (c *quicClient) openStream() quic.Stream {
+	c.t.Helper()
+	stream, err := c.qconn.OpenStreamSync(context.Background())
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return stream
+}
+
+// call sends a msg on the stream and returns the data of the response (在流上发送消息并返回响应的数据)
+func (c *quicClient) call(stream quic.Stream) string {
+	c.t.Helper()
+	msg := NewNSQMsg(9, 0, smsg.SerializeNone, nil, nil)
+	msg.SetHasFrameDecoder(true)
+	data, err := c.dp.Pack(msg)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if _, err := stream.Write(data); err != nil {
+		c.t.Fatal(err)
+	}
+	decoder := NewLengthFieldFrameDecoder(TcpLengthField())
+	buf := make([]byte, 1024)
+	_ = stream.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		n, err := stream.Read(buf)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		frames, err := decoder.Decode(buf[:n])
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		if len(frames) > 0 {
+			resp, err := c.dp.Unpack(frames[0])
+			if err != nil {
+				c.t.Fatal(err)
+			}
+			return string(resp.GetData())
+		}
+	}
+}
+
+// datagram sends a datagram until a reply arrives, the datagrams may be lost
+// (发送datagram直到收到回复，datagram可能丢失)
+func (c *quicClient) datagram(timeout time.Duration) (string, bool) {
+	c.t.Helper()
+	data, err := c.dp.Pack(NewNSQMsg(9, 0, smsg.SerializeNone, nil, nil))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if err := c.qconn.SendDatagram(data); err != nil {
+			c.t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		reply, err := c.qconn.ReceiveDatagram(ctx)
+		cancel()
+		if err != nil {
+			continue
+		}
+		resp, err := c.dp.Unpack(reply)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		return string(resp.GetData()), true
+	}
+	return "", false
+}
+
+func waitConnLen(t *testing.T, connMgr SConnManager, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for connMgr.Len() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected connections %d, want %d", connMgr.Len(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestQuicMultiStream(t *testing.T) {
+	slog.NewZapLog(&sconfig.Slog{Director: t.TempDir(), Level: "error"})
+	tlsConf, err := utils.GenerateTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer("quic", "udp", "127.0.0.1", 0, WithQuic(tlsConf, &quic.Config{EnableDatagrams: true}), WithQuicMultiStream())
+	s.AddRouter(9, &quicRouter{})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	qconn, err := quic.DialAddr(context.Background(), s.Addr().String(),
+		&tls.Config{InsecureSkipVerify: true, NextProtos: tlsConf.NextProtos}, &quic.Config{EnableDatagrams: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qconn.CloseWithError(0, "")
+	c := &quicClient{t: t, qconn: qconn, dp: NewTcpDataPack()}
+
+	// every stream is a connection of its own and the msgs are tagged with the stream ID
+	// (每个流都是独立的连接，消息带有流ID)
+	first, second := c.openStream(), c.openStream()
+	for _, stream := range []quic.Stream{first, second} {
+		if got, want := c.call(stream), fmt.Sprint(stream.StreamID()); got != want {
+			t.Fatalf("unexpected stream ID %s, want %s", got, want)
+		}
+	}
+	waitConnLen(t, s.GetConnMgr(), 2)
+
+	// the datagrams are dispatched by the connection of the first stream (datagram由第一个流的连接分发)
+	firstID, ok := c.datagram(time.Second)
+	if !ok {
+		t.Fatal("no reply to the datagram")
+	}
+
+	// closing a stream stops its connection only, the next stream takes over the datagrams
+	// (关闭一个流只会停止其连接，下一个流接管datagram)
+	first.CancelRead(0)
+	_ = first.Close()
+	waitConnLen(t, s.GetConnMgr(), 1)
+	third := c.openStream()
+	if got, want := c.call(third), fmt.Sprint(third.StreamID()); got != want {
+		t.Fatalf("unexpected stream ID %s, want %s", got, want)
+	}
+	if id, ok := c.datagram(time.Second); !ok || id == firstID {
+		t.Fatalf("the datagram is dispatched by connID %q of the closed stream, replied %v", id, ok)
+	}
+
+	// closing the QUIC connection stops all its stream connections (关闭QUIC连接会停止其所有流的连接)
+	_ = qconn.CloseWithError(0, "")
+	waitConnLen(t, s.GetConnMgr(), 0)
+}
+
+func TestQuicListenerAcceptWithoutStream(t *testing.T) {
+	slog.NewZapLog(&sconfig.Slog{Director: t.TempDir(), Level: "error"})
+	tlsConf, err := utils.GenerateTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer("quic", "udp", "127.0.0.1", 0, WithQuic(tlsConf, nil))
+	s.AddRouter(9, &quicRouter{})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	dial := func() *quicClient {
+		qconn, err := quic.DialAddr(context.Background(), s.Addr().String(),
+			&tls.Config{InsecureSkipVerify: true, NextProtos: tlsConf.NextProtos}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = qconn.CloseWithError(0, "") })
+		return &quicClient{t: t, qconn: qconn, dp: NewTcpDataPack()}
+	}
+	// a client that never opens a stream does not block the next one (从不打开流的客户端不会阻塞下一个客户端)
+	dial()
+	c := dial()
+	stream := c.openStream()
+	if got, want := c.call(stream), fmt.Sprint(stream.StreamID()); got != want {
+		t.Fatalf("unexpected stream ID %s, want %s", got, want)
+	}
+}
+
+func TestQuicRateLimitDatagramAndStream(t *testing.T) {
+	slog.NewZapLog(&sconfig.Slog{Director: t.TempDir(), Level: "error"})
+	tlsConf, err := utils.GenerateTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer("quic", "udp", "127.0.0.1", 0, WithQuic(tlsConf, &quic.Config{EnableDatagrams: true}),
+		WithQuicMultiStream(), WithConnOptions(WithRateLimit(NewRateLimiter(WithConnRate(0.001, 1)))))
+	s.AddRouter(9, &quicRouter{})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	qconn, err := quic.DialAddr(context.Background(), s.Addr().String(),
+		&tls.Config{InsecureSkipVerify: true, NextProtos: tlsConf.NextProtos}, &quic.Config{EnableDatagrams: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qconn.CloseWithError(0, "")
+	c := &quicClient{t: t, qconn: qconn, dp: NewTcpDataPack()}
+	stream := c.openStream()
+	c.call(stream)
+	waitConnLen(t, s.GetConnMgr(), 1)
+
+	// the reader and the datagram loop check the limit of the same connection at the same time
+	// (读协程与datagram循环同时检查同一个连接的限制)
+	const n = 50
+	streamMsg := NewNSQMsg(9, 0, smsg.SerializeNone, nil, nil)
+	streamMsg.SetHasFrameDecoder(true)
+	streamData, err := c.dp.Pack(streamMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	datagramData, err := c.dp.Pack(NewNSQMsg(9, 0, smsg.SerializeNone, nil, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < n; i++ {
+			if err := qconn.SendDatagram(datagramData); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	for i := 0; i < n; i++ {
+		if _, err := stream.Write(streamData); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// the datagrams may be lost, so only a part of them is required (datagram可能丢失，只要求收到一部分)
+	conn, err := s.GetConnMgr().Get(s.GetConnMgr().GetAllConnID()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := conn.(*Connection).rateLimit
+	deadline := time.Now().Add(2 * time.Second)
+	for cl.violations.Load() <= n {
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected violations %d, want more than %d", cl.violations.Load(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,176 @@
+package sbus
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/wwengg/threego/core/sconfig"
+	"github.com/wwengg/threego/core/slog"
+	"github.com/wwengg/threego/core/utils"
+)
+
+// RateLimitAction decides what happens to a message over the limit (超出限制的消息的处理方式)
+type RateLimitAction int
+
+const (
+	RateLimitDrop  RateLimitAction = iota // Drop the message (丢弃消息)
+	RateLimitReply                        // Drop the message and reply RetRateLimited (丢弃消息并回复RetRateLimited)
+)
+
+// RetRateLimited is the Ret of the response replied to the message over the limit (超出限制的消息的响应Ret)
+const RetRateLimited uint16 = 429
+
+var ErrRateLimited = errors.New("rate limited")
+
+type rateSpec struct {
+	rate  float64
+	burst int
+}
+
+// RateLimiter is the token bucket config shared by the connections, every connection gets buckets of its own
+// through WithRateLimit (连接共享的令牌桶配置，每个连接通过WithRateLimit获得自己的令牌桶)
+type RateLimiter struct {
+	conn            rateSpec
+	msgs            map[int32]rateSpec
+	action          RateLimitAction
+	disconnectAfter int
+	banDuration     time.Duration
+}
+
+type RateLimitOption func(l *RateLimiter)
+
+// WithConnRate limits the messages of a connection to rate per second with burst, rate 0 means no limit
+// (限制每个连接每秒rate个消息，突发burst个，rate为0表示不限制)
+func WithConnRate(rate float64, burst int) RateLimitOption {
+	return func(l *RateLimiter) {
+		l.conn = rateSpec{rate: rate, burst: burst}
+	}
+}
+
+// WithMsgRate limits the messages of msgID of a connection to rate per second with burst
+// (限制每个连接msgID的消息每秒rate个，突发burst个)
+func WithMsgRate(msgID int32, rate float64, burst int) RateLimitOption {
+	return func(l *RateLimiter) {
+		l.msgs[msgID] = rateSpec{rate: rate, burst: burst}
+	}
+}
+
+// WithRateLimitAction sets what happens to a message over the limit (设置超出限制的消息的处理方式)
+func WithRateLimitAction(action RateLimitAction) RateLimitOption {
+	return func(l *RateLimiter) {
+		l.action = action
+	}
+}
+
+// WithDisconnectAfter stops the connection after n messages over the limit, and bans its IP for banDuration
+// in the blacklist of the ConnManager if both are positive
+// (连接超出限制n次后停止连接，banDuration大于0且ConnManager有黑名单时将其IP封禁banDuration)
+func WithDisconnectAfter(n int, banDuration time.Duration) RateLimitOption {
+	return func(l *RateLimiter) {
+		l.disconnectAfter = n
+		l.banDuration = banDuration
+	}
+}
+
+func NewRateLimiter(opts ...RateLimitOption) *RateLimiter {
+	l := &RateLimiter{msgs: make(map[int32]rateSpec)}
+	for _, opt := range opts {
+		opt(l)
+	}
+	return l
+}
+
+// NewRateLimiterByConf creates the RateLimiter, nil is returned if no rate is configured, an unknown
+// action is an error (根据配置创建RateLimiter，没有配置任何速率时返回nil，未知的action返回错误)
+func NewRateLimiterByConf(conf sconfig.RateLimit) (*RateLimiter, error) {
+	action := RateLimitDrop
+	switch conf.Action {
+	case "", "drop":
+	case "reply":
+		action = RateLimitReply
+	default:
+		return nil, fmt.Errorf("sbus: unknown rate limit action %q", conf.Action)
+	}
+	if conf.ConnRate <= 0 && len(conf.MsgLimits) == 0 {
+		return nil, nil
+	}
+	opts := []RateLimitOption{
+		WithConnRate(conf.ConnRate, conf.ConnBurst),
+		WithRateLimitAction(action),
+		WithDisconnectAfter(conf.DisconnectAfter, time.Duration(conf.BanMilli)*time.Millisecond),
+	}
+	for _, ml := range conf.MsgLimits {
+		opts = append(opts, WithMsgRate(ml.MsgID, ml.Rate, ml.Burst))
+	}
+	return NewRateLimiter(opts...), nil
+}
+
+// WithRateLimit gives the connection its own token buckets of the limiter, the limit is checked by the
+// reader and the QUIC datagram loop before the message is sent to the TaskHandler, nil means no limit
+// (为连接创建limiter的令牌桶，读协程与QUIC datagram循环在将消息交给TaskHandler之前检查限制，nil表示不限制)
+func WithRateLimit(limiter *RateLimiter) ConnOption {
+	return func(c *Connection) {
+		if limiter != nil {
+			c.rateLimit = limiter.newConnLimit()
+		}
+	}
+}
+
+// connLimit is the state of a connection, it is used by the reader and the QUIC datagram loop at the same
+// time, msgs is not changed after it is created and the token buckets lock themselves
+// (连接的限流状态，读协程与QUIC datagram循环会同时使用，msgs创建之后不再修改，令牌桶自身带锁)
+type connLimit struct {
+	limiter    *RateLimiter
+	conn       *utils.TokenBucket
+	msgs       map[int32]*utils.TokenBucket
+	violations atomic.Int64
+}
+
+func (l *RateLimiter) newConnLimit() *connLimit {
+	cl := &connLimit{limiter: l, msgs: make(map[int32]*utils.TokenBucket, len(l.msgs))}
+	if l.conn.rate > 0 {
+		cl.conn = utils.NewTokenBucket(l.conn.rate, l.conn.burst)
+	}
+	for msgID, spec := range l.msgs {
+		cl.msgs[msgID] = utils.NewTokenBucket(spec.rate, spec.burst)
+	}
+	return cl
+}
+
+func (cl *connLimit) allow(msgID int32) bool {
+	if b, ok := cl.msgs[msgID]; ok && !b.Allow() {
+		return false
+	}
+	return cl.conn == nil || cl.conn.Allow()
+}
+
+// checkRateLimit returns false if msg is over the limit, it has been dropped or replied then,
+// and the connection is stopped after too many violations
+// (msg超出限制时返回false，此时消息已经被丢弃或回复，超出次数过多时停止连接)
+func (bc *Connection) checkRateLimit(msg SMsg) bool {
+	cl := bc.rateLimit
+	if cl == nil || cl.allow(msg.GetMsgId()) {
+		return true
+	}
+	violations := cl.violations.Add(1)
+	slog.Ins().Debugf("connID = %d msgID = %d is rate limited, violations = %d", bc.ConnID, msg.GetMsgId(), violations)
+
+	l := cl.limiter
+	if l.action == RateLimitReply {
+		if err := bc.SendBuffMsg(NewErrorResponseMsg(msg, RetRateLimited, ErrRateLimited.Error())); err != nil {
+			slog.Ins().Errorf("reply rate limited to connID = %d error: %s", bc.ConnID, err)
+		}
+	}
+	if l.disconnectAfter > 0 && violations >= int64(l.disconnectAfter) {
+		slog.Ins().Warnf("connID = %d is over the rate limit %d times, stop it", bc.ConnID, violations)
+		if l.banDuration > 0 && bc.connManager != nil {
+			if bl := bc.connManager.GetBlacklist(); bl != nil {
+				bl.Ban(bc.clientIP(), l.banDuration)
+			}
+		}
+		bc.Stop()
+	}
+	return false
+}
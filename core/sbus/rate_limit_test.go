@@ -0,0 +1,113 @@
+package sbus
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/wwengg/threego/core/sconfig"
+	"github.com/wwengg/threego/core/slog"
+	"github.com/wwengg/threego/core/smsg"
+)
+
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr { return c.remote }
+
+func TestConnectionRateLimit(t *testing.T) {
+	slog.NewZapLog(&sconfig.Slog{Director: t.TempDir(), Level: "error"})
+	blacklist, err := NewIPBlacklist("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	connMgr := NewConnManager(WithBlacklist(blacklist))
+	mh := NewTaskHandler(1, 16)
+	limiter := NewRateLimiter(
+		WithMsgRate(1, 0.001, 2),
+		WithRateLimitAction(RateLimitReply),
+		WithDisconnectAfter(2, time.Minute))
+
+	server, client := net.Pipe()
+	defer client.Close()
+	peer := &net.TCPAddr{IP: net.ParseIP("192.168.1.2"), Port: 5000}
+	conn := NewConnection(&addrConn{Conn: server, remote: peer}, 1, 0, mh, nil, nil, nil, NewTcpDataPack(), connMgr, 0, 0,
+		WithRateLimit(limiter)).(*Connection)
+
+	for i := 0; i < 4; i++ {
+		_ = conn.dispatchMsg(NewNSQMsg(1, 0, smsg.SerializeNone, nil, nil))
+	}
+	// msgID 2 has no limit of its own (msgID 2没有单独的限制)
+	_ = NewConnection(nil, 2, 0, mh, nil, nil, nil, NewTcpDataPack(), nil, 0, 0, WithRateLimit(limiter)).(*Connection).
+		dispatchMsg(NewNSQMsg(2, 0, smsg.SerializeNone, nil, nil))
+
+	if mh.QueueLen() != 3 {
+		t.Fatalf("queued %d tasks, want 3", mh.QueueLen())
+	}
+	for i := 0; i < 2; i++ {
+		resp, err := conn.Datapack.Unpack(<-conn.msgBuffChan)
+		if err != nil || resp.GetRet() != RetRateLimited {
+			t.Fatalf("unexpected reply %+v, %v", resp, err)
+		}
+	}
+	if conn.Context().Err() == nil {
+		t.Fatal("the connection is not stopped after 2 violations")
+	}
+	if !connMgr.IsBlocked(peer.IP) || !connMgr.IsBlocked(net.ParseIP("10.1.2.3")) || connMgr.IsBlocked(net.ParseIP("192.168.1.3")) {
+		t.Fatal("unexpected blacklist")
+	}
+	blacklist.Remove("192.168.1.2")
+	if connMgr.IsBlocked(peer.IP) {
+		t.Fatal("the removed IP is still blocked")
+	}
+}
+
+func TestRateLimitBanClientIP(t *testing.T) {
+	slog.NewZapLog(&sconfig.Slog{Director: t.TempDir(), Level: "error"})
+	// the blacklist of the conf is applied to the ConnManager passed by the caller
+	// (配置文件中的黑名单会应用到调用方传入的ConnManager上)
+	connMgr := NewConnManager()
+	s := NewServerByConf(sconfig.Sbus{RateLimit: sconfig.RateLimit{Blacklist: []string{"10.0.0.0/8"}, BanMilli: 60000}},
+		WithConnManager(connMgr))
+	if s.GetConnMgr() != connMgr || !connMgr.IsBlocked(net.ParseIP("10.1.2.3")) {
+		t.Fatal("the conf blacklist is not applied to the caller's ConnManager")
+	}
+
+	// behind a proxy the client IP is banned instead of the proxy IP (代理之后封禁的是客户端IP而不是代理IP)
+	mh := NewTaskHandler(1, 16)
+	limiter := NewRateLimiter(WithMsgRate(1, 0.001, 1), WithDisconnectAfter(1, time.Minute))
+	server, client := net.Pipe()
+	defer client.Close()
+	proxy := &net.TCPAddr{IP: net.ParseIP("192.168.1.2"), Port: 5000}
+	conn := NewConnection(&addrConn{Conn: server, remote: proxy}, 1, 0, mh, nil, nil, nil, NewTcpDataPack(), connMgr, 0, 0,
+		WithRateLimit(limiter)).(*Connection)
+	conn.SetProperty(PropertyKeyClientIP, "203.0.113.7")
+	for i := 0; i < 2; i++ {
+		_ = conn.dispatchMsg(NewNSQMsg(1, 0, smsg.SerializeNone, nil, nil))
+	}
+	if conn.Context().Err() == nil {
+		t.Fatal("the connection is not stopped after the violation")
+	}
+	if !connMgr.IsBlocked(net.ParseIP("203.0.113.7")) || connMgr.IsBlocked(proxy.IP) {
+		t.Fatal("the ban does not use the client IP")
+	}
+}
+
+func TestRateLimitInvalidConf(t *testing.T) {
+	slog.NewZapLog(&sconfig.Slog{Director: t.TempDir(), Level: "error"})
+	// the invalid config is returned by Start instead of a panic (配置错误由Start返回而不是panic)
+	for _, conf := range []sconfig.RateLimit{
+		{Blacklist: []string{"10.0.0.0/33"}},
+		{Blacklist: []string{"not an ip"}},
+		{ConnRate: 10, Action: "kick"},
+		{Action: "kick"},
+	} {
+		s := NewServerByConf(sconfig.Sbus{Host: "127.0.0.1", RateLimit: conf})
+		if err := s.Start(); err == nil {
+			s.Stop()
+			t.Fatalf("expected the error of %+v", conf)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package sbus
+
+import (
+	"fmt"
+)
+
+// RouterGroup registers the routers of a msgID range, such as the msgIDs of a module, with the shared middlewares
+// (注册某个msgID区间的路由，例如一个模块的msgID，并共享中间件)
+type RouterGroup struct {
+	handler STaskHandler
+	// the msgID range [start, end] (msgID区间[start, end])
+	start, end  int32
+	middlewares []MiddlewareFunc
+}
+
+// NewRouterGroup creates a group of the msgID range [start, end], it panics if start > end
+// (创建msgID区间为[start, end]的路由组，start > end时panic)
+func NewRouterGroup(handler STaskHandler, start, end int32, middlewares ...MiddlewareFunc) *RouterGroup {
+	if start > end {
+		panic(fmt.Sprintf("sbus: invalid router group range [%d, %d]", start, end))
+	}
+	return &RouterGroup{
+		handler:     handler,
+		start:       start,
+		end:         end,
+		middlewares: middlewares,
+	}
+}
+
+// Group creates a sub group inside the range of g, the middlewares of g run before its own
+// (在g的区间内创建子路由组，g的中间件在子路由组的中间件之前执行)
+func (g *RouterGroup) Group(start, end int32, middlewares ...MiddlewareFunc) *RouterGroup {
+	if start < g.start || end > g.end {
+		panic(fmt.Sprintf("sbus: router group range [%d, %d] is out of [%d, %d]", start, end, g.start, g.end))
+	}
+	combined := make([]MiddlewareFunc, 0, len(g.middlewares)+len(middlewares))
+	combined = append(combined, g.middlewares...)
+	return NewRouterGroup(g.handler, start, end, append(combined, middlewares...)...)
+}
+
+// Use adds the middlewares for the routers added after it (为之后添加的路由添加中间件)
+func (g *RouterGroup) Use(middlewares ...MiddlewareFunc) {
+	g.middlewares = append(g.middlewares, middlewares...)
+}
+
+// AddRouter adds the router with the middlewares of the group, it panics if msgID is out of the range
+// (添加路由以及路由组的中间件，msgID不在区间内时panic)
+func (g *RouterGroup) AddRouter(msgID int32, router SRouter) {
+	if msgID < g.start || msgID > g.end {
+		panic(fmt.Sprintf("sbus: msgID = %d is out of the router group [%d, %d]", msgID, g.start, g.end))
+	}
+	g.handler.AddRouter(msgID, router)
+	if len(g.middlewares) > 0 {
+		g.handler.UseWithMsgID(msgID, g.middlewares...)
+	}
+}
+
+// Handle adds the function handler, see NewFuncRouter (添加函数式处理函数，参见NewFuncRouter)
+func (g *RouterGroup) Handle(msgID int32, fn interface{}) {
+	g.AddRouter(msgID, NewFuncRouter(fn))
+}
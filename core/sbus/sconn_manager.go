@@ -1,5 +1,7 @@
 package sbus
 
+import "net"
+
 type SConnManager interface {
 	Add(SConnection)                                                        // Add connection
 	Remove(SConnection)                                                     // Remove connection
@@ -11,4 +13,22 @@ type SConnManager interface {
 	GetAllConnIdStr() []string                                              // Get all string connection IDs
 	Range(func(uint64, SConnection, interface{}) error, interface{}) error  // Traverse all connections
 	Range2(func(string, SConnection, interface{}) error, interface{}) error // Traverse all connections 2
+	AddIndex(key string)                                                    // Index the property key (为属性key建立索引)
+	FindByProperty(key string, value any) []SConnection                     // Find the connections by an indexed property (按已索引的属性查找连接)
+	OnPropertyChange(conn SConnection, key string, oldValue, newValue any)  // Called by the connection to update the indexes (由连接调用以更新索引)
+	BindUser(conn SConnection, uid, device string) error                    // Bind the user to the connection after login (登录后将用户绑定到连接)
+	UnbindUser(conn SConnection)                                            // Unbind the user from the connection (解除连接绑定的用户)
+	GetUserConns(uid string) []SConnection                                  // Get the connections of every device of the user (获取用户所有设备的连接)
+	GetUserConn(uid, device string) (SConnection, error)                    // Get the connection of the device of the user (获取用户某个设备的连接)
+	AddUserHooks(onBind, onUnbind UserBindHook)                             // Add the hooks called after a user is bound or unbound (添加用户绑定或解绑后调用的钩子)
+	Kick(conn SConnection, reason string)                                   // Send the reason to the connection and stop it (向连接发送原因并停止连接)
+	JoinGroup(conn SConnection, group string) error                         // Add the connection to the group (将连接加入分组)
+	LeaveGroup(conn SConnection, group string)                              // Remove the connection from the group (将连接移出分组)
+	GetGroupConns(group string) []SConnection                               // Get the connections of the group (获取分组中的连接)
+	GetConnGroups(conn SConnection) []string                                // Get the groups joined by the connection (获取连接加入的分组)
+	Broadcast(msg SMsg) error                                               // Send the msg to all connections (向所有连接发送msg)
+	BroadcastToGroup(group string, msg SMsg, exclude ...uint64) error       // Send the msg to the group except the excluded connIDs (向分组中除排除的connID以外的连接发送msg)
+	Multicast(connIDs []uint64, msg SMsg) error                             // Send the msg to the connIDs (向指定connID发送msg)
+	GetBlacklist() *IPBlacklist                                             // Get the blacklist, nil if there is none (获取黑名单)
+	IsBlocked(ip net.IP) bool                                               // Check the remote IP on accept (accept时检查远端IP)
 }
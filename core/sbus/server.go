@@ -0,0 +1,580 @@
+package sbus
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/wwengg/threego/core/sconfig"
+	"github.com/wwengg/threego/core/slog"
+	"github.com/wwengg/threego/core/utils"
+)
+
+const (
+	DefaultWorkerPoolSize uint32 = 10
+	DefaultMaxTaskChanLen uint32 = 1024
+	DefaultIOReadBuffSize uint32 = 4096
+)
+
+// connIDSeq is shared by all servers in the process, so connections from different listeners
+// never collide in the same ConnManager
+// (进程内所有服务器共用，保证不同监听器的连接在同一个ConnManager中不会冲突)
+var connIDSeq uint64
+
+// NextConnID returns the next monotonically increasing connection ID
+// (返回下一个单调递增的连接ID)
+func NextConnID() uint64 {
+	return atomic.AddUint64(&connIDSeq, 1)
+}
+
+type ServerOption func(s *Server)
+
+func WithConnManager(connMgr SConnManager) ServerOption {
+	return func(s *Server) {
+		s.connMgr = connMgr
+	}
+}
+
+func WithTaskHandler(taskHandler STaskHandler) ServerOption {
+	return func(s *Server) {
+		s.taskHandler = taskHandler
+	}
+}
+
+func WithDataPack(datapack SDataPack) ServerOption {
+	return func(s *Server) {
+		s.datapack = datapack
+	}
+}
+
+// WithFrameDecoder sets the frame decoder factory, every connection gets its own decoder
+// because the decoder buffers partial frames
+// (设置断粘包解码器工厂，解码器会缓存半包数据，所以每个连接单独创建一个)
+func WithFrameDecoder(newFrameDecoder func() SFrameDecoder) ServerOption {
+	return func(s *Server) {
+		s.newFrameDecoder = newFrameDecoder
+	}
+}
+
+// WithLengthFieldFrameDecoder gives every connection a LengthFieldFrameDecoder built from lf
+// (每个连接使用lf创建的LengthFieldFrameDecoder)
+func WithLengthFieldFrameDecoder(lf LengthField) ServerOption {
+	return WithFrameDecoder(func() SFrameDecoder {
+		return NewLengthFieldFrameDecoder(lf)
+	})
+}
+
+// WithConnOptions sets the options applied to every connection accepted by the server
+// (设置服务器接收的每个连接所使用的选项)
+func WithConnOptions(opts ...ConnOption) ServerOption {
+	return func(s *Server) {
+		s.connOpts = append(s.connOpts, opts...)
+	}
+}
+
+func WithOnConnStart(onConnStart func(conn SConnection)) ServerOption {
+	return func(s *Server) {
+		s.onConnStart = onConnStart
+	}
+}
+
+func WithOnConnStop(onConnStop func(conn SConnection)) ServerOption {
+	return func(s *Server) {
+		s.onConnStop = onConnStop
+	}
+}
+
+func WithMaxConn(maxConn int) ServerOption {
+	return func(s *Server) {
+		s.MaxConn = maxConn
+	}
+}
+
+func WithIOReadBuffSize(size uint32) ServerOption {
+	return func(s *Server) {
+		s.IOReadBuffSize = size
+	}
+}
+
+func WithHeartbeatMax(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.HeartbeatMax = d
+	}
+}
+
+// WithHeartbeat enables the heartbeat detection for every connection, option can be nil to use the defaults
+// (为每个连接开启心跳检测，option为nil时使用默认值)
+func WithHeartbeat(interval time.Duration, option *HeartBeatOption) ServerOption {
+	return func(s *Server) {
+		s.hc = NewHeartbeatCheckerWithOption(interval, option)
+		s.heartbeatInterval = interval
+	}
+}
+
+// WithQuic makes the server listen on QUIC instead of tcp, every QUIC connection carries one stream
+// unless WithQuicMultiStream is set, set EnableDatagrams in quicConf to receive the datagrams
+// (服务端监听QUIC而不是tcp，除非设置了WithQuicMultiStream，否则每个QUIC连接只承载一个流，
+// 需要接收datagram时在quicConf中设置EnableDatagrams)
+func WithQuic(tlsConf *tls.Config, quicConf *quic.Config) ServerOption {
+	return func(s *Server) {
+		s.quicTLSConf = tlsConf
+		s.quicConf = quicConf
+	}
+}
+
+// WithQuicMultiStream makes every stream of a QUIC connection a sbus connection of its own,
+// such as a control stream and several data streams, the stream ID is set in the task by TaskKeyStreamID
+// (QUIC连接的每个流都作为独立的sbus连接，例如一个控制流加多个数据流，流ID通过TaskKeyStreamID设置到任务中)
+func WithQuicMultiStream() ServerOption {
+	return func(s *Server) {
+		s.quicMultiStream = true
+	}
+}
+
+type Server struct {
+	Name      string
+	IPVersion string
+	IP        string
+	Port      int
+	// The maximum number of connections, 0 means unlimited
+	// (最大连接数，0表示不限制)
+	MaxConn        int
+	IOReadBuffSize uint32
+	HeartbeatMax   time.Duration
+
+	taskHandler     STaskHandler
+	connMgr         SConnManager
+	datapack        SDataPack
+	newFrameDecoder func() SFrameDecoder
+	connOpts        []ConnOption
+
+	// the heartbeat checker cloned for every connection (为每个连接克隆的心跳检测器)
+	hc                SHeartbeatChecker
+	heartbeatInterval time.Duration
+
+	onConnStart func(conn SConnection)
+	onConnStop  func(conn SConnection)
+
+	ln net.Listener
+
+	// the TLS of the tcp listener (tcp监听的TLS)
+	tlsConf             *tls.Config
+	certReloader        *CertReloader
+	tlsHandshakeTimeout time.Duration
+
+	quicTLSConf     *tls.Config
+	quicConf        *quic.Config
+	quicMultiStream bool
+	// the udp socket of the QUIC listener (QUIC监听的udp套接字)
+	packetConn net.PacketConn
+
+	// the first error of the options and the config, returned by Start (选项以及配置的第一个错误，由Start返回)
+	confErr error
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// wait for the accept loop, the TLS handshakes and the QUIC sessions to exit, so no connection is
+	// started after it (等待accept循环、TLS握手以及QUIC会话退出，之后不会再启动连接)
+	wg sync.WaitGroup
+	// wait for the started connections to finish stopping (等待已启动的连接停止完成)
+	connWg   sync.WaitGroup
+	stopOnce sync.Once
+}
+
+func NewServer(name, ipVersion, ip string, port int, opts ...ServerOption) *Server {
+	s := &Server{
+		Name:           name,
+		IPVersion:      ipVersion,
+		IP:             ip,
+		Port:           port,
+		IOReadBuffSize: DefaultIOReadBuffSize,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if s.IPVersion == "" {
+		s.IPVersion = "tcp"
+	}
+	if s.IOReadBuffSize == 0 {
+		s.IOReadBuffSize = DefaultIOReadBuffSize
+	}
+	if s.hc != nil && s.HeartbeatMax <= 0 {
+		// A connection is considered dead after missing 3 heartbeats by default
+		// (默认连续3个心跳周期没有活动则认为连接已经死亡)
+		s.HeartbeatMax = 3 * s.heartbeatInterval
+	}
+	if s.taskHandler == nil {
+		s.taskHandler = NewTaskHandler(DefaultWorkerPoolSize, DefaultMaxTaskChanLen)
+	}
+	if s.connMgr == nil {
+		s.connMgr = NewConnManager()
+	}
+	if s.datapack == nil {
+		// TcpDataPack pairs with the LengthFieldFrameDecoder by default
+		// (TcpDataPack默认搭配LengthFieldFrameDecoder使用)
+		s.datapack = NewTcpDataPack()
+		if s.newFrameDecoder == nil {
+			s.newFrameDecoder = func() SFrameDecoder {
+				return NewLengthFieldFrameDecoder(TcpLengthField())
+			}
+		}
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	return s
+}
+
+func NewServerByConf(conf sconfig.Sbus, opts ...ServerOption) *Server {
+	workerPoolSize := conf.WorkerPoolSize
+	if workerPoolSize == 0 {
+		workerPoolSize = DefaultWorkerPoolSize
+	}
+	maxTaskChanLen := conf.MaxTaskChanLen
+	if maxTaskChanLen == 0 {
+		maxTaskChanLen = DefaultMaxTaskChanLen
+	}
+	var taskHandlerOpts []TaskHandlerOption
+	if conf.OrderedDispatch {
+		taskHandlerOpts = append(taskHandlerOpts, WithOrderedDispatch(nil))
+	}
+	if conf.EnqueueTimeoutMilli > 0 {
+		taskHandlerOpts = append(taskHandlerOpts, WithOverloadPolicy(OverloadBlock, time.Duration(conf.EnqueueTimeoutMilli)*time.Millisecond))
+	}
+	if conf.MaxWorkerPoolSize > workerPoolSize && conf.WorkerIdleMilli > 0 {
+		taskHandlerOpts = append(taskHandlerOpts, WithWorkerScaling(workerPoolSize, conf.MaxWorkerPoolSize, time.Duration(conf.WorkerIdleMilli)*time.Millisecond))
+	}
+	confOpts := []ServerOption{
+		WithTaskHandler(NewTaskHandler(workerPoolSize, maxTaskChanLen, taskHandlerOpts...)),
+		WithMaxConn(conf.MaxConn),
+		WithIOReadBuffSize(conf.IOReadBuffSize),
+		WithHeartbeatMax(time.Duration(conf.HeartbeatMaxMilli) * time.Millisecond),
+	}
+	if conf.ReaderIdleMilli > 0 || conf.WriterIdleMilli > 0 || conf.AllIdleMilli > 0 {
+		confOpts = append(confOpts, WithConnOptions(WithIdleTimeout(
+			time.Duration(conf.ReaderIdleMilli)*time.Millisecond,
+			time.Duration(conf.WriterIdleMilli)*time.Millisecond,
+			time.Duration(conf.AllIdleMilli)*time.Millisecond)))
+	}
+	if conf.WriteTimeoutMilli > 0 {
+		confOpts = append(confOpts, WithConnOptions(WithWriteTimeout(time.Duration(conf.WriteTimeoutMilli)*time.Millisecond)))
+	}
+	limiter, limitErr := NewRateLimiterByConf(conf.RateLimit)
+	if limiter != nil {
+		confOpts = append(confOpts, WithConnOptions(WithRateLimit(limiter)))
+	}
+	if conf.Encryption.Enable {
+		msgID := conf.Encryption.HandshakeMsgID
+		if msgID == 0 {
+			msgID = EncryptionDefaultMsgID
+		}
+		confOpts = append(confOpts, WithConnOptions(WithEncryption(msgID, conf.Encryption.Required)))
+	}
+	if conf.TLS.Enable {
+		certPath, keyPath := conf.TLS.CertPath, conf.TLS.KeyPath
+		if certPath == "" && keyPath == "" {
+			certPath, keyPath = sconfig.S_CONF.CertPath, sconfig.S_CONF.KeyPath
+		}
+		confOpts = append(confOpts, WithTLSFiles(certPath, keyPath, conf.TLS.ClientCAPath),
+			WithTLSHandshakeTimeout(time.Duration(conf.TLS.HandshakeTimeoutMilli)*time.Millisecond))
+	}
+	// options passed by the caller take precedence over the config
+	// (调用方传入的选项优先于配置文件)
+	s := NewServer(conf.Name, conf.IPVersion, conf.Host, conf.Port, append(confOpts, opts...)...)
+	s.setConfErr(limitErr)
+	if len(conf.RateLimit.Blacklist) > 0 || conf.RateLimit.BanMilli > 0 {
+		s.setConfErr(applyBlacklist(s.connMgr, conf.RateLimit.Blacklist))
+	}
+	return s
+}
+
+// applyBlacklist adds the entries to the blacklist of connMgr, which may be passed by the caller with
+// WithConnManager, a blacklist is created if it has none
+// (将条目添加到connMgr的黑名单中，connMgr可能由调用方通过WithConnManager传入，没有黑名单时创建一个)
+func applyBlacklist(connMgr SConnManager, entries []string) error {
+	cm, ok := connMgr.(*ConnManager)
+	if !ok {
+		return fmt.Errorf("sbus: the rate-limit blacklist needs a *ConnManager, got %T", connMgr)
+	}
+	if cm.blacklist == nil {
+		cm.blacklist, _ = NewIPBlacklist()
+	}
+	for _, entry := range entries {
+		if err := cm.blacklist.Add(entry); err != nil {
+			return fmt.Errorf("sbus: invalid rate-limit blacklist: %w", err)
+		}
+	}
+	return nil
+}
+
+// withConfErr is the option of an invalid config, the error is returned by Start
+// (无效配置的选项，错误由Start返回)
+func withConfErr(err error) ServerOption {
+	return func(s *Server) {
+		s.setConfErr(err)
+	}
+}
+
+// setConfErr keeps the first error of the options and the config for Start
+// (为Start保留选项以及配置的第一个错误)
+func (s *Server) setConfErr(err error) {
+	if s.confErr == nil {
+		s.confErr = err
+	}
+}
+
+// Start starts the worker pool and the accept loop, it does not block, the error of the options and the
+// config is returned before listening
+// (启动工作池以及accept循环，不阻塞，选项以及配置有错误时在监听之前返回)
+func (s *Server) Start() error {
+	if s.confErr != nil {
+		slog.Ins().Errorf("[%s] invalid config: %v", s.Name, s.confErr)
+		return s.confErr
+	}
+	addr := fmt.Sprintf("%s:%d", s.IP, s.Port)
+	ln, err := s.listen(addr)
+	if err != nil {
+		slog.Ins().Errorf("[%s] listen %s %s err: %v", s.Name, s.IPVersion, addr, err)
+		return err
+	}
+	s.ln = ln
+
+	s.taskHandler.StartWorkerPool()
+
+	s.wg.Add(1)
+	if ql, ok := ln.(*QuicListener); ok && s.quicMultiStream {
+		go s.acceptSessionLoop(ql)
+	} else {
+		go s.acceptLoop()
+	}
+
+	slog.Ins().Infof("[%s] start sbus server success, listening at %s", s.Name, ln.Addr().String())
+	return nil
+}
+
+func (s *Server) listen(addr string) (net.Listener, error) {
+	if s.quicTLSConf == nil {
+		ln, err := net.Listen(s.IPVersion, addr)
+		if err != nil || s.tlsConf == nil {
+			return ln, err
+		}
+		return tls.NewListener(ln, s.tlsConf), nil
+	}
+	network := s.IPVersion
+	if !strings.HasPrefix(network, "udp") {
+		network = "udp"
+	}
+	pc, err := net.ListenPacket(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := NewQuicListener(pc, s.quicTLSConf, s.quicConf)
+	if err != nil {
+		_ = pc.Close()
+		return nil, err
+	}
+	s.packetConn = pc
+	return ln, nil
+}
+
+func (s *Server) acceptLoop() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) || s.ctx.Err() != nil {
+				slog.Ins().Infof("[%s] accept loop exit", s.Name)
+				return
+			}
+			slog.Ins().Errorf("[%s] accept err: %v", s.Name, err)
+			// Back off on accept errors such as "too many open files"
+			// (accept出错时退避，例如文件句柄耗尽)
+			utils.AcceptDelay.Delay()
+			continue
+		}
+		utils.AcceptDelay.Reset()
+
+		if s.connMgr.IsBlocked(addrIP(conn.RemoteAddr())) {
+			slog.Ins().Debugf("[%s] %s is in the blacklist, close it", s.Name, conn.RemoteAddr().String())
+			_ = conn.Close()
+			continue
+		}
+		if s.MaxConn > 0 && s.connMgr.Len() >= s.MaxConn {
+			slog.Ins().Warnf("[%s] too many connections, MaxConn = %d, close %s", s.Name, s.MaxConn, conn.RemoteAddr().String())
+			_ = conn.Close()
+			continue
+		}
+
+		if tlsConn, ok := conn.(*tls.Conn); ok {
+			s.wg.Add(1)
+			go s.serveTLSConn(tlsConn)
+			continue
+		}
+		s.startConn(conn, nil)
+	}
+}
+
+func (s *Server) acceptSessionLoop(ql *QuicListener) {
+	defer s.wg.Done()
+	for {
+		session, err := ql.AcceptSession(s.ctx)
+		if err != nil {
+			if errors.Is(err, quic.ErrServerClosed) || s.ctx.Err() != nil {
+				slog.Ins().Infof("[%s] accept session loop exit", s.Name)
+				return
+			}
+			slog.Ins().Errorf("[%s] accept session err: %v", s.Name, err)
+			utils.AcceptDelay.Delay()
+			continue
+		}
+		utils.AcceptDelay.Reset()
+		if s.connMgr.IsBlocked(addrIP(session.RemoteAddr())) {
+			slog.Ins().Debugf("[%s] %s is in the blacklist, close the session", s.Name, session.RemoteAddr().String())
+			_ = session.CloseWithError(0, "blocked")
+			continue
+		}
+		s.wg.Add(1)
+		go s.serveQuicSession(session)
+	}
+}
+
+// serveQuicSession starts a sbus connection for every stream of the session, the datagrams are
+// dispatched by one of the stream connections, so the handlers can reply through it, the next
+// accepted stream takes over the datagrams when that connection stops
+// (为会话的每个流启动一个sbus连接，datagram由其中一个流的连接分发，处理函数可以通过它回复，
+// 该连接停止后由下一个接收的流接管datagram)
+func (s *Server) serveQuicSession(session *QuicSession) {
+	defer s.wg.Done()
+	var datagramBound atomic.Bool
+	for {
+		qconn, err := session.AcceptStream(s.ctx)
+		if err != nil {
+			slog.Ins().Debugf("[%s] session %s accept stream exit: %v", s.Name, session.RemoteAddr().String(), err)
+			return
+		}
+		if s.MaxConn > 0 && s.connMgr.Len() >= s.MaxConn {
+			slog.Ins().Warnf("[%s] too many connections, MaxConn = %d, close the stream of %s", s.Name, s.MaxConn, session.RemoteAddr().String())
+			_ = qconn.Close()
+			continue
+		}
+		conn := s.startConn(qconn, nil)
+		if session.SupportsDatagrams() && datagramBound.CompareAndSwap(false, true) {
+			s.connWg.Add(1)
+			go func() {
+				defer s.connWg.Done()
+				s.datagramLoop(session, conn.(*Connection))
+				datagramBound.Store(false)
+			}()
+		}
+	}
+}
+
+// datagramLoop dispatches the datagrams of the session by conn until conn stops or the session is closed
+// (通过conn分发会话的datagram，直到conn停止或者会话关闭)
+func (s *Server) datagramLoop(session *QuicSession, conn *Connection) {
+	for {
+		data, err := session.ReceiveDatagram(conn.Context())
+		if err != nil {
+			return
+		}
+		if err := conn.dispatchDatagram(data); err != nil {
+			slog.Ins().Warnf("[%s] datagram of connID = %d error: %s", s.Name, conn.ConnID, err)
+		}
+	}
+}
+
+// startConn starts a sbus connection with props set before it is added to the connMgr, so they are indexed
+// (启动sbus连接，props在加入connMgr之前设置，因此会建立索引)
+func (s *Server) startConn(conn net.Conn, props map[string]any) SConnection {
+	var frameDecoder SFrameDecoder
+	if s.newFrameDecoder != nil {
+		frameDecoder = s.newFrameDecoder()
+	}
+	dealConn := NewConnection(conn, NextConnID(), 0, s.taskHandler, s.onConnStart, s.onConnStop, frameDecoder, s.datapack, s.connMgr, s.IOReadBuffSize, s.HeartbeatMax, s.connOpts...)
+	if s.hc != nil {
+		checker := s.hc.Clone()
+		checker.BindConn(dealConn)
+		dealConn.SetHeartBeat(checker)
+	}
+	for key, value := range props {
+		dealConn.SetProperty(key, value)
+	}
+	s.connMgr.Add(dealConn)
+	s.connWg.Add(1)
+	go func() {
+		defer s.connWg.Done()
+		dealConn.Start()
+	}()
+	return dealConn
+}
+
+// Stop closes the listener first so no new connection comes in, then stops all the connections and waits
+// for their readers to exit, and finally stops the worker pool after the TaskQueue is drained
+// (先关闭监听不再接收新连接，再停止所有连接并等待其读协程退出，最后等TaskQueue消费完后停止工作池)
+func (s *Server) Stop() {
+	s.stopOnce.Do(func() {
+		slog.Ins().Infof("[%s] stop sbus server", s.Name)
+		s.cancel()
+		if s.ln != nil {
+			_ = s.ln.Close()
+		}
+		if s.packetConn != nil {
+			_ = s.packetConn.Close()
+		}
+		s.wg.Wait()
+		if s.certReloader != nil {
+			_ = s.certReloader.Close()
+		}
+		s.connMgr.ClearConn()
+		// the readers still running could queue tasks after the workers exit (仍在运行的读协程可能在worker退出后投递任务)
+		s.connWg.Wait()
+		s.taskHandler.Stop()
+	})
+}
+
+func (s *Server) Serve() {
+	if err := s.Start(); err != nil {
+		return
+	}
+	<-s.ctx.Done()
+}
+
+func (s *Server) AddRouter(msgID int32, router SRouter) {
+	s.taskHandler.AddRouter(msgID, router)
+}
+
+func (s *Server) Use(middlewares ...MiddlewareFunc) {
+	s.taskHandler.Use(middlewares...)
+}
+
+func (s *Server) Handle(msgID int32, fn interface{}) {
+	s.taskHandler.Handle(msgID, fn)
+}
+
+func (s *Server) Group(start, end int32, middlewares ...MiddlewareFunc) *RouterGroup {
+	return s.taskHandler.Group(start, end, middlewares...)
+}
+
+func (s *Server) GetConnMgr() SConnManager {
+	return s.connMgr
+}
+
+func (s *Server) GetTaskHandler() STaskHandler {
+	return s.taskHandler
+}
+
+// Addr returns the listener's network address, nil if the server is not started
+// (返回监听地址，未启动时返回nil)
+func (s *Server) Addr() net.Addr {
+	if s.ln == nil {
+		return nil
+	}
+	return s.ln.Addr()
+}
@@ -0,0 +1,40 @@
+package sbus
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/wwengg/threego/core/sconfig"
+	"github.com/wwengg/threego/core/slog"
+)
+
+func TestServerStopWaitsForConnections(t *testing.T) {
+	slog.NewZapLog(&sconfig.Slog{Director: t.TempDir(), Level: "error"})
+	s := NewServer("stop", "tcp", "127.0.0.1", 0)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	const connNum = 3
+	for i := 0; i < connNum; i++ {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+	}
+	deadline := time.Now().Add(time.Second)
+	for s.GetConnMgr().Len() != connNum {
+		if time.Now().After(deadline) {
+			t.Fatalf("conn num = %d, want %d", s.GetConnMgr().Len(), connNum)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// every connection has finished stopping when Stop returns (Stop返回时所有连接都已停止完成)
+	s.Stop()
+	if n := s.GetConnMgr().Len(); n != 0 {
+		t.Fatalf("%d connections are left after Stop", n)
+	}
+}
@@ -1,17 +1,19 @@
 package sbus
 
+import "time"
+
 type SHeartbeatChecker interface {
 	SetOnRemoteNotAlive(OnRemoteNotAlive)
 	SetHeartbeatMsgFunc(HeartBeatMsgFunc)
 	//SetHeartbeatFunc(HeartBeatFunc)
-	//BindRouter(uint32, SRouter)
+	BindRouter(uint16, SRouter)
 	Start()
 	Stop()
 	SendHeartBeatMsg() error
 	BindConn(connection SConnection)
-	//Clone() SHeartbeatChecker
+	Clone() SHeartbeatChecker
 	Cmd() uint16
-	//Router() SRouter
+	Router() SRouter
 }
 
 // User-defined method for handling heartbeat detection messages
@@ -31,6 +33,7 @@ type HeartBeatOption struct {
 	OnRemoteNotAlive OnRemoteNotAlive // User-defined method for handling remote connections that are not alive(用户自定义的远程连接不存活时的处理方法)
 	HeartBeatMsgID   uint32           // User-defined ID for heartbeat detection messages(用户自定义的心跳检测消息ID)
 	Router           SRouter          // User-defined business processing route for heartbeat detection messages(用户自定义的心跳检测消息业务处理路由)
+	SendInterval     time.Duration    // The interval of sending the MakeMsg messages to the client, 0 means not sending(向客户端发送MakeMsg消息的间隔，0表示不发送)
 }
 
 const (
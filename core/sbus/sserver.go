@@ -0,0 +1,11 @@
+package sbus
+
+type SServer interface {
+	Start() error                          // Start listening and accepting connections (启动监听并接收连接)
+	Stop()                                 // Stop the server and all its connections (停止服务器以及所有连接)
+	Serve()                                // Start the server and block until it is stopped (启动服务器并阻塞直到停止)
+	AddRouter(msgID int32, router SRouter) // Add a router for the msgID (为msgID添加路由)
+	Use(middlewares ...MiddlewareFunc)     // Add the middlewares for all msgIDs (添加所有msgID的中间件)
+	GetConnMgr() SConnManager              // Get the connection manager (获取连接管理器)
+	GetTaskHandler() STaskHandler          // Get the task handler (获取任务处理器)
+}
@@ -19,9 +19,18 @@ type STask interface {
 	// (转进到下一个处理器开始执行 但是调用此方法的函数会根据先后顺序逆序执行)
 	Call() error
 
+	// Run the rest of the middleware chain inside a middleware, like gin.Context.Next
+	// (在中间件内执行链上剩余的处理函数，与gin.Context.Next相同)
+	Next()
+	// Bind the middlewares that run before the router (绑定在路由之前执行的中间件)
+	BindMiddleware(middlewares []MiddlewareFunc)
+
 	//erminate the execution of the processing function, but the function that calls this method will be executed until completion
 	// 终止处理函数的运行 但调用此方法的函数会执行完毕
 	Abort()
+	AbortWithError(err error) // Abort and set the error returned by Call (终止并设置Call返回的错误)
+	IsAborted() bool          // Whether Abort has been called (是否调用过Abort)
+	GetErr() error            // The error of the router or AbortWithError (路由或者AbortWithError的错误)
 
 	//Set 在 Request 中存放一个上下文
 	Set(key string, value interface{})
@@ -29,6 +38,11 @@ type STask interface {
 	Get(key string) (value interface{}, exists bool)
 }
 
+// MiddlewareFunc runs around the router, call task.Next() to run the rest of the chain, or
+// task.Abort() to stop it
+// (中间件在路由前后执行，调用task.Next()执行链上剩余部分，调用task.Abort()终止)
+type MiddlewareFunc func(task STask)
+
 type BaseRequest struct{}
 
 func (br *BaseRequest) GetConnection() SConnection { return nil }
@@ -39,6 +53,12 @@ func (br *BaseRequest) GetMessage() SMsg           { return nil }
 func (br *BaseRequest) BindRouter(router SRouter)  {}
 func (br *BaseRequest) Call() error                { return nil }
 func (br *BaseRequest) Abort()                     {}
+func (br *BaseRequest) Next()                      {}
+func (br *BaseRequest) AbortWithError(err error)   {}
+func (br *BaseRequest) IsAborted() bool            { return false }
+func (br *BaseRequest) GetErr() error              { return nil }
+
+func (br *BaseRequest) BindMiddleware(middlewares []MiddlewareFunc) {}
 
 func (br *BaseRequest) Set(key string, value interface{}) {}
 
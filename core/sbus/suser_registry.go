@@ -0,0 +1,23 @@
+package sbus
+
+import (
+	"context"
+	"time"
+)
+
+// SUserRegistry maps the users to the gateway nodes they are connected to, it is shared by all nodes,
+// such as store.RedisUserRegistry (将用户映射到其所连接的网关节点，所有节点共享，例如store.RedisUserRegistry)
+type SUserRegistry interface {
+	// Register the device of uid on nodeID and return the node registered before, "" if none
+	// (将uid的设备注册到nodeID，并返回之前注册的节点，没有时返回"")
+	Register(ctx context.Context, uid, device, nodeID string) (prevNodeID string, err error)
+	// Unregister the device of uid only if it is still registered on nodeID
+	// (仅当uid的设备仍注册在nodeID上时注销)
+	Unregister(ctx context.Context, uid, device, nodeID string) error
+	// Lookup the nodes of every device of uid, device -> nodeID, the devices on the nodes that are not alive
+	// are left out (查询uid每个设备所在的节点，device -> nodeID，不存活节点上的设备会被排除)
+	Lookup(ctx context.Context, uid string) (map[string]string, error)
+	// KeepAlive marks nodeID alive for ttl, so the users of a crashed node are not looked up any more
+	// (将nodeID标记为存活ttl时长，使崩溃节点上的用户不再被查询到)
+	KeepAlive(ctx context.Context, nodeID string, ttl time.Duration) error
+}
@@ -1,6 +1,7 @@
 package sbus
 
 import (
+	"math"
 	"sync"
 )
 
@@ -12,6 +13,19 @@ const (
 	HANDLE_OVER
 )
 
+// The keys set by sbus in the task context (sbus在任务上下文中设置的key)
+const (
+	// TaskKeyStreamID is the quic.StreamID of the stream the msg came from, only set on QUIC connections
+	// (消息来源流的quic.StreamID，仅在QUIC连接上设置)
+	TaskKeyStreamID = "sbus.streamID"
+	// TaskKeyDatagram is true if the msg came from a QUIC datagram (消息来自QUIC datagram时为true)
+	TaskKeyDatagram = "sbus.datagram"
+)
+
+// abortIndex is larger than the length of any chain, so Next stops after Abort
+// (abortIndex大于任何链的长度，Abort之后Next不再继续)
+const abortIndex int8 = math.MaxInt8 >> 1
+
 var TaskPool = new(sync.Pool)
 
 func init() {
@@ -38,6 +52,12 @@ type Task struct {
 	needNext bool                   // whether to execute the next router function(是否需要执行下一个路由函数)
 	index    int8                   // router function slice index(路由函数切片索引)
 	keys     map[string]interface{} // keys 路由处理时可能会存取的上下文信息
+	keysLock sync.RWMutex           // protects keys(保护keys)
+
+	middlewares []MiddlewareFunc // the middlewares bound by the TaskHandler(TaskHandler绑定的中间件)
+	handlers    []MiddlewareFunc // middlewares and the router, reused by the pooled task(中间件加路由，池化的任务复用)
+	aborted     bool             // whether Abort has been called(是否调用过Abort)
+	err         error            // the error of the router or AbortWithError(路由或者AbortWithError的错误)
 }
 
 func (r *Task) Reset(conn SConnection, msg SMsg) {
@@ -47,6 +67,11 @@ func (r *Task) Reset(conn SConnection, msg SMsg) {
 	r.needNext = true
 	r.index = -1
 	r.keys = nil
+	r.router = nil
+	r.middlewares = nil
+	r.handlers = r.handlers[:0]
+	r.aborted = false
+	r.err = nil
 }
 
 func GetTask(conn SConnection, msg SMsg) STask {
@@ -84,10 +109,30 @@ func (r *Task) GetCmd() uint16 {
 	return r.msg.GetCmd()
 }
 
+func (r *Task) Set(key string, value interface{}) {
+	r.keysLock.Lock()
+	defer r.keysLock.Unlock()
+	if r.keys == nil {
+		r.keys = make(map[string]interface{})
+	}
+	r.keys[key] = value
+}
+
+func (r *Task) Get(key string) (value interface{}, exists bool) {
+	r.keysLock.RLock()
+	defer r.keysLock.RUnlock()
+	value, exists = r.keys[key]
+	return
+}
+
 func (r *Task) BindRouter(router SRouter) {
 	r.router = router
 }
 
+func (r *Task) BindMiddleware(middlewares []MiddlewareFunc) {
+	r.middlewares = middlewares
+}
+
 func (r *Task) next() {
 	if r.needNext == false {
 		r.needNext = true
@@ -99,20 +144,69 @@ func (r *Task) next() {
 	r.stepLock.Unlock()
 }
 
+// Call runs the middlewares bound by BindMiddleware and then the router, it returns the error
+// returned by the router or passed to AbortWithError
+// (依次执行BindMiddleware绑定的中间件以及路由，返回路由返回的错误或者AbortWithError传入的错误)
 func (r *Task) Call() error {
 
 	if r.router == nil {
 		return nil
 	}
 
-	for r.steps < HANDLE_OVER {
+	if len(r.middlewares) == 0 {
+		r.callRouter(r)
+		return r.err
+	}
+
+	r.handlers = append(append(r.handlers[:0], r.middlewares...), r.callRouter)
+	r.index = -1
+	r.Next()
+	return r.err
+}
+
+// Next runs the rest of the chain inside the current middleware, the code after Next runs after the router
+// (在当前中间件内执行链上剩余的处理函数，Next之后的代码在路由执行之后运行)
+func (r *Task) Next() {
+	r.index++
+	for r.index < int8(len(r.handlers)) {
+		r.handlers[r.index](r)
+		r.index++
+	}
+}
+
+// Abort stops the rest of the chain, the middlewares already running still execute until completion
+// (终止链上剩余的处理函数，已经在执行的中间件仍会执行完毕)
+func (r *Task) Abort() {
+	r.index = abortIndex
+	r.aborted = true
+}
+
+func (r *Task) AbortWithError(err error) {
+	r.err = err
+	r.Abort()
+}
+
+func (r *Task) IsAborted() bool {
+	return r.aborted
+}
+
+func (r *Task) GetErr() error {
+	return r.err
+}
+
+// callRouter runs PreHandle, Handle and PostHandle of the router, it is the last handler of the chain
+// (执行路由的PreHandle、Handle以及PostHandle，是链上的最后一个处理函数)
+func (r *Task) callRouter(STask) {
+	for r.steps < HANDLE_OVER && !r.aborted {
 		switch r.steps {
 		case PRE_HANDLE:
 			r.router.PreHandle(r)
 		case HANDLE:
 			err := r.router.Handle(r)
 			if err != nil {
-				return err
+				r.err = err
+				r.steps = PRE_HANDLE
+				return
 			}
 		case POST_HANDLE:
 			r.router.PostHandle(r)
@@ -122,5 +216,4 @@ func (r *Task) Call() error {
 	}
 
 	r.steps = PRE_HANDLE
-	return nil
 }
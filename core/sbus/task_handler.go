@@ -5,25 +5,100 @@ import (
 	"fmt"
 	"runtime"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/wwengg/threego/core/slog"
 )
 
 type STaskHandler interface {
 	AddRouter(msgID int32, router SRouter)
-	StartWorkerPool()               //  Start the worker pool
-	SendTaskToTaskQueue(task STask) // Pass the message to the TaskQueue for processing by the worker(将消息交给TaskQueue,由worker进行处理)
+	Use(middlewares ...MiddlewareFunc)                       // Add the middlewares for all msgIDs (添加所有msgID的中间件)
+	UseWithMsgID(msgID int32, middlewares ...MiddlewareFunc) // Add the middlewares for the msgID (添加指定msgID的中间件)
+	Handle(msgID int32, fn interface{})                      // Add a function handler, see NewFuncRouter (添加函数式处理函数)
+	Group(start, end int32, middlewares ...MiddlewareFunc) *RouterGroup
+	StartWorkerPool()                               //  Start the worker pool
+	SendTaskToTaskQueue(task STask) error           // Pass the message to the TaskQueue for processing by the worker(将消息交给TaskQueue,由worker进行处理)
+	Stats() map[int32]TaskStats                     // Get the counters of every msgID (获取每个msgID的计数)
+	QueueLen() int                                  // Get the number of the tasks waiting in the queues (获取队列中等待的任务数)
+	QueueCap() int                                  // Get the capacity of the queues (获取队列的容量)
+	Submit(fn func()) error                         // Run fn on a worker (在worker上执行fn)
+	SubmitToConn(conn SConnection, fn func()) error // Run fn on the lane of conn (在conn所在的队列上执行fn)
+	Resize(n uint32) error                          // Set the number of the workers at runtime (运行时设置worker数量)
+	WorkerNum() int                                 // Get the number of the running workers (获取运行中的worker数量)
 	Stop()
 }
 
+// TaskKeyFunc returns the key of the task in the ordered dispatch mode, the tasks with the same key are
+// processed in order by the same worker, use utils.Fnv32 for a string key such as the player ID
+// (返回顺序分发模式下任务的key，key相同的任务由同一个worker按顺序处理，字符串key例如玩家ID可以使用utils.Fnv32)
+type TaskKeyFunc func(task STask) uint64
+
+// ConnIDTaskKey is the default TaskKeyFunc, the tasks without connection, such as the function tasks, get 0
+// (默认的TaskKeyFunc，没有连接的任务例如函数任务返回0)
+func ConnIDTaskKey(task STask) uint64 {
+	if conn := task.GetConnection(); conn != nil {
+		return conn.GetConnID()
+	}
+	return 0
+}
+
+type TaskHandlerOption func(mh *TaskHandler)
+
+// WithOrderedDispatch gives every worker a queue of its own and hashes the tasks onto the queues by keyFunc,
+// so the tasks of a connection are processed in order while different connections run in parallel,
+// keyFunc nil means ConnIDTaskKey
+// (每个worker拥有自己的队列，按keyFunc将任务哈希到各个队列上，同一连接的任务按顺序处理，不同连接之间仍然并行，
+// keyFunc为nil时使用ConnIDTaskKey)
+func WithOrderedDispatch(keyFunc TaskKeyFunc) TaskHandlerOption {
+	return func(mh *TaskHandler) {
+		if keyFunc == nil {
+			keyFunc = ConnIDTaskKey
+		}
+		mh.keyFunc = keyFunc
+	}
+}
+
 type TaskHandler struct {
 	Apis map[int32]SRouter
+	// The middlewares for all msgIDs (所有msgID的中间件)
+	middlewares []MiddlewareFunc
+	// The middlewares for the msgID (指定msgID的中间件)
+	msgMiddlewares map[int32][]MiddlewareFunc
+	// The global middlewares followed by the ones of the msgID, rebuilt by Use and UseWithMsgID
+	// (全局中间件加上msgID的中间件，由Use以及UseWithMsgID重建)
+	chains map[int32][]MiddlewareFunc
 	// The number of worker goroutines in the business work Worker pool
 	// (业务工作Worker池的数量)
 	WorkerPoolSize uint32
 	// A message queue for workers to take tasks
 	// (Worker负责取任务的消息队列)
 	TaskQueue chan STask
+	// The queue of every worker in the ordered dispatch mode (顺序分发模式下每个worker的队列)
+	taskQueues []chan STask
+	// not nil in the ordered dispatch mode (顺序分发模式下不为nil)
+	keyFunc TaskKeyFunc
+
+	// The policy when the queue is full and the timeout of OverloadBlock (队列满时的处理策略以及OverloadBlock的超时时间)
+	overloadPolicy OverloadPolicy
+	enqueueTimeout time.Duration
+	// The *taskCounter of every msgID (每个msgID的*taskCounter)
+	counters sync.Map
+
+	// The bounds of the worker pool and the idle time before shrinking, see WithWorkerScaling
+	// (工作池的上下限以及缩容之前的空闲时间，参见WithWorkerScaling)
+	minWorkers, maxWorkers uint32
+	workerIdleTimeout      time.Duration
+	// protects started, ctx, cancel, workerNum, targetNum, nextWorkerID and the bounds
+	// (保护started、ctx、cancel、workerNum、targetNum、nextWorkerID以及上下限)
+	scaleLock    sync.Mutex
+	started      bool
+	workerNum    uint32
+	targetNum    uint32
+	nextWorkerID int
+	busyWorkers  atomic.Int32
+	// an idle worker exits when it receives from retireChan (空闲worker从retireChan收到信号时退出)
+	retireChan chan struct{}
 
 	ctx    context.Context
 	cancel context.CancelFunc
@@ -32,20 +107,46 @@ type TaskHandler struct {
 	wg sync.WaitGroup
 }
 
-func NewTaskHandler(workPoolSize, maxTaskQueueLen uint32) STaskHandler {
-	var freeWorkers map[uint32]struct{}
-	freeWorkers = make(map[uint32]struct{}, workPoolSize)
-	for i := uint32(0); i < workPoolSize; i++ {
-		freeWorkers[i] = struct{}{}
+// NewTaskHandler creates a TaskHandler, maxTaskQueueLen is the length of the shared TaskQueue, or the length
+// of every worker queue in the ordered dispatch mode
+// (创建TaskHandler，maxTaskQueueLen为共享TaskQueue的长度，顺序分发模式下为每个worker队列的长度)
+func NewTaskHandler(workPoolSize, maxTaskQueueLen uint32, opts ...TaskHandlerOption) STaskHandler {
+	if workPoolSize == 0 {
+		panic("sbus: NewTaskHandler workPoolSize is 0")
 	}
 	handler := &TaskHandler{
 		Apis:           make(map[int32]SRouter),
+		msgMiddlewares: make(map[int32][]MiddlewareFunc),
+		chains:         make(map[int32][]MiddlewareFunc),
 		WorkerPoolSize: workPoolSize,
-		TaskQueue:      make(chan STask, maxTaskQueueLen),
+	}
+	for _, opt := range opts {
+		opt(handler)
+	}
+	if handler.workerIdleTimeout == 0 || handler.keyFunc != nil {
+		handler.minWorkers, handler.maxWorkers = workPoolSize, workPoolSize
+		handler.workerIdleTimeout = 0
+	}
+	handler.WorkerPoolSize = max(handler.minWorkers, min(handler.maxWorkers, workPoolSize))
+	if handler.keyFunc != nil {
+		handler.taskQueues = make([]chan STask, workPoolSize)
+		for i := range handler.taskQueues {
+			handler.taskQueues[i] = make(chan STask, maxTaskQueueLen)
+		}
+	} else {
+		handler.TaskQueue = make(chan STask, maxTaskQueueLen)
+		handler.retireChan = make(chan struct{})
 	}
 	return handler
 }
 
+// ReservedMsgIDMax is the largest msgID reserved by sbus, the msgIDs from 1 to it are used by
+// HeartBeatDefaultMsgID, KickDefaultMsgID, ClusterDefaultMsgID, EncryptionDefaultMsgID and the future
+// built-in messages, some of which are handled before the routers, so AddRouter warns about them
+// (sbus保留的最大msgID，1到该值的msgID被HeartBeatDefaultMsgID、KickDefaultMsgID、ClusterDefaultMsgID、
+// EncryptionDefaultMsgID以及以后的内置消息使用，其中一些在路由之前就被处理，所以AddRouter会对其打印警告)
+const ReservedMsgIDMax int32 = 15
+
 func (mh *TaskHandler) AddRouter(msgID int32, router SRouter) {
 	// 1. Check whether the current API processing method bound to the msgID already exists
 	// (判断当前msg绑定的API处理方法是否已经存在)
@@ -53,18 +154,63 @@ func (mh *TaskHandler) AddRouter(msgID int32, router SRouter) {
 		msgErr := fmt.Sprintf("repeated api , msgID = %+v\n", msgID)
 		panic(msgErr)
 	}
+	if msgID > 0 && msgID <= ReservedMsgIDMax {
+		slog.Ins().Warnf("msgID = %d is reserved by sbus (1-%d), it may collide with the built-in messages", msgID, ReservedMsgIDMax)
+	}
 	// 2. Add the binding relationship between msg and API
 	// (添加msg与api的绑定关系)
 	mh.Apis[msgID] = router
 	slog.Ins().Infof("Add Router msgID = %d", msgID)
 }
 
-// SendTaskToTaskQueue sends the message to the TaskQueue for processing by the worker
-// (将消息交给TaskQueue,由worker进行处理)
-func (mh *TaskHandler) SendTaskToTaskQueue(task STask) {
+// Handle adds the function handler, see NewFuncRouter (添加函数式处理函数，参见NewFuncRouter)
+func (mh *TaskHandler) Handle(msgID int32, fn interface{}) {
+	mh.AddRouter(msgID, NewFuncRouter(fn))
+}
 
-	mh.TaskQueue <- task
-	//slog.Ins().Debugf("SendMsgToTaskQueue-->%s", hex.EncodeToString(task.GetData()))
+// Group creates a router group of the msgID range [start, end] (创建msgID区间为[start, end]的路由组)
+func (mh *TaskHandler) Group(start, end int32, middlewares ...MiddlewareFunc) *RouterGroup {
+	return NewRouterGroup(mh, start, end, middlewares...)
+}
+
+// Use adds the middlewares for all msgIDs, they run before the ones added by UseWithMsgID,
+// like AddRouter it must be called before StartWorkerPool
+// (添加所有msgID的中间件，在UseWithMsgID添加的中间件之前执行，与AddRouter一样必须在StartWorkerPool之前调用)
+func (mh *TaskHandler) Use(middlewares ...MiddlewareFunc) {
+	mh.middlewares = append(mh.middlewares, middlewares...)
+	for msgID := range mh.msgMiddlewares {
+		mh.buildChain(msgID)
+	}
+}
+
+// UseWithMsgID adds the middlewares for the msgID, like AddRouter it must be called before StartWorkerPool
+// (添加指定msgID的中间件，与AddRouter一样必须在StartWorkerPool之前调用)
+func (mh *TaskHandler) UseWithMsgID(msgID int32, middlewares ...MiddlewareFunc) {
+	mh.msgMiddlewares[msgID] = append(mh.msgMiddlewares[msgID], middlewares...)
+	mh.buildChain(msgID)
+}
+
+func (mh *TaskHandler) buildChain(msgID int32) {
+	chain := make([]MiddlewareFunc, 0, len(mh.middlewares)+len(mh.msgMiddlewares[msgID]))
+	chain = append(chain, mh.middlewares...)
+	mh.chains[msgID] = append(chain, mh.msgMiddlewares[msgID]...)
+}
+
+func (mh *TaskHandler) middlewaresOf(msgID int32) []MiddlewareFunc {
+	if chain, ok := mh.chains[msgID]; ok {
+		return chain
+	}
+	return mh.middlewares
+}
+
+// SendTaskToTaskQueue sends the message to the TaskQueue for processing by the worker, what happens
+// when the queue is full depends on the OverloadPolicy, the rejected task must not be used any more
+// (将消息交给TaskQueue,由worker进行处理，队列满时的行为由OverloadPolicy决定，被拒绝的任务不能再使用)
+func (mh *TaskHandler) SendTaskToTaskQueue(task STask) error {
+	if mh.keyFunc != nil {
+		return mh.enqueue(mh.taskQueues[mh.keyFunc(task)%uint64(len(mh.taskQueues))], task)
+	}
+	return mh.enqueue(mh.TaskQueue, task)
 }
 
 // doFuncHandler handles functional requests (执行函数式请求)
@@ -102,6 +248,7 @@ func (mh *TaskHandler) doMsgHandler(task STask, workerID int) {
 	// Bind the Task request to the corresponding Router relationship
 	// (Request请求绑定Router对应关系)
 	task.BindRouter(handler)
+	task.BindMiddleware(mh.middlewaresOf(msgId))
 
 	// Execute the corresponding processing method
 	task.Call()
@@ -120,41 +267,84 @@ func (mh *TaskHandler) StartOneWorker(workerID int, taskQueue chan STask) {
 		// If there is a message, take out the Request from the queue and execute the bound business method
 		// (有消息则取出队列的Request，并执行绑定的业务方法)
 		case task := <-taskQueue:
+			mh.doTask(task, workerID)
+		case <-mh.retireChan:
+			slog.Ins().Debugf("[Worker ID = %d exit! retired]", workerID)
+			return
+		case <-mh.ctx.Done():
+			// Consume all the remaining tasks in the queue before exiting
+			// (退出前消费完TaskQueue内所有数据)
+			for {
+				select {
+				case task := <-taskQueue:
+					mh.doTask(task, workerID)
+				default:
+					slog.Ins().Infof("[Worker ID = %d exit! ctx.Done]", workerID)
+					return
+				}
+			}
+		}
+	}
+}
 
-			switch task := task.(type) {
+// doTask dispatches the task according to its type
+// (根据任务类型分发任务)
+func (mh *TaskHandler) doTask(task STask, workerID int) {
+	// the task is put back to the TaskPool after it is processed (任务处理完成后会被放回TaskPool)
+	defer mh.counter(task.GetMsgID()).processed.Add(1)
+	mh.busyWorkers.Add(1)
+	defer mh.busyWorkers.Add(-1)
+	switch task := task.(type) {
 
-			case SFuncTask:
-				// Internal function call request (内部函数调用request)
+	case SFuncTask:
+		// Internal function call request (内部函数调用request)
 
-				mh.doFuncHandler(task, workerID)
+		mh.doFuncHandler(task, workerID)
 
-			case STask: // Client message request
-				mh.doMsgHandler(task, workerID)
-			}
-		case <-mh.ctx.Done():
-			l := len(taskQueue)
-			slog.Ins().Infof("[Nsq Writer exit! ctx.Done],msgBuffChanLen:%d", l)
-			return
-		}
+	case STask: // Client message request
+		mh.doMsgHandler(task, workerID)
 	}
 }
 
 // StartWorkerPool starts the worker pool
 func (mh *TaskHandler) StartWorkerPool() {
-	// Iterate through the required number of workers and start them one by one
-	// (遍历需要启动worker的数量，依此启动)
+	// Resize before the start only records the size, so it can not start a worker without ctx
+	// (启动之前的Resize只记录数量，因此不会在没有ctx时启动worker)
+	mh.scaleLock.Lock()
+	defer mh.scaleLock.Unlock()
 	mh.ctx, mh.cancel = context.WithCancel(context.Background())
+	mh.started = true
 
-	for i := 0; i < int(mh.WorkerPoolSize); i++ {
+	// Iterate through the required number of workers and start them one by one
+	// (遍历需要启动worker的数量，依此启动)
 
-		// Start the current worker, blocking and waiting for messages to be passed in the corresponding task queue
-		// (启动当前Worker，阻塞的等待对应的任务队列是否有消息传递进来)
-		mh.wg.Add(1)
-		go mh.StartOneWorker(i, mh.TaskQueue)
+	if mh.keyFunc != nil {
+		for i := 0; i < int(mh.WorkerPoolSize); i++ {
+			// Start the current worker, blocking and waiting for messages to be passed in the corresponding task queue
+			// (启动当前Worker，阻塞的等待对应的任务队列是否有消息传递进来)
+			mh.wg.Add(1)
+			go mh.StartOneWorker(i, mh.taskQueues[i])
+		}
+		return
 	}
+
+	mh.targetNum = mh.WorkerPoolSize
+	mh.applyTargetLocked()
+
+	// The monitor applies the autoscaling and the shrinking by Resize (监控协程执行自动扩缩容以及Resize的缩容)
+	mh.wg.Add(1)
+	go mh.scaleMonitor()
 }
 
+// Stop stops the worker pool, the workers exit after the TaskQueue is drained
+// (停止工作池，worker消费完TaskQueue后退出)
 func (mh *TaskHandler) Stop() {
-	mh.cancel()
+	mh.scaleLock.Lock()
+	cancel := mh.cancel
+	mh.scaleLock.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
 	mh.wg.Wait()
 }
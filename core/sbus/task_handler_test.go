@@ -0,0 +1,250 @@
+package sbus
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wwengg/threego/core/sconfig"
+	"github.com/wwengg/threego/core/slog"
+	"github.com/wwengg/threego/core/smsg"
+)
+
+type orderRouter struct {
+	BaseRouter
+	mu   sync.Mutex
+	seen map[uint64][]uint32
+}
+
+func (r *orderRouter) Handle(task STask) error {
+	n := binary.BigEndian.Uint32(task.GetData())
+	// make the later tasks faster to expose reordering (让后面的任务更快，以暴露乱序)
+	time.Sleep(time.Duration(10-n%10) * 100 * time.Microsecond)
+	r.mu.Lock()
+	r.seen[task.GetConnection().GetConnID()] = append(r.seen[task.GetConnection().GetConnID()], n)
+	r.mu.Unlock()
+	return nil
+}
+
+func TestTaskHandlerOrderedDispatch(t *testing.T) {
+	slog.NewZapLog(&sconfig.Slog{Director: t.TempDir(), Level: "error"})
+	router := &orderRouter{seen: make(map[uint64][]uint32)}
+	mh := NewTaskHandler(4, 16, WithOrderedDispatch(nil))
+	mh.AddRouter(1, router)
+	mh.StartWorkerPool()
+
+	const connNum, taskNum = 3, 50
+	var conns []SConnection
+	for i := 1; i <= connNum; i++ {
+		conns = append(conns, NewConnection(nil, uint64(i), 0, mh, nil, nil, nil, NewTcpDataPack(), nil, 0, 0))
+	}
+	for n := uint32(0); n < taskNum; n++ {
+		for _, conn := range conns {
+			data := make([]byte, 4)
+			binary.BigEndian.PutUint32(data, n)
+			mh.SendTaskToTaskQueue(GetTask(conn, NewNSQMsg(1, 0, smsg.SerializeNone, nil, data)))
+		}
+	}
+	mh.Stop()
+
+	for _, conn := range conns {
+		seen := router.seen[conn.GetConnID()]
+		if len(seen) != taskNum {
+			t.Fatalf("conn %d: got %d tasks, want %d", conn.GetConnID(), len(seen), taskNum)
+		}
+		for i, n := range seen {
+			if n != uint32(i) {
+				t.Fatalf("conn %d: task %d processed at position %d", conn.GetConnID(), n, i)
+			}
+		}
+	}
+}
+
+func TestTaskHandlerOverloadPolicy(t *testing.T) {
+	slog.NewZapLog(&sconfig.Slog{Director: t.TempDir(), Level: "error"})
+
+	for _, tc := range []struct {
+		name    string
+		policy  OverloadPolicy
+		wantErr error
+	}{
+		{"block", OverloadBlock, ErrTaskQueueTimeout},
+		{"reject", OverloadReject, ErrTaskQueueFull},
+		{"drop oldest", OverloadDropOldest, nil},
+	} {
+		// the workers are not started, so the queue of length 1 is full after the first task
+		// (worker未启动，长度为1的队列在第一个任务之后就满了)
+		mh := NewTaskHandler(1, 1, WithOverloadPolicy(tc.policy, 10*time.Millisecond))
+		conn := NewConnection(nil, 1, 0, mh, nil, nil, nil, NewTcpDataPack(), nil, 0, 0).(*Connection)
+		first := NewNSQMsg(1, 0, smsg.SerializeNone, nil, []byte("first"))
+		second := NewNSQMsg(2, 0, smsg.SerializeNone, nil, []byte("second"))
+		if err := mh.SendTaskToTaskQueue(GetTask(conn, first)); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if err := mh.SendTaskToTaskQueue(GetTask(conn, second)); err != tc.wantErr {
+			t.Fatalf("%s: err = %v, want %v", tc.name, err, tc.wantErr)
+		}
+
+		rejected := uint16(2)
+		if tc.policy == OverloadDropOldest {
+			rejected = 1
+		}
+		resp, err := conn.Datapack.Unpack(<-conn.msgBuffChan)
+		if err != nil || resp.GetRet() != RetOverload || resp.GetCmd() != rejected {
+			t.Fatalf("%s: unexpected reply %+v, %v", tc.name, resp, err)
+		}
+		if stats := mh.Stats(); stats[int32(rejected)].Rejected != 1 || mh.QueueLen() != 1 || mh.QueueCap() != 1 {
+			t.Fatalf("%s: unexpected stats %+v, queue %d/%d", tc.name, stats, mh.QueueLen(), mh.QueueCap())
+		}
+	}
+
+	// without the option a full queue blocks until there is room (未设置选项时队列满会一直阻塞直到有空位)
+	mh := NewTaskHandler(1, 1)
+	conn := NewConnection(nil, 1, 0, mh, nil, nil, nil, NewTcpDataPack(), nil, 0, 0)
+	if err := mh.SendTaskToTaskQueue(GetTask(conn, NewNSQMsg(1, 0, smsg.SerializeNone, nil, nil))); err != nil {
+		t.Fatal(err)
+	}
+	sent := make(chan error, 1)
+	go func() { sent <- mh.SendTaskToTaskQueue(GetTask(conn, NewNSQMsg(2, 0, smsg.SerializeNone, nil, nil))) }()
+	select {
+	case err := <-sent:
+		t.Fatalf("the default policy does not block, err = %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	mh.StartWorkerPool()
+	defer mh.Stop()
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+}
+
+type blockRouter struct {
+	BaseRouter
+	release chan struct{}
+}
+
+func (r *blockRouter) Handle(task STask) error {
+	<-r.release
+	return nil
+}
+
+func waitWorkerNum(t *testing.T, mh STaskHandler, want int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for mh.WorkerNum() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("worker num = %d, want %d", mh.WorkerNum(), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTaskHandlerWorkerScaling(t *testing.T) {
+	slog.NewZapLog(&sconfig.Slog{Director: t.TempDir(), Level: "error"})
+	router := &blockRouter{release: make(chan struct{})}
+	mh := NewTaskHandler(1, 64, WithWorkerScaling(1, 4, 50*time.Millisecond))
+	mh.AddRouter(1, router)
+	mh.StartWorkerPool()
+	defer mh.Stop()
+
+	conn := NewConnection(nil, 1, 0, mh, nil, nil, nil, NewTcpDataPack(), nil, 0, 0)
+	const taskNum = 20
+	for i := 0; i < taskNum; i++ {
+		if err := mh.SendTaskToTaskQueue(GetTask(conn, NewNSQMsg(1, 0, smsg.SerializeNone, nil, nil))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the backlog grows the pool to the max (积压使工作池扩容到上限)
+	waitWorkerNum(t, mh, 4)
+
+	close(router.release)
+	// the idle pool shrinks back to the min (空闲的工作池缩容回下限)
+	waitWorkerNum(t, mh, 1)
+	if stats := mh.Stats()[1]; stats.Processed != taskNum {
+		t.Fatalf("processed %d tasks, want %d", stats.Processed, taskNum)
+	}
+
+	if err := mh.Resize(6); err != nil {
+		t.Fatal(err)
+	}
+	waitWorkerNum(t, mh, 6)
+
+	if err := NewTaskHandler(2, 1, WithOrderedDispatch(nil)).Resize(3); err != ErrResizeOrderedDispatch {
+		t.Fatalf("expected ErrResizeOrderedDispatch, got %v", err)
+	}
+
+	// Resize racing with the start either sets the size or resizes the started pool
+	// (与启动竞争的Resize要么设置工作池大小，要么调整已启动的工作池)
+	racing := NewTaskHandler(2, 16)
+	resizing, resized := make(chan struct{}), make(chan error, 1)
+	go func() {
+		close(resizing)
+		for i := 0; i < 1000; i++ {
+			if err := racing.Resize(3); err != nil {
+				resized <- err
+				return
+			}
+		}
+		resized <- nil
+	}()
+	<-resizing
+	racing.StartWorkerPool()
+	defer racing.Stop()
+	if err := <-resized; err != nil {
+		t.Fatal(err)
+	}
+	waitWorkerNum(t, racing, 3)
+}
+
+func TestTaskHandlerSubmit(t *testing.T) {
+	slog.NewZapLog(&sconfig.Slog{Director: t.TempDir(), Level: "error"})
+	mh := NewTaskHandler(4, 64, WithOrderedDispatch(nil))
+	mh.StartWorkerPool()
+	defer mh.Stop()
+
+	// the functions submitted to a connection run in order (提交到同一连接的函数按顺序执行)
+	conn := NewConnection(nil, 1, 0, mh, nil, nil, nil, NewTcpDataPack(), nil, 0, 0)
+	var seen []int
+	for i := 0; i < 20; i++ {
+		i := i
+		if err := mh.SubmitToConn(conn, func() { seen = append(seen, i) }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	last := SubmitFuture(mh, conn, func() ([]int, error) { return seen, nil })
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	got, err := last.Get(ctx)
+	if err != nil || len(got) != 20 {
+		t.Fatalf("unexpected result %v, %v", got, err)
+	}
+	for i, n := range got {
+		if n != i {
+			t.Fatalf("func %d ran at position %d", n, i)
+		}
+	}
+
+	panicked := SubmitFuture(mh, nil, func() (int, error) { panic("boom") })
+	if _, err := panicked.Get(ctx); err == nil {
+		t.Fatal("expected the panic as an error")
+	}
+
+	// the rejected future is completed with the error of the OverloadPolicy (被拒绝的future以OverloadPolicy的错误完成)
+	full := NewTaskHandler(1, 1, WithOverloadPolicy(OverloadReject, 0))
+	if err := full.Submit(func() {}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SubmitFuture(full, nil, func() (int, error) { return 1, nil }).Get(ctx); !errors.Is(err, ErrTaskQueueFull) {
+		t.Fatalf("expected ErrTaskQueueFull, got %v", err)
+	}
+	blocked := NewTaskHandler(1, 1, WithOverloadPolicy(OverloadBlock, 10*time.Millisecond))
+	if err := blocked.Submit(func() {}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SubmitFuture(blocked, nil, func() (int, error) { return 1, nil }).Get(ctx); !errors.Is(err, ErrTaskQueueTimeout) {
+		t.Fatalf("expected ErrTaskQueueTimeout, got %v", err)
+	}
+}
@@ -0,0 +1,170 @@
+package sbus
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/wwengg/threego/core/slog"
+)
+
+// OverloadPolicy decides what SendTaskToTaskQueue does when the queue is full
+// (队列满时SendTaskToTaskQueue的处理策略)
+type OverloadPolicy int
+
+const (
+	OverloadBlock      OverloadPolicy = iota // Block until the timeout if one is set, then reject the task (阻塞直到设置的超时，超时后拒绝任务)
+	OverloadReject                           // Reject the task immediately (立即拒绝任务)
+	OverloadDropOldest                       // Reject the oldest task in the queue to make room (拒绝队列中最早的任务以腾出空间)
+)
+
+// RetOverload is the Ret of the response replied to the rejected task (被拒绝任务的响应Ret)
+const RetOverload uint16 = 503
+
+var (
+	ErrTaskQueueFull    = errors.New("task queue is full")
+	ErrTaskQueueTimeout = errors.New("send task to task queue timeout")
+)
+
+// WithOverloadPolicy sets the policy when the queue is full, timeout is only used by OverloadBlock and 0 means
+// blocking forever, which is also what a TaskHandler without this option does, a rejected task is replied
+// with RetOverload if it came from a connection
+// (设置队列满时的处理策略，timeout仅用于OverloadBlock，0表示一直阻塞，未设置该选项的TaskHandler也是一直阻塞，
+// 来自连接的任务被拒绝时会回复RetOverload)
+func WithOverloadPolicy(policy OverloadPolicy, timeout time.Duration) TaskHandlerOption {
+	return func(mh *TaskHandler) {
+		mh.overloadPolicy = policy
+		mh.enqueueTimeout = timeout
+	}
+}
+
+// TaskStats is the counters of a msgID (某个msgID的计数)
+type TaskStats struct {
+	Queued    uint64 // The tasks sent to the queue (进入队列的任务数)
+	Processed uint64 // The tasks processed by the workers (worker处理完成的任务数)
+	Rejected  uint64 // The tasks rejected, timed out or dropped (被拒绝、超时或丢弃的任务数)
+}
+
+type taskCounter struct {
+	queued    atomic.Uint64
+	processed atomic.Uint64
+	rejected  atomic.Uint64
+}
+
+func (mh *TaskHandler) counter(msgID int32) *taskCounter {
+	if c, ok := mh.counters.Load(msgID); ok {
+		return c.(*taskCounter)
+	}
+	c, _ := mh.counters.LoadOrStore(msgID, &taskCounter{})
+	return c.(*taskCounter)
+}
+
+// Stats returns the counters of every msgID, the function tasks are counted by msgID 0
+// (返回每个msgID的计数，函数任务计入msgID 0)
+func (mh *TaskHandler) Stats() map[int32]TaskStats {
+	stats := make(map[int32]TaskStats)
+	mh.counters.Range(func(key, value any) bool {
+		c := value.(*taskCounter)
+		stats[key.(int32)] = TaskStats{
+			Queued:    c.queued.Load(),
+			Processed: c.processed.Load(),
+			Rejected:  c.rejected.Load(),
+		}
+		return true
+	})
+	return stats
+}
+
+// QueueLen returns the number of the tasks waiting in the queues (返回队列中等待的任务数)
+func (mh *TaskHandler) QueueLen() int {
+	if mh.keyFunc == nil {
+		return len(mh.TaskQueue)
+	}
+	n := 0
+	for _, q := range mh.taskQueues {
+		n += len(q)
+	}
+	return n
+}
+
+// QueueCap returns the capacity of the queues (返回队列的容量)
+func (mh *TaskHandler) QueueCap() int {
+	if mh.keyFunc == nil {
+		return cap(mh.TaskQueue)
+	}
+	n := 0
+	for _, q := range mh.taskQueues {
+		n += cap(q)
+	}
+	return n
+}
+
+// enqueue sends the task to the queue according to the OverloadPolicy
+// (根据OverloadPolicy将任务放入队列)
+func (mh *TaskHandler) enqueue(queue chan STask, task STask) error {
+	msgID := task.GetMsgID()
+	select {
+	case queue <- task:
+		mh.counter(msgID).queued.Add(1)
+		return nil
+	default:
+	}
+
+	switch mh.overloadPolicy {
+	case OverloadReject:
+		mh.reject(task, ErrTaskQueueFull)
+		return ErrTaskQueueFull
+	case OverloadDropOldest:
+		for {
+			select {
+			case queue <- task:
+				mh.counter(msgID).queued.Add(1)
+				return nil
+			default:
+			}
+			select {
+			case oldest := <-queue:
+				mh.reject(oldest, ErrTaskQueueFull)
+			default:
+			}
+		}
+	default:
+		var timeout <-chan time.Time
+		if mh.enqueueTimeout > 0 {
+			timer := time.NewTimer(mh.enqueueTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case queue <- task:
+			mh.counter(msgID).queued.Add(1)
+			return nil
+		case <-timeout:
+			mh.reject(task, ErrTaskQueueTimeout)
+			return ErrTaskQueueTimeout
+		}
+	}
+}
+
+// reject counts the task, replies RetOverload with err to its connection and puts it back to the TaskPool,
+// a function task gets err by its onReject
+// (计数、向任务的连接回复带有err的RetOverload并将其放回TaskPool，函数任务通过onReject收到err)
+func (mh *TaskHandler) reject(task STask, err error) {
+	mh.counter(task.GetMsgID()).rejected.Add(1)
+	if _, ok := task.(SFuncTask); ok {
+		if ft, ok := task.(*funcTask); ok && ft.onReject != nil {
+			ft.onReject(err)
+		}
+		return
+	}
+	defer PutTask(task)
+
+	conn, msg := task.GetConnection(), task.GetMessage()
+	if conn == nil || msg == nil {
+		return
+	}
+	slog.Ins().Warnf("%s, reject msgID = %d of connID = %d", err, task.GetMsgID(), conn.GetConnID())
+	if err := conn.SendBuffMsg(NewErrorResponseMsg(msg, RetOverload, err.Error())); err != nil {
+		slog.Ins().Errorf("reply overload to connID = %d error: %s", conn.GetConnID(), err)
+	}
+}
@@ -0,0 +1,134 @@
+package sbus
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/wwengg/threego/core/slog"
+)
+
+// The interval of checking the queue depth and the idle workers (检查队列深度以及空闲worker的间隔)
+const workerScaleInterval = 100 * time.Millisecond
+
+var ErrResizeOrderedDispatch = errors.New("the worker pool can not be resized in the ordered dispatch mode")
+
+// WithWorkerScaling makes the worker pool grow up to maxWorkers when more tasks are waiting than workers,
+// and shrink down to minWorkers by one worker every idleTimeout while the queue is empty,
+// it is ignored in the ordered dispatch mode
+// (等待的任务数多于worker数时，工作池最多扩容到maxWorkers，队列为空时每隔idleTimeout缩容一个worker直到minWorkers，
+// 顺序分发模式下忽略该选项)
+func WithWorkerScaling(minWorkers, maxWorkers uint32, idleTimeout time.Duration) TaskHandlerOption {
+	if minWorkers == 0 || minWorkers > maxWorkers || idleTimeout <= 0 {
+		panic(fmt.Sprintf("sbus: invalid worker scaling min = %d, max = %d, idle = %v", minWorkers, maxWorkers, idleTimeout))
+	}
+	return func(mh *TaskHandler) {
+		mh.minWorkers = minWorkers
+		mh.maxWorkers = maxWorkers
+		mh.workerIdleTimeout = idleTimeout
+	}
+}
+
+// Resize sets the number of the workers at runtime, such as from a config hot-reload, the bounds of
+// WithWorkerScaling are extended to include n, the retiring workers finish their current task first,
+// so no queued task is lost, before StartWorkerPool it only records n as the size of the pool
+// (运行时设置worker数量，例如配置热更新时，WithWorkerScaling的上下限会扩展到包含n，
+// 退出的worker会先完成当前任务，所以队列中的任务不会丢失，StartWorkerPool之前只将n记录为工作池大小)
+func (mh *TaskHandler) Resize(n uint32) error {
+	if mh.keyFunc != nil {
+		return ErrResizeOrderedDispatch
+	}
+	if n == 0 {
+		return errors.New("the worker pool size must be positive")
+	}
+	mh.scaleLock.Lock()
+	defer mh.scaleLock.Unlock()
+	if n < mh.minWorkers {
+		mh.minWorkers = n
+	}
+	if n > mh.maxWorkers {
+		mh.maxWorkers = n
+	}
+	mh.targetNum = n
+	if mh.started {
+		mh.applyTargetLocked()
+	} else {
+		mh.WorkerPoolSize = n
+	}
+	return nil
+}
+
+// WorkerNum returns the number of the running workers (返回运行中的worker数量)
+func (mh *TaskHandler) WorkerNum() int {
+	mh.scaleLock.Lock()
+	defer mh.scaleLock.Unlock()
+	if mh.keyFunc != nil {
+		return int(mh.WorkerPoolSize)
+	}
+	return int(mh.workerNum)
+}
+
+func (mh *TaskHandler) startWorkerLocked() {
+	mh.workerNum++
+	mh.nextWorkerID++
+	mh.wg.Add(1)
+	go mh.StartOneWorker(mh.nextWorkerID-1, mh.TaskQueue)
+}
+
+// applyTargetLocked starts or retires the workers to reach targetNum, only the idle workers waiting for
+// the queue can be retired, the rest are retired by the next check
+// (启动或退出worker以达到targetNum，只有正在等待队列的空闲worker会退出，其余的在下一次检查时退出)
+func (mh *TaskHandler) applyTargetLocked() {
+	for mh.workerNum < mh.targetNum {
+		mh.startWorkerLocked()
+	}
+	for mh.workerNum > mh.targetNum {
+		select {
+		case mh.retireChan <- struct{}{}:
+			mh.workerNum--
+		default:
+			mh.WorkerPoolSize = mh.targetNum
+			return
+		}
+	}
+	mh.WorkerPoolSize = mh.targetNum
+}
+
+// scaleMonitor adjusts targetNum by the queue depth and the idle time, and applies it
+// (根据队列深度以及空闲时间调整targetNum并执行)
+func (mh *TaskHandler) scaleMonitor() {
+	defer mh.wg.Done()
+	ticker := time.NewTicker(workerScaleInterval)
+	defer ticker.Stop()
+
+	var idleSince time.Time
+	for {
+		select {
+		case <-mh.ctx.Done():
+			return
+		case now := <-ticker.C:
+			mh.scaleLock.Lock()
+			if mh.workerIdleTimeout > 0 {
+				queueLen := uint32(len(mh.TaskQueue))
+				switch {
+				case queueLen > mh.workerNum && mh.targetNum < mh.maxWorkers:
+					mh.targetNum = min(mh.maxWorkers, mh.targetNum+queueLen-mh.workerNum)
+					idleSince = time.Time{}
+					slog.Ins().Debugf("task queue len = %d, grow the worker pool to %d", queueLen, mh.targetNum)
+				case queueLen == 0 && uint32(mh.busyWorkers.Load()) < mh.workerNum:
+					if idleSince.IsZero() {
+						idleSince = now
+					} else if now.Sub(idleSince) >= mh.workerIdleTimeout && mh.targetNum > mh.minWorkers {
+						mh.targetNum--
+						idleSince = now
+						slog.Ins().Debugf("worker pool is idle, shrink it to %d", mh.targetNum)
+					}
+				default:
+					idleSince = time.Time{}
+				}
+			}
+			mh.applyTargetLocked()
+			mh.scaleLock.Unlock()
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package sbus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"runtime"
+
+	"github.com/wwengg/threego/core/slog"
+)
+
+const (
+	// the length of the total length field (总长度字段的字节数)
+	tcpLengthFieldLen = 4
+	// TcpMaxFrameLength is the default max frame length of the TcpDataPack
+	// (TcpDataPack默认的最大帧长度)
+	TcpMaxFrameLength uint64 = 4 << 20
+)
+
+var ErrDataLenMismatch = errors.New("declared data length does not match the actual data length")
+
+type TcpDataPack struct {
+	// Data shorter than CompressThreshold is not compressed, 0 means always compress
+	// (长度小于CompressThreshold的数据不压缩，0表示总是压缩)
+	CompressThreshold uint32
+}
+
+var TcpDataPackObj = new(TcpDataPack)
+
+// The same layout as NsqDataPack, prefixed with the length of the rest of the frame when
+// the connection has a FrameDecoder, so the same SMsg works for both NSQ and socket clients
+// (与NsqDataPack布局相同，连接存在FrameDecoder时前面加上帧剩余部分的长度，
+// 使同一个SMsg同时适用于NSQ和socket客户端)
+//+-----------+------+-------+---------+---------------+--------------+-------------+-------+------------+--------------+-------------+------------+
+//| total len | CMD  |  Ret  | version | SerializeType | CompressType | messageType |  seq  |  meta len  |   meta data  |   data len  |    data    |
+//|   4字节    | 2字节 |  2字节 |  1字节  |     4bit      |     2bit     |      2bit   | 8字节  |    4字节    |     n字节    |      4字节   |    n字节    |
+//+-----------+------+-------+---------+---------------+--------------+-------------+-------+------------+--------------+-------------+------------+
+//| total len = the length of the bytes after it (其后所有字节的长度)
+//| only present when SMsg.GetHasFrameDecoder() is true (仅当SMsg.GetHasFrameDecoder()为true时存在)
+//+-----------+
+
+func NewTcpDataPack() SDataPack { return &TcpDataPack{} }
+
+// TcpLengthField returns the LengthField to decode the frames packed by TcpDataPack,
+// the total length field is stripped so Unpack gets the same bytes as NsqDataPack
+// (返回解码TcpDataPack封包的LengthField，去掉总长度字段后Unpack得到与NsqDataPack相同的字节)
+func TcpLengthField() LengthField {
+	return LengthField{
+		Order:               binary.BigEndian,
+		MaxFrameLength:      TcpMaxFrameLength,
+		LengthFieldOffset:   0,
+		LengthFieldLength:   tcpLengthFieldLen,
+		LengthAdjustment:    0,
+		InitialBytesToStrip: tcpLengthFieldLen,
+	}
+}
+
+func (dp *TcpDataPack) GetHeadLen() uint32 {
+	// total len uint32(4 bytes) + header
+	return tcpLengthFieldLen + nsqDataHeaderLen
+}
+
+// Pack packs the message, the total length is written only if the msg is sent by a connection with a FrameDecoder
+// (封包方法，只有发送消息的连接存在FrameDecoder时才写入总长度)
+func (dp *TcpDataPack) Pack(msg SMsg) ([]byte, error) {
+	dataBuff := bytes.NewBuffer(make([]byte, 0, int(dp.GetHeadLen())+len(msg.GetMeta())*64+len(msg.GetData())))
+
+	hasFrameDecoder := msg.GetHasFrameDecoder()
+	if hasFrameDecoder {
+		// Reserve the total length, filled in after the body is written
+		// (预留总长度，写完body之后再回填)
+		dataBuff.Write(make([]byte, tcpLengthFieldLen))
+	}
+	if err := packMsg(dataBuff, msg, dp.CompressThreshold); err != nil {
+		return nil, err
+	}
+
+	data := dataBuff.Bytes()
+	if hasFrameDecoder {
+		bodyLen := len(data) - tcpLengthFieldLen
+		if uint64(bodyLen) > TcpMaxFrameLength {
+			return nil, fmt.Errorf("%w: %d > %d", ErrFrameTooLong, bodyLen, TcpMaxFrameLength)
+		}
+		binary.BigEndian.PutUint32(data, uint32(bodyLen))
+	}
+	return data, nil
+}
+
+// Unpack unpacks the frame whose total length has been stripped by the FrameDecoder
+// (拆包方法，总长度已被FrameDecoder去掉)
+func (dp *TcpDataPack) Unpack(binaryData []byte) (ret SMsg, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			var errStack = make([]byte, 1024)
+			n := runtime.Stack(errStack, true)
+			slog.Ins().Errorf("panic in message decode: %v, stack: %s", r, errStack[:n])
+			ret, err = nil, fmt.Errorf("tcp datapack unpack panic: %v", r)
+		}
+	}()
+	dataBuff := bytes.NewReader(binaryData)
+
+	msg := &NSQMsg{}
+	if _, err := unpackHeader(dataBuff, msg); err != nil {
+		return nil, err
+	}
+
+	var dataLen uint32
+	if err := binary.Read(dataBuff, binary.BigEndian, &dataLen); err != nil {
+		return nil, err
+	}
+	// Validate the declared data length against the actual bytes
+	// (校验声明的数据长度与实际字节数)
+	if remain := dataBuff.Len(); uint32(remain) != dataLen {
+		return nil, fmt.Errorf("%w: declared %d, actual %d", ErrDataLenMismatch, dataLen, remain)
+	}
+	if dataLen > 0 {
+		msg.Data = binaryData[len(binaryData)-int(dataLen):]
+	}
+	// Decompress the data (解压数据)
+	if msg.Data, err = decompressData(msg.CompressType, msg.Data); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
@@ -0,0 +1,80 @@
+package sbus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/wwengg/threego/core/smsg"
+)
+
+func TestTcpDataPackRoundTripWithFrameDecoder(t *testing.T) {
+	pack := NewTcpDataPack()
+	decoder := NewLengthFieldFrameDecoder(TcpLengthField())
+
+	var stream []byte
+	for i, body := range []string{"first", "", "third message"} {
+		msg := NewNSQMsg(uint16(i+1), 0, smsg.JSON, map[string]string{"k": body}, []byte(body))
+		msg.CompressType = smsg.None
+		msg.SetHasFrameDecoder(true)
+		packData, err := pack.Pack(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream = append(stream, packData...)
+	}
+
+	// feed the stream byte by byte (逐字节喂入数据流)
+	var frames [][]byte
+	for i := range stream {
+		got, err := decoder.Decode(stream[i : i+1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, got...)
+	}
+	if len(frames) != 3 {
+		t.Fatalf("expected 3 frames, got %d", len(frames))
+	}
+	for i, body := range []string{"first", "", "third message"} {
+		msg, err := pack.Unpack(frames[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.GetCmd() != uint16(i+1) || msg.GetSerializeType() != smsg.JSON || msg.GetMeta()["k"] != body {
+			t.Fatalf("frame %d: unexpected header %+v", i, msg)
+		}
+		if !bytes.Equal(msg.GetData(), []byte(body)) {
+			t.Fatalf("frame %d: data = %q, want %q", i, msg.GetData(), body)
+		}
+	}
+}
+
+func TestTcpDataPackDataLenMismatch(t *testing.T) {
+	pack := NewTcpDataPack()
+	msg := NewNSQMsg(1, 0, smsg.ProtoBuffer, nil, []byte("payload"))
+	msg.CompressType = smsg.None
+	packData, err := pack.Pack(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pack.Unpack(packData[:len(packData)-1]); !errors.Is(err, ErrDataLenMismatch) {
+		t.Fatalf("expected ErrDataLenMismatch, got %v", err)
+	}
+}
+
+func TestTcpDataPackMetaLenExceeded(t *testing.T) {
+	pack := NewTcpDataPack()
+	msg := NewNSQMsg(1, 0, smsg.ProtoBuffer, nil, nil)
+	msg.CompressType = smsg.None
+	packData, err := pack.Pack(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the meta len follows cmd, ret, version, the type byte and seq (meta len位于cmd、ret、version、类型字节以及seq之后)
+	binary.BigEndian.PutUint32(packData[14:], 0xFFFFFFFF)
+	if _, err := pack.Unpack(packData); !errors.Is(err, ErrMetaLenExceeded) {
+		t.Fatalf("expected ErrMetaLenExceeded, got %v", err)
+	}
+}
@@ -0,0 +1,215 @@
+package sbus
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/wwengg/threego/core/slog"
+)
+
+// DefaultTLSHandshakeTimeout is the timeout of the TLS handshake of an accepted connection
+// (已接收连接的TLS握手超时时间)
+const DefaultTLSHandshakeTimeout = 10 * time.Second
+
+// The properties of the peer certificate verified by the mutual TLS (双向TLS验证通过的对端证书属性)
+const (
+	PropertyKeyPeerCert        = "sbus.tls.peerCert"        // *x509.Certificate
+	PropertyKeyPeerCommonName  = "sbus.tls.peerCommonName"  // string
+	PropertyKeyPeerDNSNames    = "sbus.tls.peerDNSNames"    // []string
+	PropertyKeyPeerFingerprint = "sbus.tls.peerFingerprint" // string, the hex SHA-256 of the certificate (证书的十六进制SHA-256)
+)
+
+// The delay of reloading after the last change, so a cert and a key written one by one are loaded together
+// (最后一次变更后延迟重新加载，使先后写入的证书和私钥一起加载)
+const certReloadDelay = 100 * time.Millisecond
+
+// CertReloader serves the certificate of certPath and keyPath and reloads it when the files change,
+// a failed reload keeps the previous certificate
+// (提供certPath和keyPath的证书，文件变更时重新加载，加载失败时保留之前的证书)
+type CertReloader struct {
+	certPath string
+	keyPath  string
+	cert     atomic.Pointer[tls.Certificate]
+
+	watcher   *fsnotify.Watcher
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// NewCertReloader loads the certificate and watches the directories of the files, so the files replaced
+// by a rename, such as a mounted kubernetes secret, are reloaded too
+// (加载证书并监听文件所在的目录，通过rename替换的文件，例如挂载的kubernetes secret，也会重新加载)
+func NewCertReloader(certPath, keyPath string) (*CertReloader, error) {
+	r := &CertReloader{
+		certPath: filepath.Clean(certPath),
+		keyPath:  filepath.Clean(keyPath),
+		done:     make(chan struct{}),
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range []string{filepath.Dir(r.certPath), filepath.Dir(r.keyPath)} {
+		if err = watcher.Add(dir); err != nil {
+			_ = watcher.Close()
+			return nil, err
+		}
+	}
+	r.watcher = watcher
+	go r.watch()
+	return r, nil
+}
+
+// Reload loads the certificate from the files (从文件加载证书)
+func (r *CertReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		return fmt.Errorf("sbus: load certificate %s: %w", r.certPath, err)
+	}
+	r.cert.Store(&cert)
+	return nil
+}
+
+// GetCertificate is used as tls.Config.GetCertificate (用作tls.Config.GetCertificate)
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load(), nil
+}
+
+// Close stops watching the files (停止监听文件)
+func (r *CertReloader) Close() error {
+	var err error
+	r.closeOnce.Do(func() {
+		close(r.done)
+		err = r.watcher.Close()
+	})
+	return err
+}
+
+func (r *CertReloader) watch() {
+	timer := time.NewTimer(certReloadDelay)
+	timer.Stop()
+	defer timer.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case event, ok := <-r.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Has(fsnotify.Chmod) && !event.Has(fsnotify.Write) {
+				continue
+			}
+			// every change in the directories is considered, a symlink swap does not touch the files themselves
+			// (目录中的任何变更都会触发，替换符号链接不会改动文件本身)
+			timer.Reset(certReloadDelay)
+		case err, ok := <-r.watcher.Errors:
+			if !ok {
+				return
+			}
+			slog.Ins().Errorf("watch certificate %s error: %s", r.certPath, err)
+		case <-timer.C:
+			if err := r.Reload(); err != nil {
+				slog.Ins().Errorf("reload certificate error, keep the previous one: %s", err)
+				continue
+			}
+			slog.Ins().Infof("certificate %s reloaded", r.certPath)
+		}
+	}
+}
+
+// WithTLS makes the tcp listener serve TLS with tlsConf, set ClientAuth and ClientCAs in tlsConf for the
+// mutual TLS, the verified peer certificate is set to the connection by the PropertyKeyPeer properties
+// (tcp监听使用tlsConf提供TLS，需要双向TLS时在tlsConf中设置ClientAuth和ClientCAs，
+// 验证通过的对端证书通过PropertyKeyPeer系列属性设置到连接上)
+func WithTLS(tlsConf *tls.Config) ServerOption {
+	return func(s *Server) {
+		s.tlsConf = tlsConf
+	}
+}
+
+// WithTLSFiles is WithTLS with the certificate of certPath and keyPath reloaded when the files change,
+// a non-empty clientCAPath enables the mutual TLS that requires the client certificates signed by it,
+// the error of loading the files is returned by Start
+// (使用certPath和keyPath的证书的WithTLS，文件变更时重新加载证书，clientCAPath非空时开启双向TLS，
+// 要求客户端证书由其签发，加载文件的错误由Start返回)
+func WithTLSFiles(certPath, keyPath, clientCAPath string) ServerOption {
+	tlsConf := &tls.Config{MinVersion: tls.VersionTLS12}
+	if clientCAPath != "" {
+		caPEM, err := os.ReadFile(clientCAPath)
+		if err != nil {
+			return withConfErr(fmt.Errorf("sbus: read client CA %s: %w", clientCAPath, err))
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return withConfErr(fmt.Errorf("sbus: no certificate found in client CA %s", clientCAPath))
+		}
+		tlsConf.ClientCAs = pool
+		tlsConf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	// the reloader is created last, so its watcher is not left running by an error above
+	// (最后创建reloader，避免上面的错误使其监听协程遗留)
+	reloader, err := NewCertReloader(certPath, keyPath)
+	if err != nil {
+		return withConfErr(err)
+	}
+	tlsConf.GetCertificate = reloader.GetCertificate
+	return func(s *Server) {
+		s.tlsConf = tlsConf
+		s.certReloader = reloader
+	}
+}
+
+// WithTLSHandshakeTimeout sets the timeout of the TLS handshake, DefaultTLSHandshakeTimeout by default
+// (设置TLS握手超时时间，默认为DefaultTLSHandshakeTimeout)
+func WithTLSHandshakeTimeout(timeout time.Duration) ServerOption {
+	return func(s *Server) {
+		s.tlsHandshakeTimeout = timeout
+	}
+}
+
+// serveTLSConn finishes the handshake before starting the connection, so a slow client does not block
+// the accept loop and the peer properties are ready in OnConnStart
+// (启动连接前完成握手，慢客户端不会阻塞accept循环，且OnConnStart中对端属性已就绪)
+func (s *Server) serveTLSConn(conn *tls.Conn) {
+	defer s.wg.Done()
+	timeout := s.tlsHandshakeTimeout
+	if timeout <= 0 {
+		timeout = DefaultTLSHandshakeTimeout
+	}
+	ctx, cancel := context.WithTimeout(s.ctx, timeout)
+	defer cancel()
+	if err := conn.HandshakeContext(ctx); err != nil {
+		slog.Ins().Debugf("[%s] tls handshake with %s error: %s", s.Name, conn.RemoteAddr().String(), err)
+		_ = conn.Close()
+		return
+	}
+	s.startConn(conn, peerProperties(conn.ConnectionState()))
+}
+
+func peerProperties(state tls.ConnectionState) map[string]any {
+	if len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	cert := state.PeerCertificates[0]
+	sum := sha256.Sum256(cert.Raw)
+	return map[string]any{
+		PropertyKeyPeerCert:        cert,
+		PropertyKeyPeerCommonName:  cert.Subject.CommonName,
+		PropertyKeyPeerDNSNames:    cert.DNSNames,
+		PropertyKeyPeerFingerprint: hex.EncodeToString(sum[:]),
+	}
+}
@@ -0,0 +1,198 @@
+package sbus
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/wwengg/threego/core/sconfig"
+	"github.com/wwengg/threego/core/slog"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCert issues a certificate of cn signed by parent, or a self-signed CA if parent is nil
+// (签发cn的证书，parent为nil时签发自签名CA)
+func newTestCert(t *testing.T, cn string, serial int64, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{cn},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func (c *testCert) tlsCert(t *testing.T) tls.Certificate {
+	t.Helper()
+	cert, err := tls.X509KeyPair(c.certPEM, c.keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	// replace the file by a rename like most deployment tools (与大多数部署工具一样通过rename替换文件)
+	if err := os.WriteFile(path+".tmp", data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerMutualTLS(t *testing.T) {
+	slog.NewZapLog(&sconfig.Slog{Director: t.TempDir(), Level: "error"})
+
+	dir := t.TempDir()
+	ca := newTestCert(t, "test ca", 1, nil)
+	server := newTestCert(t, "localhost", 2, ca)
+	client := newTestCert(t, "client-1", 3, ca)
+	certPath, keyPath, caPath := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), filepath.Join(dir, "ca.crt")
+	writeFile(t, certPath, server.certPEM)
+	writeFile(t, keyPath, server.keyPEM)
+	writeFile(t, caPath, ca.certPEM)
+
+	started := make(chan SConnection, 4)
+	s := NewServer("tls", "tcp", "127.0.0.1", 0,
+		WithTLSFiles(certPath, keyPath, caPath),
+		WithOnConnStart(func(conn SConnection) { started <- conn }))
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	dial := func(certs ...tls.Certificate) (*tls.Conn, error) {
+		conn, err := tls.Dial("tcp", s.Addr().String(), &tls.Config{RootCAs: roots, ServerName: "localhost", Certificates: certs})
+		if err != nil {
+			return nil, err
+		}
+		// the server verifies the client certificate after the client finishes (服务端在客户端完成后验证客户端证书)
+		_ = conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		_, err = conn.Read(make([]byte, 1))
+		_ = conn.SetReadDeadline(time.Time{})
+		if ne, ok := err.(interface{ Timeout() bool }); ok && ne.Timeout() {
+			err = nil
+		}
+		return conn, err
+	}
+
+	conn, err := dial(client.tlsCert(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	select {
+	case sc := <-started:
+		if cn, err := GetPropertyAs[string](sc, PropertyKeyPeerCommonName); err != nil || cn != "client-1" {
+			t.Fatalf("unexpected peer common name %q, %v", cn, err)
+		}
+		if cert, err := GetPropertyAs[*x509.Certificate](sc, PropertyKeyPeerCert); err != nil || cert.SerialNumber.Int64() != 3 {
+			t.Fatalf("unexpected peer certificate %v, %v", cert, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the tls connection is not started")
+	}
+
+	// the client without a certificate is rejected (没有证书的客户端被拒绝)
+	if conn, err := dial(); err == nil {
+		conn.Close()
+		t.Fatal("expected the handshake to fail without a client certificate")
+	}
+
+	// the rotated certificate is served to the new connections (新连接使用轮换后的证书)
+	rotated := newTestCert(t, "localhost", 4, ca)
+	writeFile(t, keyPath, rotated.keyPEM)
+	writeFile(t, certPath, rotated.certPEM)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn, err := dial(client.tlsCert(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		serial := conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+		conn.Close()
+		if serial == 4 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the certificate is not reloaded, serial = %d", serial)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestWithTLSFilesError(t *testing.T) {
+	slog.NewZapLog(&sconfig.Slog{Director: t.TempDir(), Level: "error"})
+
+	dir := t.TempDir()
+	ca := newTestCert(t, "test ca", 1, nil)
+	server := newTestCert(t, "localhost", 2, ca)
+	certPath, keyPath, caPath := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), filepath.Join(dir, "ca.crt")
+	writeFile(t, certPath, server.certPEM)
+	writeFile(t, keyPath, server.keyPEM)
+	writeFile(t, caPath, []byte("not a certificate"))
+
+	// the errors of the files are returned by Start instead of a panic (文件的错误由Start返回而不是panic)
+	for _, files := range [][3]string{
+		{filepath.Join(dir, "missing.crt"), keyPath, ""},
+		{certPath, filepath.Join(dir, "missing.key"), ""},
+		{certPath, keyPath, filepath.Join(dir, "missing-ca.crt")},
+		{certPath, keyPath, caPath},
+	} {
+		s := NewServer("tls", "tcp", "127.0.0.1", 0, WithTLSFiles(files[0], files[1], files[2]))
+		err := s.Start()
+		s.Stop()
+		if err == nil {
+			t.Fatalf("expected the error of %v", files)
+		}
+	}
+}
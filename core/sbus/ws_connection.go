@@ -1,33 +1,109 @@
 package sbus
 
 import (
-	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/wwengg/threego/core/slog"
 )
 
+// The timeout of writing the control frames, such as ping and close
+// (写入ping、close等控制帧的超时时间)
+const wsControlWriteTimeout = time.Second
+
 type WsConnection struct {
 	Connection
 	// conn is the current connection's WebSocket socket TCP socket. (当前连接的socket TCP套接字)
 	conn *websocket.Conn
+	// The interval of sending ping frames, 0 means no ping (发送ping帧的间隔，0表示不发送)
+	pingInterval time.Duration
 }
 
-func NewWsConnection(cID uint64, taskHandler STaskHandler, conn *websocket.Conn, onConnStart, onConnStop func(conn SConnection), datapack SDataPack) SConnection {
-	return &WsConnection{
+// NewWsConnection creates a connection that reads and writes a message per WebSocket frame,
+// the msg is written as a binary frame and no FrameDecoder is needed
+// (创建一个WebSocket连接，每个WebSocket帧对应一个消息，消息以二进制帧写入，不需要FrameDecoder)
+func NewWsConnection(cID uint64, taskHandler STaskHandler, conn *websocket.Conn, onConnStart, onConnStop func(conn SConnection), datapack SDataPack, connManager SConnManager, heartbeatDuration, pingInterval time.Duration, opts ...ConnOption) SConnection {
+	wc := &WsConnection{
 		Connection: Connection{
-			ConnID:         cID,
-			ConnIdStr:      fmt.Sprintf("%d", cID),
-			TaskHandler:    taskHandler,
-			OnConnStart:    onConnStart,
-			OnConnStop:     onConnStop,
-			Datapack:       datapack,
-			Property:       nil,
-			IOReadBuffSize: 0,
+			Conn:              conn.NetConn(),
+			ConnID:            cID,
+			ConnIdStr:         fmt.Sprintf("%d", cID),
+			TaskHandler:       taskHandler,
+			OnConnStart:       onConnStart,
+			OnConnStop:        onConnStop,
+			Datapack:          datapack,
+			Property:          nil,
+			IOReadBuffSize:    0,
+			connManager:       connManager,
+			heartBeatDuration: heartbeatDuration,
+			readFunc:          wsReadFunc(conn),
+			sendFunc:          wsSendFunc(conn),
+			closeFunc:         wsCloseFunc(conn),
+			readDeadlineFunc:  conn.SetReadDeadline,
+			writeDeadlineFunc: conn.SetWriteDeadline,
 		},
-		conn: conn,
+		conn:         conn,
+		pingInterval: pingInterval,
+	}
+	for _, opt := range opts {
+		opt(&wc.Connection)
+	}
+	wc.self = wc
+	wc.init()
+
+	// Both ping and pong frames from the client mean it is alive, so they extend the read deadline too
+	// (客户端的ping帧与pong帧都表示其存活，所以也会延长读超时时间)
+	conn.SetPongHandler(func(string) error {
+		wc.updateActivity()
+		wc.setReadDeadline()
+		return nil
+	})
+	conn.SetPingHandler(func(appData string) error {
+		wc.updateActivity()
+		wc.setReadDeadline()
+		err := conn.WriteControl(websocket.PongMessage, []byte(appData), time.Now().Add(wsControlWriteTimeout))
+		if errors.Is(err, websocket.ErrCloseSent) {
+			return nil
+		}
+		return err
+	})
+	return wc
+}
+
+// Start starts the ping goroutine before starting the connection
+// (启动连接之前先启动ping协程)
+func (wc *WsConnection) Start() {
+	if wc.pingInterval > 0 {
+		wc.goRoutine(wc.startPinger)
 	}
+	wc.Connection.Start()
+}
+
+// startPinger sends a ping frame every pingInterval, the connection is stopped if the ping fails
+// (每隔pingInterval发送一个ping帧，发送失败时停止连接)
+func (wc *WsConnection) startPinger() {
+	ticker := time.NewTicker(wc.pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := wc.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsControlWriteTimeout)); err != nil {
+				slog.Ins().Errorf("websocket ping connID=%d error: %s", wc.ConnID, err)
+				wc.Stop()
+				return
+			}
+		case <-wc.ctx.Done():
+			return
+		}
+	}
+}
+
+// GetWsConn returns the underlying WebSocket connection (返回底层的WebSocket连接)
+func (wc *WsConnection) GetWsConn() *websocket.Conn {
+	return wc.conn
 }
 
 func wsSendFunc(wsConn *websocket.Conn) func([]byte) error {
@@ -36,26 +112,30 @@ func wsSendFunc(wsConn *websocket.Conn) func([]byte) error {
 	}
 }
 
-func wsReadFunc(wsConn *websocket.Conn) func(conn SConnection, buffer []byte) (n int, err error) {
-	return func(conn SConnection, buffer []byte) (n int, err error) {
-		if len(buffer) != 0 {
-			buffer = buffer[len(buffer):]
-		}
-		messageType, buffer, err := wsConn.ReadMessage()
+// wsReadFunc reads a whole message, the control frames are handled by the ping, pong and close handlers
+// inside ReadMessage, a normal close from the client is reported as io.EOF
+// (读取一个完整的消息，控制帧在ReadMessage内部由ping、pong以及close处理器处理，客户端正常关闭时返回io.EOF)
+func wsReadFunc(wsConn *websocket.Conn) func(buffer []byte) ([]byte, error) {
+	return func(buffer []byte) ([]byte, error) {
+		_, data, err := wsConn.ReadMessage()
 		if err != nil {
-			conn.Stop()
-			return 0, fmt.Errorf("websocket Read Error: %s", err.Error())
-		}
-		if messageType == websocket.PingMessage {
-			//conn.updateActivity()
-			return 0, nil
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				return nil, io.EOF
+			}
+			return nil, err
 		}
-		n = len(buffer)
-		if err != nil {
-			return 0, fmt.Errorf("read msg head [read datalen=%d], error = %s", n, err.Error())
-		}
-		slog.Ins().Debugf("read buffer %s \n", hex.EncodeToString(buffer[0:n]))
+		return data, nil
+	}
+}
 
-		return n, nil
+// wsCloseFunc sends a close frame before closing the socket, the error of the close frame is ignored
+// because the client may have closed the connection already
+// (关闭socket之前先发送close帧，客户端可能已经关闭连接，所以忽略close帧的错误)
+func wsCloseFunc(wsConn *websocket.Conn) func() error {
+	return func() error {
+		_ = wsConn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+			time.Now().Add(wsControlWriteTimeout))
+		return wsConn.Close()
 	}
 }
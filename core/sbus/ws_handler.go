@@ -0,0 +1,189 @@
+package sbus
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/wwengg/threego/core/slog"
+)
+
+var ErrMaxConn = errors.New("too many connections")
+
+// DefaultWsReadLimit is the max size of a message read from the client when ReadLimit is not set
+// (未设置ReadLimit时从客户端读取的消息最大长度)
+const DefaultWsReadLimit int64 = 4 << 20
+
+type WsHandlerOption func(h *WsHandler)
+
+// WsHandler upgrades the http requests to WebSocket connections and registers them in the SConnManager
+// like the tcp connections, it is a http.Handler so it can be mounted on the Gin engine by gin.WrapH
+// (将http请求升级为WebSocket连接，并与tcp连接一样注册到SConnManager中，
+// 它是一个http.Handler，所以可以通过gin.WrapH挂载到Gin engine上)
+type WsHandler struct {
+	Upgrader websocket.Upgrader
+	// The max connections, 0 means no limit (最大连接数，0表示不限制)
+	MaxConn int
+	// The max size of a message read from the client, 0 means DefaultWsReadLimit and a negative value means no limit
+	// (从客户端读取的消息最大长度，0表示DefaultWsReadLimit，负数表示不限制)
+	ReadLimit int64
+	// The interval of sending ping frames, 0 means no ping (发送ping帧的间隔，0表示不发送)
+	PingInterval time.Duration
+	// The duration without any data from the client after which the connection is not alive
+	// (客户端在该时间内没有任何数据则认为连接不存活)
+	HeartbeatMax time.Duration
+
+	taskHandler STaskHandler
+	connMgr     SConnManager
+	datapack    SDataPack
+	connOpts    []ConnOption
+	hc          SHeartbeatChecker
+
+	onConnStart func(conn SConnection)
+	onConnStop  func(conn SConnection)
+}
+
+func WithWsUpgrader(upgrader websocket.Upgrader) WsHandlerOption {
+	return func(h *WsHandler) {
+		h.Upgrader = upgrader
+	}
+}
+
+func WithWsDataPack(datapack SDataPack) WsHandlerOption {
+	return func(h *WsHandler) {
+		h.datapack = datapack
+	}
+}
+
+func WithWsConnOptions(opts ...ConnOption) WsHandlerOption {
+	return func(h *WsHandler) {
+		h.connOpts = append(h.connOpts, opts...)
+	}
+}
+
+func WithWsOnConnStart(f func(conn SConnection)) WsHandlerOption {
+	return func(h *WsHandler) {
+		h.onConnStart = f
+	}
+}
+
+func WithWsOnConnStop(f func(conn SConnection)) WsHandlerOption {
+	return func(h *WsHandler) {
+		h.onConnStop = f
+	}
+}
+
+func WithWsMaxConn(maxConn int) WsHandlerOption {
+	return func(h *WsHandler) {
+		h.MaxConn = maxConn
+	}
+}
+
+func WithWsReadLimit(limit int64) WsHandlerOption {
+	return func(h *WsHandler) {
+		h.ReadLimit = limit
+	}
+}
+
+// WithWsPingInterval makes the server send a ping frame every interval, the pong frames from the
+// client update its activity time
+// (服务端每隔interval发送一个ping帧，客户端回复的pong帧会更新其活动时间)
+func WithWsPingInterval(interval time.Duration) WsHandlerOption {
+	return func(h *WsHandler) {
+		h.PingInterval = interval
+	}
+}
+
+// WithWsHeartbeat enables the heartbeat detection like WithHeartbeat of the Server
+// (与Server的WithHeartbeat一样开启心跳检测)
+func WithWsHeartbeat(interval time.Duration, option *HeartBeatOption) WsHandlerOption {
+	return func(h *WsHandler) {
+		h.hc = NewHeartbeatCheckerWithOption(interval, option)
+		if h.HeartbeatMax == 0 {
+			h.HeartbeatMax = 3 * interval
+		}
+	}
+}
+
+// NewWsHandler creates a WsHandler, the connections share the taskHandler and connMgr with the tcp server
+// if they are the ones returned by Server.GetTaskHandler() and Server.GetConnMgr()
+// (创建WsHandler，传入Server.GetTaskHandler()以及Server.GetConnMgr()时与tcp服务共享工作池以及连接管理器)
+func NewWsHandler(taskHandler STaskHandler, connMgr SConnManager, opts ...WsHandlerOption) *WsHandler {
+	if taskHandler == nil {
+		panic("sbus: NewWsHandler taskHandler is nil")
+	}
+	h := &WsHandler{
+		taskHandler: taskHandler,
+		connMgr:     connMgr,
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	if h.connMgr == nil {
+		h.connMgr = NewConnManager()
+	}
+	if h.datapack == nil {
+		// A WebSocket frame is a whole msg, so the length field is not needed
+		// (一个WebSocket帧就是一个完整的消息，不需要长度字段)
+		h.datapack = NewTcpDataPack()
+	}
+	return h
+}
+
+// Upgrade upgrades the request and registers the connection in the SConnManager, the caller starts it
+// by SConnection.Start(), an http error has been replied to the client if an error is returned
+// (升级请求并将连接注册到SConnManager中，由调用方通过SConnection.Start()启动连接，返回错误时已经向客户端回复http错误)
+func (h *WsHandler) Upgrade(w http.ResponseWriter, r *http.Request, responseHeader http.Header) (SConnection, error) {
+	return h.UpgradeClientIP(w, r, responseHeader, hostIP(r.RemoteAddr))
+}
+
+// UpgradeClientIP is Upgrade with the client IP resolved by the caller, such as the one behind the trusted
+// proxies, it is checked against the blacklist and set to the connection by PropertyKeyClientIP
+// (使用调用方解析出的客户端IP(例如可信代理之后的IP)的Upgrade，该IP会被黑名单检查，并通过PropertyKeyClientIP设置到连接上)
+func (h *WsHandler) UpgradeClientIP(w http.ResponseWriter, r *http.Request, responseHeader http.Header, clientIP net.IP) (SConnection, error) {
+	if h.connMgr.IsBlocked(clientIP) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return nil, ErrBlocked
+	}
+	if h.MaxConn > 0 && h.connMgr.Len() >= h.MaxConn {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return nil, ErrMaxConn
+	}
+	wsConn, err := h.Upgrader.Upgrade(w, r, responseHeader)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case h.ReadLimit > 0:
+		wsConn.SetReadLimit(h.ReadLimit)
+	case h.ReadLimit == 0:
+		wsConn.SetReadLimit(DefaultWsReadLimit)
+	}
+
+	conn := NewWsConnection(NextConnID(), h.taskHandler, wsConn, h.onConnStart, h.onConnStop, h.datapack, h.connMgr, h.HeartbeatMax, h.PingInterval, h.connOpts...)
+	if h.hc != nil {
+		checker := h.hc.Clone()
+		checker.BindConn(conn)
+		conn.SetHeartBeat(checker)
+	}
+	if clientIP != nil {
+		conn.SetProperty(PropertyKeyClientIP, clientIP.String())
+	}
+	h.connMgr.Add(conn)
+	return conn, nil
+}
+
+func (h *WsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := h.Upgrade(w, r, nil)
+	if err != nil {
+		slog.Ins().Errorf("websocket upgrade %s error: %s", r.RemoteAddr, err)
+		return
+	}
+	go conn.Start()
+}
+
+func (h *WsHandler) GetConnMgr() SConnManager {
+	return h.connMgr
+}
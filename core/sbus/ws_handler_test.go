@@ -0,0 +1,118 @@
+package sbus
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/wwengg/threego/core/sconfig"
+	"github.com/wwengg/threego/core/slog"
+	"github.com/wwengg/threego/core/smsg"
+)
+
+type wsConnRouter struct {
+	BaseRouter
+	conns chan SConnection
+}
+
+func (r *wsConnRouter) Handle(task STask) error {
+	r.conns <- task.GetConnection()
+	return task.GetConnection().SendBuffMsg(NewResponseMsg(task.GetMessage(), RetOK, task.GetData()))
+}
+
+func TestWsHandler(t *testing.T) {
+	slog.NewZapLog(&sconfig.Slog{Director: t.TempDir(), Level: "error"})
+
+	router := &wsConnRouter{conns: make(chan SConnection, 4)}
+	mh := NewTaskHandler(1, 16)
+	mh.AddRouter(10, router)
+	mh.StartWorkerPool()
+	defer mh.Stop()
+
+	started, stopped := make(chan SConnection, 4), make(chan SConnection, 4)
+	h := NewWsHandler(mh, nil, WithWsReadLimit(1024),
+		WithWsOnConnStart(func(conn SConnection) { started <- conn }),
+		WithWsOnConnStop(func(conn SConnection) { stopped <- conn }))
+	// start the connections here instead of ServeHTTP, so the test waits for them to stop
+	// (在这里而不是ServeHTTP中启动连接，使测试可以等待其停止)
+	var wg sync.WaitGroup
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := h.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn.Start()
+		}()
+	}))
+	defer srv.Close()
+	defer func() {
+		h.GetConnMgr().ClearConn()
+		wg.Wait()
+	}()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	client, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// the callbacks and the tasks get the *WsConnection, not the embedded *Connection
+	// (回调以及任务拿到的是*WsConnection，而不是内嵌的*Connection)
+	select {
+	case conn := <-started:
+		if _, ok := conn.(*WsConnection); !ok {
+			t.Fatalf("OnConnStart got %T, want *WsConnection", conn)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the websocket connection is not started")
+	}
+
+	dp := NewTcpDataPack()
+	data, err := dp.Pack(NewNSQMsg(10, 0, smsg.SerializeNone, nil, []byte("hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.WriteMessage(websocket.BinaryMessage, data); err != nil {
+		t.Fatal(err)
+	}
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+	_, frame, err := client.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := dp.Unpack(frame)
+	if err != nil || !bytes.Equal(resp.GetData(), []byte("hello")) {
+		t.Fatalf("unexpected echo %v, %v", resp, err)
+	}
+	if wc, ok := (<-router.conns).(*WsConnection); !ok || wc.GetWsConn() == nil {
+		t.Fatal("the task connection is not a *WsConnection")
+	}
+
+	// a message over ReadLimit stops the connection (超过ReadLimit的消息会停止连接)
+	if err := client.WriteMessage(websocket.BinaryMessage, make([]byte, 2048)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case conn := <-stopped:
+		if _, ok := conn.(*WsConnection); !ok {
+			t.Fatalf("OnConnStop got %T, want *WsConnection", conn)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the connection is not stopped by the read limit")
+	}
+	deadline := time.Now().Add(time.Second)
+	for h.GetConnMgr().Len() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the connection is not removed from the manager")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
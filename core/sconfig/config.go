@@ -12,6 +12,7 @@ type Config struct {
 	RPC        RPC             `mapstructure:"rpc" yaml:"rpc" json:"rpc"`
 	RpcService RpcService      `mapstructure:"rpc-service" yaml:"rpc-service" json:"rpcService"`
 	Nsq        Nsq             `mapstructure:"nsq" yaml:"nsq" json:"nsq"`
+	Sbus       Sbus            `mapstructure:"sbus" yaml:"sbus" json:"sbus"`
 	Redis      Redis           `mapstructure:"redis" yaml:"redis" json:"redis"`
 	RootPath   string          `yaml:"root-path" json:"rootPath" mapstructure:"root-path"`
 	DBList     []SpecializedDB `mapstructure:"db-list" json:"db-list" yaml:"db-list"`
@@ -0,0 +1,54 @@
+package sconfig
+
+type Sbus struct {
+	Name                string         `mapstructure:"name" json:"name" yaml:"name"`
+	IPVersion           string         `mapstructure:"ip-version" json:"ipVersion" yaml:"ip-version"` // tcp, tcp4, tcp6
+	Host                string         `mapstructure:"host" json:"host" yaml:"host"`
+	Port                int            `mapstructure:"port" json:"port" yaml:"port"`
+	MaxConn             int            `mapstructure:"max-conn" json:"maxConn" yaml:"max-conn"`                                       // 最大连接数，0表示不限制
+	WorkerPoolSize      uint32         `mapstructure:"worker-pool-size" json:"workerPoolSize" yaml:"worker-pool-size"`                // 业务工作Worker池的数量
+	MaxTaskChanLen      uint32         `mapstructure:"max-task-chan-len" json:"maxTaskChanLen" yaml:"max-task-chan-len"`              // Worker负责取任务的消息队列长度
+	IOReadBuffSize      uint32         `mapstructure:"io-read-buff-size" json:"ioReadBuffSize" yaml:"io-read-buff-size"`              // 每次读取的缓冲大小
+	HeartbeatMaxMilli   int64          `mapstructure:"heartbeat-max-milli" json:"heartbeatMaxMilli" yaml:"heartbeat-max-milli"`       // 心跳超时时间(毫秒)
+	MaxWorkerPoolSize   uint32         `mapstructure:"max-worker-pool-size" json:"maxWorkerPoolSize" yaml:"max-worker-pool-size"`     // 自动扩容的Worker数量上限，大于worker-pool-size时开启自动扩缩容
+	WorkerIdleMilli     int64          `mapstructure:"worker-idle-milli" json:"workerIdleMilli" yaml:"worker-idle-milli"`             // Worker空闲多久后缩容(毫秒)
+	OrderedDispatch     bool           `mapstructure:"ordered-dispatch" json:"orderedDispatch" yaml:"ordered-dispatch"`               // 同一连接的消息按顺序处理
+	EnqueueTimeoutMilli int64          `mapstructure:"enqueue-timeout-milli" json:"enqueueTimeoutMilli" yaml:"enqueue-timeout-milli"` // 任务队列满时投递的超时时间(毫秒)，超时后以503拒绝，0表示一直阻塞
+	ReaderIdleMilli     int64          `mapstructure:"reader-idle-milli" json:"readerIdleMilli" yaml:"reader-idle-milli"`             // 读空闲超时时间(毫秒)，0表示不启用
+	WriterIdleMilli     int64          `mapstructure:"writer-idle-milli" json:"writerIdleMilli" yaml:"writer-idle-milli"`             // 写空闲超时时间(毫秒)，0表示不启用
+	AllIdleMilli        int64          `mapstructure:"all-idle-milli" json:"allIdleMilli" yaml:"all-idle-milli"`                      // 读写空闲超时时间(毫秒)，0表示不启用
+	WriteTimeoutMilli   int64          `mapstructure:"write-timeout-milli" json:"writeTimeoutMilli" yaml:"write-timeout-milli"`       // 写入socket的超时时间(毫秒)，0表示不超时
+	RateLimit           RateLimit      `mapstructure:"rate-limit" json:"rateLimit" yaml:"rate-limit"`                                 // 连接限流以及黑名单
+	TLS                 SbusTLS        `mapstructure:"tls" json:"tls" yaml:"tls"`                                                     // tcp监听的TLS
+	Encryption          SbusEncryption `mapstructure:"encryption" json:"encryption" yaml:"encryption"`                                // 端到端加密
+}
+
+type SbusEncryption struct {
+	Enable         bool   `mapstructure:"enable" json:"enable" yaml:"enable"`
+	Required       bool   `mapstructure:"required" json:"required" yaml:"required"`                       // 握手之前的消息是否拒绝
+	HandshakeMsgID uint16 `mapstructure:"handshake-msg-id" json:"handshakeMsgId" yaml:"handshake-msg-id"` // 握手消息的msgID，0表示默认的4
+}
+
+type SbusTLS struct {
+	Enable                bool   `mapstructure:"enable" json:"enable" yaml:"enable"`
+	CertPath              string `mapstructure:"cert-path" json:"certPath" yaml:"cert-path"`                                          // 证书路径，与key-path都为空时使用全局的cert-path
+	KeyPath               string `mapstructure:"key-path" json:"keyPath" yaml:"key-path"`                                             // 私钥路径，与cert-path都为空时使用全局的key-path
+	ClientCAPath          string `mapstructure:"client-ca-path" json:"clientCaPath" yaml:"client-ca-path"`                            // 客户端证书的CA，非空时开启双向TLS
+	HandshakeTimeoutMilli int64  `mapstructure:"handshake-timeout-milli" json:"handshakeTimeoutMilli" yaml:"handshake-timeout-milli"` // TLS握手超时时间(毫秒)，0表示默认10秒
+}
+
+type RateLimit struct {
+	ConnRate        float64        `mapstructure:"conn-rate" json:"connRate" yaml:"conn-rate"`                      // 每个连接每秒允许的消息数，0表示不限制
+	ConnBurst       int            `mapstructure:"conn-burst" json:"connBurst" yaml:"conn-burst"`                   // 每个连接允许的突发消息数
+	MsgLimits       []MsgRateLimit `mapstructure:"msg-limits" json:"msgLimits" yaml:"msg-limits"`                   // 按msgID限流
+	Action          string         `mapstructure:"action" json:"action" yaml:"action"`                              // 超出限制时的处理方式: drop, reply
+	DisconnectAfter int            `mapstructure:"disconnect-after" json:"disconnectAfter" yaml:"disconnect-after"` // 超出限制多少次后断开连接，0表示不断开
+	BanMilli        int64          `mapstructure:"ban-milli" json:"banMilli" yaml:"ban-milli"`                      // 断开连接后封禁IP的时间(毫秒)，0表示不封禁
+	Blacklist       []string       `mapstructure:"blacklist" json:"blacklist" yaml:"blacklist"`                     // 禁止连接的IP或CIDR
+}
+
+type MsgRateLimit struct {
+	MsgID int32   `mapstructure:"msg-id" json:"msgId" yaml:"msg-id"`
+	Rate  float64 `mapstructure:"rate" json:"rate" yaml:"rate"`    // 每个连接该msgID每秒允许的消息数
+	Burst int     `mapstructure:"burst" json:"burst" yaml:"burst"` // 每个连接该msgID允许的突发消息数
+}
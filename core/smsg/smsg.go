@@ -1,6 +1,7 @@
 package smsg
 
 import (
+	"github.com/smallnest/rpcx/codec"
 	"github.com/smallnest/rpcx/protocol"
 	"github.com/wwengg/threego/core/utils"
 )
@@ -39,6 +40,14 @@ const (
 
 var Compressors = map[CompressType]protocol.Compressor{
 	None:   &protocol.RawDataCompressor{},
-	Gzip:   &protocol.GzipCompressor{},
+	Gzip:   &utils.GzipCompressor{},
 	Brotli: &utils.BrotliCompressor{},
 }
+
+// Codecs are the codecs to encode and decode the data by SerializeType
+// (根据SerializeType编解码数据的编解码器)
+var Codecs = map[SerializeType]codec.Codec{
+	SerializeNone: &codec.ByteCodec{},
+	JSON:          &codec.JSONCodec{},
+	ProtoBuffer:   &codec.PBCodec{},
+}
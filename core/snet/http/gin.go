@@ -96,6 +96,18 @@ func (g *GinEngine) AddPrivateHandle() {
 
 }
 
+// AddPublicWsListener mounts the WebSocket listener on the public router group
+// (将WebSocket监听挂载到公开路由组)
+func (g *GinEngine) AddPublicWsListener(relativePath string, l *WsListener) {
+	l.Mount(g.PublicRouterGroup, relativePath)
+}
+
+// AddPrivateWsListener mounts the WebSocket listener on the private router group
+// (将WebSocket监听挂载到私有路由组)
+func (g *GinEngine) AddPrivateWsListener(relativePath string, l *WsListener) {
+	l.Mount(g.PrivateRouterGroup, relativePath)
+}
+
 func (g *GinEngine) GetPublicRouterGroup() *gin.RouterGroup {
 	return g.PublicRouterGroup
 }
@@ -1 +1,197 @@
 package http
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wwengg/threego/core/sbus"
+	"github.com/wwengg/threego/core/slog"
+)
+
+var ErrWsUnauthorized = errors.New("websocket unauthorized")
+
+// WsAuthFunc authenticates the token before upgrade, the returned properties are set on the connection
+// before it starts, so OnConnStart can read them
+// (升级之前校验token，返回的属性会在连接启动之前设置到连接上，所以OnConnStart中可以读取)
+type WsAuthFunc func(c *gin.Context, token string) (map[string]any, error)
+
+type WsListenerOption func(l *WsListener)
+
+// WsListener mounts the WebSocket endpoint on a route group of the GinEngine, the connections
+// share the STaskHandler with the tcp server, so the browser clients use the same routers
+// (将WebSocket入口挂载到GinEngine的路由组上，连接与tcp服务共享STaskHandler，浏览器客户端使用相同的路由)
+type WsListener struct {
+	handler *sbus.WsHandler
+
+	// allowed origins, empty means only the same host is allowed, "*" means all
+	// (允许的来源，为空时只允许同源，"*"表示全部允许)
+	allowedOrigins []string
+	authFunc       WsAuthFunc
+	// The query parameter of the token, the Authorization header is used if it is empty
+	// (token所在的query参数，为空时使用Authorization请求头)
+	tokenQuery string
+
+	onConnStart func(conn sbus.SConnection)
+	onConnStop  func(conn sbus.SConnection)
+	handlerOpts []sbus.WsHandlerOption
+
+	// connWg waits for the connections started by Handle (等待Handle启动的连接)
+	connWg sync.WaitGroup
+}
+
+func WithWsAllowedOrigins(origins ...string) WsListenerOption {
+	return func(l *WsListener) {
+		l.allowedOrigins = append(l.allowedOrigins, origins...)
+	}
+}
+
+func WithWsAuth(f WsAuthFunc) WsListenerOption {
+	return func(l *WsListener) {
+		l.authFunc = f
+	}
+}
+
+func WithWsTokenQuery(name string) WsListenerOption {
+	return func(l *WsListener) {
+		l.tokenQuery = name
+	}
+}
+
+func WithWsOnConnStart(f func(conn sbus.SConnection)) WsListenerOption {
+	return func(l *WsListener) {
+		l.onConnStart = f
+	}
+}
+
+func WithWsOnConnStop(f func(conn sbus.SConnection)) WsListenerOption {
+	return func(l *WsListener) {
+		l.onConnStop = f
+	}
+}
+
+// WithWsHandlerOptions passes the options to the sbus.WsHandler, such as the ping interval and heartbeat
+// (将选项传给sbus.WsHandler，例如ping间隔以及心跳)
+func WithWsHandlerOptions(opts ...sbus.WsHandlerOption) WsListenerOption {
+	return func(l *WsListener) {
+		l.handlerOpts = append(l.handlerOpts, opts...)
+	}
+}
+
+// NewWsListener creates a WsListener, datapack nil means sbus.NewTcpDataPack()
+// (创建WsListener，datapack为nil时使用sbus.NewTcpDataPack())
+func NewWsListener(taskHandler sbus.STaskHandler, connMgr sbus.SConnManager, datapack sbus.SDataPack, opts ...WsListenerOption) *WsListener {
+	l := &WsListener{
+		tokenQuery: "token",
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+
+	handlerOpts := []sbus.WsHandlerOption{
+		sbus.WithWsOnConnStart(l.onConnStart),
+		sbus.WithWsOnConnStop(l.onConnStop),
+	}
+	if datapack != nil {
+		handlerOpts = append(handlerOpts, sbus.WithWsDataPack(datapack))
+	}
+	l.handler = sbus.NewWsHandler(taskHandler, connMgr, append(handlerOpts, l.handlerOpts...)...)
+	if len(l.allowedOrigins) > 0 {
+		// The origin has been checked before upgrade (升级之前已经校验过来源)
+		l.handler.Upgrader.CheckOrigin = func(r *http.Request) bool { return true }
+	}
+	return l
+}
+
+// Mount registers the endpoint on the group, such as GinEngine.GetPublicRouterGroup()
+// (将入口注册到路由组上，例如GinEngine.GetPublicRouterGroup())
+func (l *WsListener) Mount(group *gin.RouterGroup, relativePath string) {
+	group.GET(relativePath, l.Handle)
+}
+
+// Handle checks the blacklist, origin and token, then upgrades the request and starts the connection,
+// the client IP behind the trusted proxies of gin is checked against the blacklist and banned by the rate limiter
+// (校验黑名单、来源以及token，然后升级请求并启动连接，黑名单校验以及限流封禁的都是gin可信代理之后的客户端IP)
+func (l *WsListener) Handle(c *gin.Context) {
+	clientIP := net.ParseIP(c.ClientIP())
+	if l.handler.GetConnMgr().IsBlocked(clientIP) {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	if !l.checkOrigin(c.Request) {
+		slog.Ins().Warnf("websocket origin %s of %s is not allowed", c.GetHeader("Origin"), c.ClientIP())
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+
+	var props map[string]any
+	if l.authFunc != nil {
+		var err error
+		if props, err = l.authFunc(c, l.token(c)); err != nil {
+			slog.Ins().Warnf("websocket auth %s error: %s", c.ClientIP(), err)
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+	}
+
+	conn, err := l.handler.UpgradeClientIP(c.Writer, c.Request, nil, clientIP)
+	if err != nil {
+		slog.Ins().Errorf("websocket upgrade %s error: %s", c.ClientIP(), err)
+		c.Abort()
+		return
+	}
+	for k, v := range props {
+		conn.SetProperty(k, v)
+	}
+	l.connWg.Add(1)
+	go func() {
+		defer l.connWg.Done()
+		conn.Start()
+	}()
+}
+
+func (l *WsListener) GetConnMgr() sbus.SConnManager {
+	return l.handler.GetConnMgr()
+}
+
+// Wait waits for the connections started by Handle to return, such as after the SConnManager is cleared
+// on shutdown, the SConnManager may be shared with the other servers so it is not cleared here
+// (等待Handle启动的连接返回，例如关闭时清空SConnManager之后，SConnManager可能与其他服务共享，因此这里不会清空)
+func (l *WsListener) Wait() {
+	l.connWg.Wait()
+}
+
+func (l *WsListener) token(c *gin.Context) string {
+	if l.tokenQuery != "" {
+		if token := c.Query(l.tokenQuery); token != "" {
+			return token
+		}
+	}
+	return strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+}
+
+// checkOrigin allows the requests without Origin header, which are not from browsers
+// (允许没有Origin请求头的请求，这些请求不是来自浏览器)
+func (l *WsListener) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if len(l.allowedOrigins) == 0 {
+		return strings.EqualFold(u.Host, r.Host)
+	}
+	for _, allowed := range l.allowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) || strings.EqualFold(allowed, u.Host) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package http
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/wwengg/threego/core/sbus"
+	"github.com/wwengg/threego/core/sconfig"
+	"github.com/wwengg/threego/core/slog"
+)
+
+func TestWsListener(t *testing.T) {
+	slog.NewZapLog(&sconfig.Slog{Director: t.TempDir(), Level: "error"})
+	gin.SetMode(gin.TestMode)
+
+	th := sbus.NewTaskHandler(1, 4)
+	th.StartWorkerPool()
+	defer th.Stop()
+
+	blacklist, err := sbus.NewIPBlacklist("203.0.113.7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan sbus.SConnection, 1)
+	l := NewWsListener(th, sbus.NewConnManager(sbus.WithBlacklist(blacklist)), nil,
+		WithWsAllowedOrigins("https://game.example.com"),
+		WithWsAuth(func(c *gin.Context, token string) (map[string]any, error) {
+			if token != "secret" {
+				return nil, errors.New("invalid token")
+			}
+			return map[string]any{"uid": "42"}, nil
+		}),
+		WithWsOnConnStart(func(conn sbus.SConnection) { started <- conn }))
+	engine := gin.New()
+	l.Mount(engine.Group("/"), "/ws")
+	srv := httptest.NewServer(engine)
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+
+	// the checks before upgrade reply an http error (升级之前的校验失败时回复http错误)
+	for _, tc := range []struct {
+		name   string
+		query  string
+		header http.Header
+		status int
+	}{
+		{"blocked", "?token=secret", http.Header{"X-Forwarded-For": {"203.0.113.7"}}, http.StatusForbidden},
+		{"origin", "?token=secret", http.Header{"Origin": {"https://evil.example.com"}}, http.StatusForbidden},
+		{"token", "?token=wrong", http.Header{"Origin": {"https://game.example.com"}}, http.StatusUnauthorized},
+	} {
+		conn, resp, err := websocket.DefaultDialer.Dial(url+tc.query, tc.header)
+		if err == nil {
+			conn.Close()
+			t.Fatalf("%s: expected the upgrade to fail", tc.name)
+		}
+		if resp == nil || resp.StatusCode != tc.status {
+			t.Fatalf("%s: unexpected response %v, want status %d", tc.name, resp, tc.status)
+		}
+	}
+
+	// the token in the Authorization header is used without the query parameter, the properties returned
+	// by the auth and the client IP behind the proxy are ready in OnConnStart
+	// (没有query参数时使用Authorization请求头中的token，校验返回的属性以及代理之后的客户端IP在OnConnStart中已就绪)
+	client, _, err := websocket.DefaultDialer.Dial(url, http.Header{
+		"Origin":          {"https://game.example.com"},
+		"Authorization":   {"Bearer secret"},
+		"X-Forwarded-For": {"198.51.100.9"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case conn := <-started:
+		if uid, err := sbus.GetPropertyAs[string](conn, "uid"); err != nil || uid != "42" {
+			t.Fatalf("unexpected uid %q, %v", uid, err)
+		}
+		if ip, err := sbus.GetPropertyAs[string](conn, sbus.PropertyKeyClientIP); err != nil || ip != "198.51.100.9" {
+			t.Fatalf("unexpected client IP %q, %v", ip, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the websocket connection is not started")
+	}
+	if l.GetConnMgr().Len() != 1 {
+		t.Fatalf("unexpected connections %d, want 1", l.GetConnMgr().Len())
+	}
+
+	client.Close()
+	deadline := time.Now().Add(time.Second)
+	for l.GetConnMgr().Len() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the connection is not removed after the client closes")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	l.Wait()
+}
+
+func TestWsListenerCheckOrigin(t *testing.T) {
+	for _, tc := range []struct {
+		allowed []string
+		origin  string
+		want    bool
+	}{
+		{nil, "", true},
+		{nil, "http://api.example.com", true},
+		{nil, "http://other.example.com", false},
+		{[]string{"*"}, "http://other.example.com", true},
+		{[]string{"other.example.com"}, "https://other.example.com", true},
+		{[]string{"https://other.example.com"}, "http://other.example.com", false},
+		{[]string{"https://other.example.com"}, "://bad", false},
+	} {
+		l := &WsListener{allowedOrigins: tc.allowed}
+		r := httptest.NewRequest(http.MethodGet, "http://api.example.com/ws", nil)
+		if tc.origin != "" {
+			r.Header.Set("Origin", tc.origin)
+		}
+		if got := l.checkOrigin(r); got != tc.want {
+			t.Errorf("allowed %v origin %q: got %v, want %v", tc.allowed, tc.origin, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/wwengg/threego/core/sbus"
+)
+
+// registerScript sets the node of the device and returns the node set before
+// (设置设备所在的节点并返回之前的节点)
+var registerScript = redis.NewScript(`
+local prev = redis.call('HGET', KEYS[1], ARGV[1])
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+if tonumber(ARGV[3]) > 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[3])
+end
+return prev
+`)
+
+// unregisterScript deletes the device only if it is still on the node
+// (仅当设备仍在该节点上时删除)
+var unregisterScript = redis.NewScript(`
+if redis.call('HGET', KEYS[1], ARGV[1]) == ARGV[2] then
+	return redis.call('HDEL', KEYS[1], ARGV[1])
+end
+return 0
+`)
+
+// RedisUserRegistry implements sbus.SUserRegistry with a redis hash per user, device -> nodeID, and a key
+// per node that expires if the node is not kept alive
+// (以每个用户一个redis hash实现sbus.SUserRegistry，device -> nodeID，每个节点一个key，节点未保持存活时过期)
+type RedisUserRegistry struct {
+	*RedisBase
+	keyformat     string
+	nodeKeyformat string
+	// The hash expires if the user does not log in again, so the hashes of the users who never come back
+	// are cleaned up, 0 means never (用户不再登录时hash会过期，使不再登录的用户的hash被清理，0表示永不过期)
+	expire time.Duration
+}
+
+var _ sbus.SUserRegistry = (*RedisUserRegistry)(nil)
+
+// NewRedisUserRegistry creates the registry, keyformat must contain a %s for the uid, such as "gateway:user:%s",
+// and nodeKeyformat a %s for the nodeID, such as "gateway:node:%s"
+// (创建注册中心，keyformat必须包含uid的%s，例如"gateway:user:%s"，nodeKeyformat必须包含nodeID的%s，例如"gateway:node:%s")
+func NewRedisUserRegistry(redisBase *RedisBase, keyformat, nodeKeyformat string, expire time.Duration) *RedisUserRegistry {
+	for _, format := range []string{keyformat, nodeKeyformat} {
+		if !strings.Contains(format, "%s") {
+			panic(fmt.Sprintf("store: keyformat %q of RedisUserRegistry must contain %%s", format))
+		}
+	}
+	return &RedisUserRegistry{
+		RedisBase:     redisBase,
+		keyformat:     keyformat,
+		nodeKeyformat: nodeKeyformat,
+		expire:        expire,
+	}
+}
+
+func (r *RedisUserRegistry) Register(ctx context.Context, uid, device, nodeID string) (string, error) {
+	key := fmt.Sprintf(r.keyformat, uid)
+	prev, err := registerScript.Run(ctx, r.RedisCli, []string{key}, device, nodeID, r.expire.Milliseconds()).Text()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	return prev, err
+}
+
+func (r *RedisUserRegistry) Unregister(ctx context.Context, uid, device, nodeID string) error {
+	key := fmt.Sprintf(r.keyformat, uid)
+	return unregisterScript.Run(ctx, r.RedisCli, []string{key}, device, nodeID).Err()
+}
+
+// Lookup leaves out the devices on the nodes that are not alive and deletes them from the hash
+// (排除不存活节点上的设备，并将其从hash中删除)
+func (r *RedisUserRegistry) Lookup(ctx context.Context, uid string) (map[string]string, error) {
+	devices, err := r.RedisCli.HGetAll(ctx, fmt.Sprintf(r.keyformat, uid)).Result()
+	if err != nil || len(devices) == 0 {
+		return devices, err
+	}
+	alive := make(map[string]*redis.IntCmd)
+	pipe := r.RedisCli.Pipeline()
+	for _, nodeID := range devices {
+		if _, ok := alive[nodeID]; !ok {
+			alive[nodeID] = pipe.Exists(ctx, fmt.Sprintf(r.nodeKeyformat, nodeID))
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	for device, nodeID := range devices {
+		if alive[nodeID].Val() > 0 {
+			continue
+		}
+		delete(devices, device)
+		if err := r.Unregister(ctx, uid, device, nodeID); err != nil {
+			return nil, err
+		}
+	}
+	return devices, nil
+}
+
+func (r *RedisUserRegistry) KeepAlive(ctx context.Context, nodeID string, ttl time.Duration) error {
+	return r.RedisCli.Set(ctx, fmt.Sprintf(r.nodeKeyformat, nodeID), 1, ttl).Err()
+}
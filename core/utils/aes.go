@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+var ErrCiphertextTooShort = errors.New("ciphertext too short")
+
+// NewAESGCM 使用16、24或32字节的密钥创建AES-GCM
+func NewAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+/*
+AESGCMSeal 使用随机nonce加密plaintext，返回nonce+密文
+additionalData不加密但参与认证，解密时必须一致
+*/
+func AESGCMSeal(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	out := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, out); err != nil {
+		return nil, err
+	}
+	return aead.Seal(out, out, plaintext, additionalData), nil
+}
+
+// AESGCMOpen 解密AESGCMSeal的结果
+func AESGCMOpen(aead cipher.AEAD, data, additionalData []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize()+aead.Overhead() {
+		return nil, ErrCiphertextTooShort
+	}
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
+
+/*
+AESGCMSealCounter 使用prefix+counter组成的nonce加密plaintext，返回8字节大端counter+密文
+同一个密钥下prefix与counter的组合不能重复，接收方可以据此拒绝重放的数据
+*/
+func AESGCMSealCounter(aead cipher.AEAD, prefix uint32, counter uint64, plaintext, additionalData []byte) []byte {
+	out := make([]byte, 8, 8+len(plaintext)+aead.Overhead())
+	binary.BigEndian.PutUint64(out, counter)
+	return aead.Seal(out, counterNonce(aead, prefix, counter), plaintext, additionalData)
+}
+
+// AESGCMOpenCounter 解密AESGCMSealCounter的结果，返回counter与明文
+func AESGCMOpenCounter(aead cipher.AEAD, prefix uint32, data, additionalData []byte) (uint64, []byte, error) {
+	if len(data) < 8+aead.Overhead() {
+		return 0, nil, ErrCiphertextTooShort
+	}
+	counter := binary.BigEndian.Uint64(data)
+	plaintext, err := aead.Open(nil, counterNonce(aead, prefix, counter), data[8:], additionalData)
+	if err != nil {
+		return 0, nil, err
+	}
+	return counter, plaintext, nil
+}
+
+// counterNonce 返回4字节大端prefix+8字节大端counter，前面不足的部分补0
+func counterNonce(aead cipher.AEAD, prefix uint32, counter uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint32(nonce[len(nonce)-12:], prefix)
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], counter)
+	return nonce
+}
@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// MaxUnzipSize is the max size of the unzipped data, the zipped data comes from the clients and may be
+// a decompression bomb (解压后数据的最大长度，压缩数据来自客户端，可能是解压炸弹)
+var MaxUnzipSize int64 = 16 << 20
+
+var ErrUnzipTooLarge = errors.New("unzipped data is too large")
+
+// readAllLimit reads r up to MaxUnzipSize (最多读取MaxUnzipSize字节)
+func readAllLimit(r io.Reader) ([]byte, error) {
+	limit := MaxUnzipSize
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("%w: more than %d bytes", ErrUnzipTooLarge, limit)
+	}
+	return data, nil
+}
+
+var gzipWriterPool = sync.Pool{
+	New: func() interface{} {
+		return gzip.NewWriter(nil)
+	},
+}
+
+// GzipCompressor is the same as protocol.GzipCompressor of rpcx, except that the zipped data does not
+// share memory with a pooled buffer, so it is safe to be used by several goroutines
+// (与rpcx的protocol.GzipCompressor相同，区别是压缩后的数据不与池化的buffer共享内存，可以被多个协程安全使用)
+type GzipCompressor struct{}
+
+func (c GzipCompressor) Zip(data []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w := gzipWriterPool.Get().(*gzip.Writer)
+	defer gzipWriterPool.Put(w)
+	w.Reset(&b)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (c GzipCompressor) Unzip(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readAllLimit(r)
+}
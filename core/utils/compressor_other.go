@@ -5,7 +5,6 @@ package utils
 
 import (
 	"bytes"
-	"io"
 
 	"github.com/andybalholm/brotli"
 )
@@ -27,5 +26,5 @@ func (c BrotliCompressor) Zip(data []byte) ([]byte, error) {
 
 func (c BrotliCompressor) Unzip(data []byte) ([]byte, error) {
 	r := brotli.NewReader(bytes.NewReader(data))
-	return io.ReadAll(r)
+	return readAllLimit(r)
 }
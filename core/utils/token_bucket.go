@@ -0,0 +1,43 @@
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+// TokenBucket allows rate events per second on average and burst events at once
+// (平均每秒允许rate个事件，最多一次允许burst个事件)
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket creates a full bucket, burst less than 1 is treated as 1
+// (创建一个满的令牌桶，burst小于1时按1处理)
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	b := float64(max(burst, 1))
+	return &TokenBucket{rate: rate, burst: b, tokens: b, last: time.Now()}
+}
+
+// Allow takes a token if there is one (有令牌时取走一个令牌)
+func (tb *TokenBucket) Allow() bool {
+	return tb.AllowAt(time.Now())
+}
+
+// AllowAt is Allow at the time now (在now时刻的Allow)
+func (tb *TokenBucket) AllowAt(now time.Time) bool {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if elapsed := now.Sub(tb.last); elapsed > 0 {
+		tb.tokens = min(tb.burst, tb.tokens+elapsed.Seconds()*tb.rate)
+		tb.last = now
+	}
+	if tb.tokens < 1 {
+		return false
+	}
+	tb.tokens--
+	return true
+}